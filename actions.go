@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"github.com/allen-b1/llgen/parser"
+	"go/scanner"
+	"go/token"
+	"strconv"
+	"strings"
+)
+
+// actionVar is a $n in an action, at action[start:end].
+type actionVar struct {
+	start, end int
+	n          int
+}
+
+// actionVars returns the $n variables of an action in order. It scans the
+// action as Go, so a $n inside a string or a comment is left alone.
+func actionVars(action string) []actionVar {
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(action))
+	var s scanner.Scanner
+	s.Init(file, []byte(action), func(token.Position, string) {}, 0)
+
+	var vars []actionVar
+	dollar := -1
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			return vars
+		}
+		offset := file.Offset(pos)
+		// $1.x scans as the number 1. and x, so only the digits count.
+		digits := lit[:len(lit)-len(strings.TrimLeft(lit, "0123456789"))]
+		if (tok == token.INT || tok == token.FLOAT) && dollar >= 0 && offset == dollar+1 && digits != "" {
+			n, _ := strconv.Atoi(digits)
+			vars = append(vars, actionVar{start: dollar, end: offset + len(digits), n: n})
+		}
+		dollar = -1
+		if tok == token.ILLEGAL && lit == "$" {
+			dollar = offset
+		}
+	}
+}
+
+// valueType returns the Go type an action sees for a referenced unit:
+// the declared type of typed rules and of lists of them, and the node
+// itself otherwise.
+func (g *generator) valueType(r ref) string {
+	if l, ok := g.lists[r.name]; ok && !l.item.token && g.types[l.item.name] != "" {
+		return "[]" + g.types[l.item.name]
+	}
+	if !r.token && g.types[r.name] != "" {
+		return g.types[r.name]
+	}
+	return r.typ
+}
+
+// valueCode returns code that declares v as the value of field, a unit
+// with the given suffix.
+func (g *generator) valueCode(v string, field string, r ref, suffix string) string {
+	typ := g.valueType(r)
+	if typ == r.typ {
+		return fmt.Sprintf("\t%s := %s\n", v, field)
+	}
+
+	if _, ok := g.lists[r.name]; ok {
+		switch suffix {
+		case "opt":
+			return fmt.Sprintf(`	var %s %s
+	if %s != nil {
+		for _, item := range %s.Items {
+			%s = append(%s, item.Value())
+		}
+	}
+`, v, typ, field, field, v, v)
+		case "ell":
+			return fmt.Sprintf("\t%s := %s\n", v, field)
+		}
+		return fmt.Sprintf(`	var %s %s
+	for _, item := range %s.Items {
+		%s = append(%s, item.Value())
+	}
+`, v, typ, field, v, v)
+	}
+
+	if suffix == "opt" {
+		return fmt.Sprintf(`	var %s %s
+	if %s != nil {
+		%s = %s.Value()
+	}
+`, v, typ, field, v, field)
+	}
+	if suffix == "ell" {
+		return fmt.Sprintf(`	var %s []%s
+	for _, item := range %s {
+		%s = append(%s, item.Value())
+	}
+`, v, typ, field, v, v)
+	}
+	return fmt.Sprintf("\t%s := %s.Value()\n", v, field)
+}
+
+// actionRefs returns the $n variables used by an action, checking that
+// each refers to one of count values.
+func actionRefs(name string, action string, count int) (map[int]bool, error) {
+	refs := make(map[int]bool)
+	for _, v := range actionVars(action) {
+		if v.n < 1 || v.n > count {
+			return nil, fmt.Errorf("action of %s refers to $%v, but the rule has %v values", name, v.n, count)
+		}
+		refs[v.n] = true
+	}
+	return refs, nil
+}
+
+// indentAction replaces $n with the value variables and reindents the
+// action's lines, which keep their indentation from the grammar file.
+func indentAction(action string) string {
+	vars := actionVars(action)
+	for i := len(vars) - 1; i >= 0; i-- {
+		v := vars[i]
+		action = action[:v.start] + fmt.Sprintf("v%v", v.n) + action[v.end:]
+	}
+	lines := strings.Split(action, "\n")
+	indent := ""
+	found := false
+	for _, line := range lines[1:] {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		lead := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if !found || len(lead) < len(indent) {
+			indent = lead
+			found = true
+		}
+	}
+
+	str := ""
+	for i, line := range lines {
+		if i != 0 {
+			line = strings.TrimPrefix(line, indent)
+		}
+		str += "\t" + line + "\n"
+	}
+	return str
+}
+
+// generateValue emits the Value method of a rule with a %type, which
+// runs its action over the values of its parts, along with ParseXValue.
+func (g *generator) generateValue(n parser.NodeStatementExpr) (string, error) {
+	name := n.I0.Data
+	typ := g.types[name]
+	if typ == "" {
+		if n.I3 != nil {
+			return "", fmt.Errorf("rule %s has an action but no %%type", name)
+		}
+		return "", nil
+	}
+	newName := g.goName(name)
+
+	body := ""
+	if expr, ok := n.I2.I.(parser.NodeExprOr); ok {
+		code, err := g.orValue(name, expr, n.I3)
+		if err != nil {
+			return "", err
+		}
+		body = code
+	}
+	if expr, ok := n.I2.I.(parser.NodeExprAnd); ok {
+		if n.I3 == nil {
+			return "", fmt.Errorf("rule %s has a %%type but no action", name)
+		}
+		code, err := g.andValue(name, expr, n.I3.Data)
+		if err != nil {
+			return "", err
+		}
+		body = code
+	}
+
+	return fmt.Sprintf(`
+func (node Node%s) Value() %s {
+%s}
+
+func (p *Parser) Parse%sValue(in []Token) (%s, int, error) {
+	node, n, err := p.Parse%s(in)
+	if err != nil {
+		var zero %s
+		return zero, 0, err
+	}
+	return node.Value(), n, nil
+}
+`, newName, typ, body, newName, typ, newName, typ), nil
+}
+
+func (g *generator) andValue(name string, expr parser.NodeExprAnd, action string) (string, error) {
+	type field struct {
+		r      ref
+		suffix string
+	}
+	var fields []field
+	for _, unitell := range expr.I0 {
+		if _, ok := unitell.I.(parser.NodeUnitPred); ok {
+			continue
+		}
+		if _, ok := unitell.I.(parser.Token); ok {
+			continue
+		}
+		unit, suffix := handleUnitEll(unitell)
+		if suffix == "and" || suffix == "not" {
+			continue
+		}
+		r, err := g.resolve(unit)
+		if err != nil {
+			return "", err
+		}
+		fields = append(fields, field{r, suffix})
+	}
+
+	refs, err := actionRefs(name, action, len(fields))
+	if err != nil {
+		return "", err
+	}
+	str := ""
+	for i, f := range fields {
+		if refs[i+1] {
+			str += g.valueCode(fmt.Sprintf("v%v", i+1), fmt.Sprintf("node.I%v", i), f.r, f.suffix)
+		}
+	}
+	return str + indentAction(action), nil
+}
+
+// orValue returns the body of Value for an alternation. Without an action
+// every alternative must have a type, and its value is passed through;
+// with one, $1 is the value of the alternative that matched.
+func (g *generator) orValue(name string, expr parser.NodeExprOr, action *parser.Token) (string, error) {
+	var units []parser.NodeUnit
+	units = append(units, expr.I0, expr.I2)
+	for _, ext := range expr.I3 {
+		units = append(units, ext.I1)
+	}
+
+	cases := ""
+	for _, unit := range units {
+		r, err := g.resolve(unit)
+		if err != nil {
+			return "", err
+		}
+		if r.token || g.types[r.name] == "" {
+			if action == nil {
+				return "", fmt.Errorf("alternative %s of %s has no %%type, so %s needs an action", r.name, name, name)
+			}
+			continue
+		}
+		if action == nil {
+			cases += fmt.Sprintf("\tcase %s:\n\t\treturn alt.Value()\n", r.typ)
+		} else {
+			cases += fmt.Sprintf("\tcase %s:\n\t\tv1 = alt.Value()\n", r.typ)
+		}
+	}
+
+	if action == nil {
+		return fmt.Sprintf("\tswitch alt := node.I.(type) {\n%s\t}\n\tpanic(%q)\n", cases, "invalid tree for "+name), nil
+	}
+
+	refs, err := actionRefs(name, action.Data, 1)
+	if err != nil {
+		return "", err
+	}
+	str := ""
+	if refs[1] {
+		str += "\tvar v1 interface{} = node.I\n"
+		if cases != "" {
+			str += fmt.Sprintf("\tswitch alt := node.I.(type) {\n%s\t}\n", cases)
+		}
+	}
+	return str + indentAction(action.Data), nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/allen-b1/llgen/parser"
+)
+
+// coverageMain is the program that parses the inputs named on its standard
+// input with a parser generated with coverage, and writes the counts.
+const coverageMain = `package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"llgen/parser"
+)
+
+func main() {
+	paths := bufio.NewScanner(os.Stdin)
+	for paths.Scan() {
+		text, err := ioutil.ReadFile(paths.Text())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if _, err := parser.Parse(string(text)); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", paths.Text(), err)
+		}
+	}
+	parser.WriteCoverage(os.Stdout)
+}
+`
+
+// coverageReport is what llgen coverage reports: the coverage points of a
+// grammar, "rule\tpoint", in order, and how many times each was taken.
+type coverageReport struct {
+	points []string
+	counts map[string]uint64
+	where  map[string]string // rule name to where it is defined
+}
+
+// coverageParser generates the parser of a grammar with coverage, with the
+// text in open for the files there, as for loadGrammarOpen. It returns the
+// parser's source, its generator and a report of its points with no counts.
+func coverageParser(path string, open map[string]string) (string, *generator, *coverageReport, error) {
+	l := &loader{loaded: make(map[string]bool), defined: make(map[string]string), open: open}
+	if err := l.load(path, "", ""); err != nil {
+		return "", nil, nil, err
+	}
+	g := newGenerator(options{coverage: true, files: l.files})
+	src, err := g.generateAll(parser.NodeStatements{I0: l.out})
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return src, g, &coverageReport{points: g.points, counts: make(map[string]uint64), where: l.defined}, nil
+}
+
+// runCorpus parses the files of inputs, and of the directories among them,
+// with the generated parser src, adding what it matches to r.
+func (r *coverageReport) runCorpus(src string, inputs []string) error {
+	var files []string
+	for _, input := range inputs {
+		err := filepath.Walk(input, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				abs, err := filepath.Abs(path)
+				if err != nil {
+					return err
+				}
+				files = append(files, abs)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	out, err := goRun(src, coverageMain, strings.Join(files, "\n"))
+	if err != nil {
+		return err
+	}
+	return r.add("parser output", string(out))
+}
+
+// goRun builds a generated parser, as package llgen/parser, with a main
+// package, and runs it with stdin, returning its output.
+func goRun(src string, main string, stdin string) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "llgen")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "parser"), 0755); err != nil {
+		return nil, err
+	}
+	for name, text := range map[string]string{
+		"go.mod":           "module llgen\n\ngo 1.16\n",
+		"main.go":          main,
+		"parser/parser.go": src,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	cmd := exec.Command("go", "run", ".")
+	cmd.Dir = dir
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("running the parser: %v", err)
+	}
+	return out, nil
+}
+
+// add adds the counts written by WriteCoverage.
+func (r *coverageReport) add(name string, text string) error {
+	s := bufio.NewScanner(strings.NewReader(text))
+	for line := 1; s.Scan(); line++ {
+		if s.Text() == "" {
+			continue
+		}
+		i := strings.LastIndex(s.Text(), "\t")
+		count, err := strconv.ParseUint(s.Text()[i+1:], 10, 64)
+		if i < 0 || err != nil || !strings.Contains(s.Text()[:i], "\t") {
+			return fmt.Errorf("%s:%v: rule, point and count expected", name, line)
+		}
+		r.counts[s.Text()[:i]] += count
+	}
+	return s.Err()
+}
+
+// location returns where the rule of a point is defined. Instances of
+// parameterized rules are where the parameterized rule is.
+func (r *coverageReport) location(point string) string {
+	rule := strings.SplitN(point, "\t", 2)[0]
+	return r.where[strings.SplitN(rule, "(", 2)[0]]
+}
+
+func (r *coverageReport) covered() int {
+	covered := 0
+	for _, point := range r.points {
+		if r.counts[point] != 0 {
+			covered++
+		}
+	}
+	return covered
+}
+
+func (r *coverageReport) text() string {
+	b := &strings.Builder{}
+	w := tabwriter.NewWriter(b, 0, 8, 2, ' ', 0)
+	for _, point := range r.points {
+		fmt.Fprintf(w, "%s\t%s\t%v", r.location(point), point, r.counts[point])
+		if r.counts[point] == 0 {
+			fmt.Fprint(w, "\tnever taken")
+		}
+		fmt.Fprint(w, "\n")
+	}
+	w.Flush()
+	fmt.Fprintf(b, "covered %v of %v points\n", r.covered(), len(r.points))
+	return b.String()
+}
+
+const coverageStyle = `body { font-family: sans-serif; margin: 2em; }
+td, th { text-align: left; padding: 0.2em 1em 0.2em 0; }
+td.count { text-align: right; }
+tr.never { background: #fdd; }
+.where { color: #666; font-size: small; }`
+
+func (r *coverageReport) html(title string) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n<style>\n%s\n</style>\n</head>\n<body>\n", html.EscapeString(title), coverageStyle)
+	fmt.Fprintf(b, "<h1>%s</h1>\n<p>Covered %v of %v points.</p>\n<table>\n", html.EscapeString(title), r.covered(), len(r.points))
+	rule := ""
+	for _, point := range r.points {
+		parts := strings.SplitN(point, "\t", 2)
+		if parts[0] != rule {
+			rule = parts[0]
+			fmt.Fprintf(b, "<tr><th colspan=\"2\">%s <span class=\"where\">%s</span></th></tr>\n", html.EscapeString(rule), html.EscapeString(r.location(point)))
+		}
+		class := ""
+		if r.counts[point] == 0 {
+			class = ` class="never"`
+		}
+		fmt.Fprintf(b, "<tr%s><td>%s</td><td class=\"count\">%v</td></tr>\n", class, html.EscapeString(parts[1]), r.counts[point])
+	}
+	b.WriteString("</table>\n</body>\n</html>\n")
+	return b.String()
+}
+
+func coverageCommand(args []string) error {
+	flags := flag.NewFlagSet("coverage", flag.ExitOnError)
+	asHTML := flags.Bool("html", false, "write the report as HTML")
+	out := flags.String("o", "", "write the report to `file` instead of standard output")
+	var profiles []string
+	flags.Func("profile", "add the counts in `file`, written by WriteCoverage of a parser generated with -coverage; may be repeated", func(path string) error {
+		profiles = append(profiles, path)
+		return nil
+	})
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: llgen coverage [FLAGS] GRAMMAR [INPUT...]\n\nParses each input, or each file in an input directory, with a parser that counts what it matches, and reports how many times each rule, alternative and optional or repeated part was taken.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	src, g, r, err := coverageParser(flags.Arg(0), nil)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range profiles {
+		text, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := r.add(path, string(text)); err != nil {
+			return err
+		}
+	}
+	if inputs := flags.Args()[1:]; len(inputs) != 0 {
+		if len(g.starts) == 0 || len(g.tokens) == 0 {
+			return fmt.Errorf("parsing inputs needs a %%start rule and tokens")
+		}
+		if err := r.runCorpus(src, inputs); err != nil {
+			return err
+		}
+	}
+
+	report := r.text()
+	if *asHTML {
+		report = r.html(filepath.Base(flags.Arg(0)) + " coverage")
+	}
+	if *out == "" {
+		_, err = os.Stdout.WriteString(report)
+		return err
+	}
+	return ioutil.WriteFile(*out, []byte(report), 0644)
+}
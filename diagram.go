@@ -0,0 +1,375 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Sizes used to lay out railroad diagrams, in pixels.
+const (
+	railRadius = 10 // of the arcs where tracks split and join
+	railGap    = 10 // between parts of a sequence and between stacked tracks
+	railHeight = 22 // of boxes
+	railChar   = 8  // width of a character in a box
+	railMargin = 20
+)
+
+// railItem is a laid out part of a railroad diagram. The track enters on
+// the left and leaves on the right at the same height; up and down are how
+// far the item extends above and below the track.
+type railItem interface {
+	size() (w, up, down int)
+	draw(b *strings.Builder, x, y int)
+}
+
+// railBox is a token or rule in a box, linked to where it is described if
+// href is set.
+type railBox struct {
+	text  string
+	class string // token, rule, param or check
+	href  string
+}
+
+func (r railBox) size() (int, int, int) {
+	return utf8.RuneCountInString(r.text)*railChar + 2*railGap, railHeight / 2, railHeight / 2
+}
+
+func (r railBox) draw(b *strings.Builder, x, y int) {
+	w, up, _ := r.size()
+	if r.href != "" {
+		fmt.Fprintf(b, `<a href="%s">`, html.EscapeString(r.href))
+	}
+	rx := 0
+	if r.class == "token" {
+		rx = railHeight / 2
+	}
+	fmt.Fprintf(b, `<g class="%s"><rect x="%v" y="%v" width="%v" height="%v" rx="%v"/>`, r.class, x, y-up, w, railHeight, rx)
+	fmt.Fprintf(b, `<text x="%v" y="%v">%s</text></g>`, x+w/2, y+4, html.EscapeString(r.text))
+	if r.href != "" {
+		b.WriteString("</a>")
+	}
+	b.WriteString("\n")
+}
+
+// railSkip is an empty track.
+type railSkip struct{}
+
+func (railSkip) size() (int, int, int)             { return 0, 0, 0 }
+func (railSkip) draw(b *strings.Builder, x, y int) {}
+
+type railSeq []railItem
+
+func (r railSeq) size() (int, int, int) {
+	w, up, down := 0, 0, 0
+	for i, item := range r {
+		iw, iup, idown := item.size()
+		if i != 0 {
+			w += railGap
+		}
+		w += iw
+		up = max(up, iup)
+		down = max(down, idown)
+	}
+	return w, up, down
+}
+
+func (r railSeq) draw(b *strings.Builder, x, y int) {
+	for i, item := range r {
+		if i != 0 {
+			line(b, x, y, x+railGap)
+			x += railGap
+		}
+		item.draw(b, x, y)
+		w, _, _ := item.size()
+		x += w
+	}
+}
+
+// railChoice stacks alternatives, the first on the track and the others
+// below it.
+type railChoice []railItem
+
+// offsets returns how far below the track each alternative is.
+func (r railChoice) offsets() []int {
+	offsets := make([]int, len(r))
+	_, _, bottom := r[0].size()
+	for i, item := range r[1:] {
+		_, up, down := item.size()
+		offsets[i+1] = max(bottom+railGap+up, 2*railRadius)
+		bottom = offsets[i+1] + down
+	}
+	return offsets
+}
+
+func (r railChoice) size() (int, int, int) {
+	w := 0
+	for _, item := range r {
+		iw, _, _ := item.size()
+		w = max(w, iw)
+	}
+	_, up, down := r[0].size()
+	offsets := r.offsets()
+	if len(r) > 1 {
+		_, _, last := r[len(r)-1].size()
+		down = offsets[len(r)-1] + last
+	}
+	return w + 4*railRadius, up, down
+}
+
+func (r railChoice) draw(b *strings.Builder, x, y int) {
+	w, _, _ := r.size()
+	left, right := x+2*railRadius, x+w-2*railRadius
+	for i, offset := range r.offsets() {
+		iw, _, _ := r[i].size()
+		if i == 0 {
+			line(b, x, y, left)
+			line(b, right, y, x+w)
+		} else {
+			fmt.Fprintf(b, `<path d="M%v %v q%v 0 %v %v v%v q0 %v %v %v"/>`+"\n", x, y, railRadius, railRadius, railRadius, offset-2*railRadius, railRadius, railRadius, railRadius)
+			fmt.Fprintf(b, `<path d="M%v %v q%v 0 %v %v v%v q0 %v %v %v"/>`+"\n", right, y+offset, railRadius, railRadius, -railRadius, -(offset - 2*railRadius), -railRadius, railRadius, -railRadius)
+		}
+		r[i].draw(b, left, y+offset)
+		line(b, left+iw, y+offset, right)
+	}
+}
+
+// railLoop is an item repeated one or more times, going back through sep
+// between repetitions.
+type railLoop struct {
+	item railItem
+	sep  railItem
+}
+
+// offset returns how far below the track the way back is.
+func (r railLoop) offset() int {
+	_, _, down := r.item.size()
+	_, up, _ := r.sep.size()
+	return max(down+railGap+up, 2*railRadius)
+}
+
+func (r railLoop) size() (int, int, int) {
+	w, up, _ := r.item.size()
+	sw, _, sdown := r.sep.size()
+	return max(w, sw) + 4*railRadius, up, r.offset() + sdown
+}
+
+func (r railLoop) draw(b *strings.Builder, x, y int) {
+	w, _, _ := r.size()
+	iw, _, _ := r.item.size()
+	sw, _, _ := r.sep.size()
+	left, right := x+2*railRadius, x+w-2*railRadius
+	offset := r.offset()
+
+	line(b, x, y, left)
+	r.item.draw(b, left, y)
+	line(b, left+iw, y, x+w)
+	fmt.Fprintf(b, `<path d="M%v %v q%v 0 %v %v v%v q0 %v %v %v"/>`+"\n", right, y, railRadius, railRadius, railRadius, offset-2*railRadius, railRadius, -railRadius, railRadius)
+	fmt.Fprintf(b, `<path d="M%v %v q%v 0 %v %v v%v q0 %v %v %v"/>`+"\n", left, y+offset, -railRadius, -railRadius, -railRadius, -(offset - 2*railRadius), -railRadius, railRadius, -railRadius)
+	sx := left + (right-left-sw)/2
+	line(b, left, y+offset, sx)
+	r.sep.draw(b, sx, y+offset)
+	line(b, sx+sw, y+offset, right)
+}
+
+func line(b *strings.Builder, x1, y, x2 int) {
+	if x1 != x2 {
+		fmt.Fprintf(b, `<path d="M%v %v H%v"/>`+"\n", x1, y, x2)
+	}
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// railTerm lays out a term of a rule.
+func (g *grammar) railTerm(t term) railItem {
+	switch t.op {
+	case opSeq:
+		var seq railSeq
+		for _, item := range t.items {
+			if item.op != opCut {
+				seq = append(seq, g.railTerm(item))
+			}
+		}
+		if len(seq) == 0 {
+			return railSkip{}
+		}
+		return seq
+	case opOr:
+		var choice railChoice
+		for _, item := range t.items {
+			choice = append(choice, g.railTerm(item))
+		}
+		return choice
+	case opOpt:
+		return railChoice{g.railTerm(t.items[0]), railSkip{}}
+	case opMany:
+		return railChoice{railLoop{g.railTerm(t.items[0]), railSkip{}}, railSkip{}}
+	case opList:
+		var item railItem = railLoop{g.railTerm(t.items[0]), g.railTerm(t.items[1])}
+		if t.trailing {
+			item = railSeq{item, railChoice{g.railTerm(t.items[1]), railSkip{}}}
+		}
+		if t.empty {
+			item = railChoice{item, railSkip{}}
+		}
+		return item
+	case opRule:
+		return railBox{text: t.name, class: "rule", href: "#rule-" + t.name}
+	case opCall:
+		return railBox{text: t.String(), class: "rule", href: "#rule-" + t.name}
+	case opParam:
+		return railBox{text: t.name, class: "param"}
+	case opText:
+		return railBox{text: fmt.Sprintf("%q", t.text), class: "token"}
+	case opToken:
+		if t.text != "" {
+			return railBox{text: fmt.Sprintf("%q", t.text), class: "token"}
+		}
+		if tok := g.tokenOf[t.name]; tok.literal != "" {
+			return railBox{text: fmt.Sprintf("%q", tok.literal), class: "token"}
+		}
+		return railBox{text: t.name, class: "token", href: "#token-" + t.name}
+	case opAny:
+		return railBox{text: "any token", class: "token"}
+	case opAnd:
+		return railBox{text: "followed by " + t.items[0].String(), class: "check"}
+	case opNot:
+		return railBox{text: "not followed by " + t.items[0].String(), class: "check"}
+	case opPred:
+		return railBox{text: t.String(), class: "check"}
+	}
+	return railSkip{}
+}
+
+// railDiagram returns the SVG diagram of a rule.
+func (g *grammar) railDiagram(rule *grammarRule) string {
+	item := g.railTerm(rule.body)
+	w, up, down := item.size()
+	b := &strings.Builder{}
+	x, y := railMargin, railMargin+up
+	fmt.Fprintf(b, `<svg class="railroad" xmlns="http://www.w3.org/2000/svg" width="%v" height="%v">`+"\n", w+2*railMargin+2*railGap, up+down+2*railMargin)
+	fmt.Fprintf(b, `<path d="M%v %v v%v"/>`+"\n", x, y-railGap, 2*railGap)
+	line(b, x, y, x+railGap)
+	item.draw(b, x+railGap, y)
+	line(b, x+railGap+w, y, x+2*railGap+w)
+	fmt.Fprintf(b, `<path d="M%v %v v%v"/>`+"\n", x+2*railGap+w, y-railGap, 2*railGap)
+	b.WriteString("</svg>")
+	return b.String()
+}
+
+// references returns the names of the rules each rule is referenced by.
+func (g *grammar) references() map[string][]string {
+	refs := make(map[string][]string)
+	for _, rule := range g.rules {
+		seen := make(map[string]bool)
+		var walk func(t term)
+		walk = func(t term) {
+			if (t.op == opRule || t.op == opCall) && !seen[t.name] {
+				seen[t.name] = true
+				refs[t.name] = append(refs[t.name], rule.name)
+			}
+			for _, item := range t.items {
+				walk(item)
+			}
+		}
+		walk(rule.body)
+	}
+	return refs
+}
+
+const diagramStyle = `body { font-family: sans-serif; margin: 2em; }
+svg.railroad path { stroke: #333; stroke-width: 2; fill: none; }
+svg.railroad rect { stroke: #333; stroke-width: 2; }
+svg.railroad text { font-family: monospace; font-size: 13px; text-anchor: middle; }
+svg.railroad .token rect { fill: #e8f4e8; }
+svg.railroad .rule rect { fill: #e8eef8; }
+svg.railroad .param rect { fill: #fff; stroke-dasharray: 4 2; }
+svg.railroad .param text { font-style: italic; }
+svg.railroad .check rect { fill: #f8f0e0; stroke-dasharray: 4 2; }
+svg.railroad a:hover rect { fill: #ffd; }
+.used { color: #666; font-size: small; }
+td, th { text-align: left; padding: 0.2em 1em 0.2em 0; }
+code { font-size: 13px; }`
+
+// diagramPage renders every rule of a grammar as a railroad diagram, in a
+// single HTML page.
+func (g *grammar) diagramPage(title string) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n<style>\n%s\n</style>\n</head>\n<body>\n", html.EscapeString(title), diagramStyle)
+	fmt.Fprintf(b, "<h1>%s</h1>\n<p>", html.EscapeString(title))
+	for i, rule := range g.rules {
+		if i != 0 {
+			b.WriteString(" &middot;\n")
+		}
+		fmt.Fprintf(b, `<a href="#rule-%s">%s</a>`, html.EscapeString(rule.name), html.EscapeString(rule.name))
+	}
+	b.WriteString("</p>\n")
+
+	refs := g.references()
+	for _, rule := range g.rules {
+		name := rule.name
+		if rule.params != nil {
+			name += "(" + strings.Join(rule.params, ", ") + ")"
+		}
+		fmt.Fprintf(b, "<section id=\"rule-%s\">\n<h2>%s</h2>\n%s\n", html.EscapeString(rule.name), html.EscapeString(name), g.railDiagram(rule))
+		if users := refs[rule.name]; users != nil {
+			b.WriteString(`<p class="used">Used by: `)
+			for i, user := range users {
+				if i != 0 {
+					b.WriteString(", ")
+				}
+				fmt.Fprintf(b, `<a href="#rule-%s">%s</a>`, html.EscapeString(user), html.EscapeString(user))
+			}
+			b.WriteString("</p>\n")
+		}
+		b.WriteString("</section>\n")
+	}
+
+	b.WriteString("<h2>Tokens</h2>\n<table>\n<tr><th>token</th><th>matches</th></tr>\n")
+	for _, tok := range g.tokens {
+		matches := "&mdash;"
+		if tok.literal != "" {
+			matches = "<code>" + html.EscapeString(fmt.Sprintf("%q", tok.literal)) + "</code>"
+		} else if tok.pattern != "" {
+			matches = "pattern <code>" + html.EscapeString(tok.pattern) + "</code>"
+		}
+		fmt.Fprintf(b, "<tr id=\"token-%s\"><td>%s</td><td>%s</td></tr>\n", html.EscapeString(tok.name), html.EscapeString(tok.name), matches)
+	}
+	b.WriteString("</table>\n</body>\n</html>\n")
+	return b.String()
+}
+
+func diagramCommand(args []string) error {
+	flags := flag.NewFlagSet("diagram", flag.ExitOnError)
+	out := flags.String("o", "", "write the page to `file` instead of standard output")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: llgen diagram [FLAGS] FILE\n\nWrites an HTML page with a railroad diagram of each rule.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	g, err := readGrammar(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	page := g.diagramPage(filepath.Base(flags.Arg(0)))
+	if *out == "" {
+		_, err = os.Stdout.WriteString(page)
+		return err
+	}
+	return ioutil.WriteFile(*out, []byte(page), 0644)
+}
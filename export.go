@@ -0,0 +1,534 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp/syntax"
+	"strings"
+	"unicode"
+)
+
+// notation is the syntax of a standard grammar notation.
+type notation struct {
+	define   string // between a rule's name and its body
+	end      string // after a rule's body
+	alt      string
+	seq      string
+	empty    string
+	opt      func(s string) string // of a term at precedence optPrec
+	many     func(s string) string // of a term at precedence manyPrec
+	optPrec  int
+	manyPrec int
+	comment  func(s string) string
+	quote    func(s string, fold bool) string
+	prose    func(s string) string // a description of a token, "" if not supported
+	regexp   func(s string) string // a token's regular expression as a rule body, "" if not supported
+}
+
+var notations = map[string]notation{
+	"iso": {
+		define:  " = ",
+		end:     " ;",
+		alt:     " | ",
+		seq:     " , ",
+		opt:     func(s string) string { return "[ " + s + " ]" },
+		many:    func(s string) string { return "{ " + s + " }" },
+		comment: func(s string) string { return "(* " + strings.Replace(s, "*)", "* )", -1) + " *)" },
+		quote:   func(s string, fold bool) string { return quoteRuns(s, " , ", isoChar) },
+		prose:   func(s string) string { return "? " + strings.Replace(s, "?", "", -1) + " ?" },
+	},
+	"w3c": {
+		define:   " ::= ",
+		alt:      " | ",
+		seq:      " ",
+		empty:    `""`,
+		opt:      func(s string) string { return s + "?" },
+		many:     func(s string) string { return s + "*" },
+		optPrec:  2,
+		manyPrec: 2,
+		comment:  func(s string) string { return "/* " + strings.Replace(s, "*/", "* /", -1) + " */" },
+		quote:    func(s string, fold bool) string { return quoteRuns(s, " ", w3cChar) },
+		prose:    func(s string) string { return "" },
+		regexp:   w3cRegexp,
+	},
+	"abnf": {
+		define:   " = ",
+		alt:      " / ",
+		seq:      " ",
+		empty:    `""`,
+		opt:      func(s string) string { return "[ " + s + " ]" },
+		many:     func(s string) string { return "*" + s },
+		manyPrec: 2,
+		comment:  func(s string) string { return "; " + strings.Replace(s, "\n", " ", -1) },
+		quote:    abnfQuote,
+		prose:    func(s string) string { return "<" + strings.Replace(s, ">", "", -1) + ">" },
+	},
+}
+
+// quoteRuns quotes the printable runs of s in double quotes, or in single
+// quotes if they are double quotes, and writes other characters with char.
+// The pieces are joined with seq.
+func quoteRuns(s string, seq string, char func(r rune) string) string {
+	var pieces []string
+	run := ""
+	for _, r := range s {
+		if unicode.IsPrint(r) && r != '"' {
+			run += string(r)
+			continue
+		}
+		if run != "" {
+			pieces = append(pieces, `"`+run+`"`)
+			run = ""
+		}
+		if r == '"' {
+			pieces = append(pieces, `'"'`)
+		} else {
+			pieces = append(pieces, char(r))
+		}
+	}
+	if run != "" {
+		pieces = append(pieces, `"`+run+`"`)
+	}
+	if len(pieces) == 1 {
+		return pieces[0]
+	}
+	return "( " + strings.Join(pieces, seq) + " )"
+}
+
+func isoChar(r rune) string {
+	return fmt.Sprintf("? U+%04X ?", r)
+}
+
+func w3cChar(r rune) string {
+	return fmt.Sprintf("#x%X", r)
+}
+
+// w3cRegexp writes a regular expression as a W3C EBNF expression, or
+// returns "" if it uses anchors or other features the notation lacks.
+func w3cRegexp(pattern string) string {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	s, _ := w3cTerm(re.Simplify(), 0)
+	return s
+}
+
+// w3cTerm writes a part of a regular expression, with prec as in
+// exporter.term.
+func w3cTerm(re *syntax.Regexp, prec int) (string, bool) {
+	group := func(s string, p int) string {
+		if p < prec {
+			return "( " + s + " )"
+		}
+		return s
+	}
+
+	switch re.Op {
+	case syntax.OpEmptyMatch:
+		return `""`, true
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase == 0 {
+			return quoteRuns(string(re.Rune), " ", w3cChar), true
+		}
+		var parts []string
+		for _, r := range re.Rune {
+			folds := []rune{r, r}
+			for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+				folds = append(folds, f, f)
+			}
+			parts = append(parts, w3cClass(folds))
+		}
+		if len(parts) == 1 {
+			return parts[0], true
+		}
+		return group(strings.Join(parts, " "), 1), true
+	case syntax.OpCharClass:
+		if len(re.Rune) == 0 {
+			return "", false
+		}
+		return w3cClass(re.Rune), true
+	case syntax.OpAnyCharNotNL:
+		return "[^#xA]", true
+	case syntax.OpAnyChar:
+		return "[#x0-#x10FFFF]", true
+	case syntax.OpCapture:
+		return w3cTerm(re.Sub[0], prec)
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest:
+		s, ok := w3cTerm(re.Sub[0], 2)
+		if !ok {
+			return "", false
+		}
+		return s + map[syntax.Op]string{syntax.OpStar: "*", syntax.OpPlus: "+", syntax.OpQuest: "?"}[re.Op], true
+	case syntax.OpConcat, syntax.OpAlternate:
+		sub, sep, p := 1, " ", 1
+		if re.Op == syntax.OpAlternate {
+			sub, sep, p = 0, " | ", 0
+		}
+		var parts []string
+		for _, item := range re.Sub {
+			s, ok := w3cTerm(item, sub)
+			if !ok {
+				return "", false
+			}
+			parts = append(parts, s)
+		}
+		return group(strings.Join(parts, sep), p), true
+	}
+	return "", false
+}
+
+// w3cClass writes a character class of the ranges lo, hi in runes.
+func w3cClass(runes []rune) string {
+	s := "["
+	for i := 0; i+1 < len(runes); i += 2 {
+		s += w3cClassChar(runes[i])
+		if runes[i+1] != runes[i] {
+			s += "-" + w3cClassChar(runes[i+1])
+		}
+	}
+	return s + "]"
+}
+
+func w3cClassChar(r rune) string {
+	if r < 0x80 && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+		return string(r)
+	}
+	return w3cChar(r)
+}
+
+// abnfQuote writes s as an ABNF string if it can be one, and as character
+// codes otherwise. ABNF strings ignore case, so strings with letters that
+// must match exactly use the %s prefix from RFC 7405.
+func abnfQuote(s string, fold bool) string {
+	printable, letters := true, false
+	for _, r := range s {
+		printable = printable && r >= ' ' && r <= '~' && r != '"'
+		letters = letters || unicode.IsLetter(r)
+	}
+	if printable && (fold || !letters) {
+		return `"` + s + `"`
+	} else if printable {
+		return `%s"` + s + `"`
+	}
+	var codes []string
+	for _, r := range s {
+		codes = append(codes, fmt.Sprintf("%02X", r))
+	}
+	return "%x" + strings.Join(codes, ".")
+}
+
+// exporter translates a grammar into a standard notation. Calls of
+// parameterized rules become rules of their own, and lookaheads,
+// predicates and cuts, which the notations cannot express, are left out.
+type exporter struct {
+	g        *grammar
+	n        notation
+	inline   map[string]bool   // rules to replace with their bodies
+	calls    map[string]string // call to the name of the rule made for it
+	rules    []*grammarRule    // rules to write, including those made for calls
+	tokens   []string          // tokens that are not matched by their text
+	warnings []string
+}
+
+// exportGrammar writes a grammar in the notation named format. With
+// inline, helper rules are written in place of their uses.
+func exportGrammar(g *grammar, format string, inline bool) (string, []string, error) {
+	n, ok := notations[format]
+	if !ok {
+		return "", nil, fmt.Errorf("unknown format: %s", format)
+	}
+	e := &exporter{g: g, n: n, inline: make(map[string]bool), calls: make(map[string]string)}
+	if inline {
+		e.findInline()
+	}
+
+	for _, rule := range g.rules {
+		if rule.params == nil && !e.inline[rule.name] {
+			e.rules = append(e.rules, rule)
+		}
+	}
+	b := &strings.Builder{}
+	for i := 0; i < len(e.rules); i++ {
+		rule := e.rules[i]
+		body := e.term(rule.name, e.expand(rule.body), 0)
+		b.WriteString(rule.name + n.define + body + n.end + "\n")
+	}
+
+	if e.tokens != nil {
+		b.WriteString("\n")
+	}
+	for _, name := range e.tokens {
+		if tok := g.tokenOf[name]; tok != nil && tok.pattern != "" && n.regexp != nil {
+			if body := n.regexp(tok.pattern); body != "" {
+				b.WriteString(name + n.define + body + n.end + "\n")
+				continue
+			}
+			e.warnings = append(e.warnings, fmt.Sprintf("token %s: regular expression %s has no equivalent, so it is left undefined", name, tok.pattern))
+		}
+		desc := name + " is a token"
+		if tok := g.tokenOf[name]; tok != nil && tok.pattern != "" {
+			desc = name + " matches the regular expression " + tok.pattern
+		} else if name == "any-token" {
+			desc = "any-token is any token"
+		}
+		b.WriteString(n.comment(desc) + "\n")
+		if prose := n.prose(name + " token"); prose != "" {
+			b.WriteString(name + n.define + prose + n.end + "\n")
+		}
+	}
+	return b.String(), e.warnings, nil
+}
+
+// findInline picks the trivial helper rules to inline: those that are
+// used, but not as start rules, are not recursive, have no alternatives,
+// and are either used once or only name another unit. Calls of such
+// parameterized rules are inlined too.
+func (e *exporter) findInline() {
+	edges := make(map[string][]string)
+	uses := make(map[string]int)
+	for _, rule := range e.g.rules {
+		for _, name := range e.g.refs(rule.body) {
+			if e.g.ruleOf[name] != nil {
+				edges[rule.name] = append(edges[rule.name], name)
+			}
+		}
+		countUses(rule.body, uses)
+	}
+	recursive := make(map[string]bool)
+	for _, component := range e.g.cycles(edges) {
+		for _, name := range component {
+			recursive[name] = true
+		}
+	}
+	roots := e.g.starts
+	if roots == nil && e.g.rules != nil {
+		roots = []string{e.g.rules[0].name}
+	}
+
+	for _, rule := range e.g.rules {
+		alias := rule.body.op != opSeq || len(rule.body.items) == 1
+		if uses[rule.name] > 0 && (uses[rule.name] == 1 || alias) && !recursive[rule.name] && !contains(roots, rule.name) && !hasAlt(rule.body) {
+			e.inline[rule.name] = true
+		}
+	}
+}
+
+// countUses adds the number of times t refers to each rule to uses.
+func countUses(t term, uses map[string]int) {
+	if t.op == opRule || t.op == opCall {
+		uses[t.name]++
+	}
+	for _, item := range t.items {
+		countUses(item, uses)
+	}
+}
+
+func hasAlt(t term) bool {
+	if t.op == opOr {
+		return true
+	}
+	for _, item := range t.items {
+		if hasAlt(item) {
+			return true
+		}
+	}
+	return false
+}
+
+// expand replaces calls with references to the rules made for them and
+// inlined rules with their bodies.
+func (e *exporter) expand(t term) term {
+	if t.op == opRule && e.inline[t.name] {
+		return e.expand(e.g.ruleOf[t.name].body)
+	}
+	if t.op == opCall && e.inline[t.name] {
+		return e.expand(e.g.ruleOf[t.name].body.subst(e.args(t)))
+	}
+	if t.op == opCall {
+		return term{op: opRule, name: e.call(t)}
+	}
+	if t.items == nil {
+		return t
+	}
+	items := make([]term, len(t.items))
+	for i, item := range t.items {
+		items[i] = e.expand(item)
+	}
+	t.items = items
+	return t
+}
+
+// call returns the name of the rule made for a call, such as
+// bracketed-expr for bracketed(expr), adding the rule the first time.
+func (e *exporter) call(t term) string {
+	desc := t.String()
+	if name, ok := e.calls[desc]; ok {
+		return name
+	}
+	base := t.name
+	for _, arg := range t.items {
+		base += "-" + hyphenate(arg.String())
+	}
+	name := base
+	for i := 2; e.g.ruleOf[name] != nil || e.taken(name); i++ {
+		name = fmt.Sprintf("%s-%v", base, i)
+	}
+	e.calls[desc] = name
+
+	rule := e.g.ruleOf[t.name]
+	e.rules = append(e.rules, &grammarRule{name: name, body: rule.body.subst(e.args(t)), line: rule.line})
+	return name
+}
+
+// args maps the parameters of the rule a term calls to its arguments.
+func (e *exporter) args(t term) map[string]term {
+	args := make(map[string]term)
+	for i, param := range e.g.ruleOf[t.name].params {
+		args[param] = t.items[i]
+	}
+	return args
+}
+
+// hyphenate turns the description of a term into a rule name by joining
+// its words with hyphens.
+func hyphenate(desc string) string {
+	words := strings.FieldsFunc(desc, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if words == nil {
+		return "x"
+	}
+	return strings.ToLower(strings.Join(words, "-"))
+}
+
+func (e *exporter) taken(name string) bool {
+	for _, taken := range e.calls {
+		if taken == name {
+			return true
+		}
+	}
+	return false
+}
+
+// term writes a term of a rule. prec is 0 where alternatives can appear
+// unparenthesized, 1 where sequences can, and 2 where neither can.
+func (e *exporter) term(rule string, t term, prec int) string {
+	group := func(s string, p int) string {
+		if p < prec {
+			return "( " + s + " )"
+		}
+		return s
+	}
+
+	switch t.op {
+	case opSeq, opOr:
+		var parts []string
+		for _, item := range t.items {
+			if item.op == opAnd || item.op == opNot || item.op == opPred || item.op == opCut {
+				e.leftOut(rule, item)
+				continue
+			}
+			sub := 1
+			if t.op == opSeq {
+				sub = 2
+				if item.op == opSeq || item.op == opList && !item.empty {
+					sub = 1
+				}
+			}
+			parts = append(parts, e.term(rule, item, sub))
+		}
+		if t.op == opOr {
+			return group(strings.Join(parts, e.n.alt), 0)
+		}
+		if len(parts) == 0 {
+			return e.n.empty
+		}
+		if len(parts) == 1 {
+			return parts[0]
+		}
+		return group(strings.Join(parts, e.n.seq), 1)
+	case opOpt:
+		return e.n.opt(e.term(rule, t.items[0], e.n.optPrec))
+	case opMany:
+		return e.n.many(e.term(rule, t.items[0], e.n.manyPrec))
+	case opList:
+		item, sep := t.items[0], t.items[1]
+		list := term{op: opSeq, items: []term{item, {op: opMany, items: []term{{op: opSeq, items: []term{sep, item}}}}}}
+		if t.trailing {
+			list.items = append(list.items, term{op: opOpt, items: []term{sep}})
+		}
+		if t.empty {
+			return e.term(rule, term{op: opOpt, items: []term{list}}, prec)
+		}
+		return e.term(rule, list, prec)
+	case opAnd, opNot, opPred, opCut:
+		e.leftOut(rule, t)
+		return e.n.empty
+	case opText:
+		return e.n.quote(t.text, false)
+	case opToken:
+		if t.text != "" {
+			return e.n.quote(t.text, false)
+		}
+		if tok := e.g.tokenOf[t.name]; tok != nil && tok.literal != "" {
+			return e.n.quote(tok.literal, tok.fold)
+		}
+		e.addToken(t.name)
+		return t.name
+	case opAny:
+		e.addToken("any-token")
+		return "any-token"
+	}
+	return t.name
+}
+
+func (e *exporter) addToken(name string) {
+	if !contains(e.tokens, name) {
+		e.tokens = append(e.tokens, name)
+	}
+}
+
+func (e *exporter) leftOut(rule string, t term) {
+	what := map[string]string{opAnd: "lookahead", opNot: "lookahead", opPred: "predicate", opCut: "cut"}[t.op]
+	warning := fmt.Sprintf("%s: %s %s left out", rule, what, t.String())
+	if !contains(e.warnings, warning) {
+		e.warnings = append(e.warnings, warning)
+	}
+}
+
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "iso", "notation to write: iso (ISO 14977 EBNF), w3c (W3C XML EBNF) or abnf (RFC 5234 ABNF)")
+	inline := flags.Bool("inline", false, "write trivial helper rules, which are used once or name another unit, have no alternatives and are not recursive, in place of their uses")
+	out := flags.String("o", "", "write the grammar to `file` instead of standard output")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: llgen export [FLAGS] FILE\n\nWrites the grammar in a standard notation.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	g, err := readGrammar(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	text, warnings, err := exportGrammar(g, *format, *inline)
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "llgen: warning: %s: %s\n", filepath.Base(flags.Arg(0)), warning)
+	}
+	if *out == "" {
+		_, err = os.Stdout.WriteString(text)
+		return err
+	}
+	return ioutil.WriteFile(*out, []byte(text), 0644)
+}
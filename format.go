@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/allen-b1/llgen/parser"
+)
+
+// formatGrammar returns the text of a grammar file in canonical form: one
+// space between the parts of a statement, the = of rules and the
+// definitions of tokens aligned within each group of statements, and
+// comments and single blank lines between groups kept.
+func formatGrammar(text string) (string, error) {
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	src := &source{comments: make(map[int]string), text: make(map[[2]int]string)}
+	tokens, err := tokenizeSource(text, src)
+	if err != nil {
+		return "", err
+	}
+	ns, err := parser.ParseStatementsTokens(tokens)
+	if err != nil {
+		return "", err
+	}
+
+	p := &printer{src: src}
+	b := &bytes.Buffer{}
+	w := tabwriter.NewWriter(b, 0, 8, 1, ' ', tabwriter.StripEscape)
+	started, blank := false, false
+	for _, statement := range ns.I0 {
+		var line string
+		if n, ok := statement.I.(parser.NodeStatementEmpty); ok {
+			comment, ok := src.comments[n.I0.Line]
+			if !ok {
+				blank = started
+				continue
+			}
+			line = escape(comment)
+		} else {
+			var newline parser.Token
+			if line, newline, err = p.statement(statement); err != nil {
+				return "", err
+			}
+			if comment, ok := src.comments[newline.Line]; ok && strings.Contains(line, "\n") {
+				line += " " + escape(comment)
+			} else if ok {
+				line += "\t" + escape(comment)
+			}
+		}
+		if blank {
+			fmt.Fprint(w, "\n")
+		}
+		fmt.Fprint(w, line+"\n")
+		started, blank = true, false
+	}
+	w.Flush()
+
+	lines := strings.Split(b.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " ")
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// printer prints the statements of a grammar. Cells of a line that are
+// aligned with those of the lines around it are separated by tabs, and
+// text that must not be is escaped.
+type printer struct {
+	src *source
+}
+
+// raw returns a string or action token as it was written.
+func (p *printer) raw(tok parser.Token) string {
+	text, ok := p.src.text[[2]int{tok.Line, tok.Col}]
+	if !ok {
+		text = tok.Data
+	}
+	return escape(text)
+}
+
+func escape(text string) string {
+	esc := string([]byte{tabwriter.Escape})
+	return esc + text + esc
+}
+
+// statement returns the line of a statement, and its newline token, whose
+// line is where a comment after the statement is.
+func (p *printer) statement(statement parser.NodeStatement) (string, parser.Token, error) {
+	switch n := statement.I.(type) {
+	case parser.NodeStatementExpr:
+		return p.rule(n.I0.Data, n.I2, n.I3), n.I4, nil
+	case parser.NodeStatementMacro:
+		params := make([]string, len(n.I2.Items))
+		for i, param := range n.I2.Items {
+			params[i] = param.Data
+		}
+		return p.rule(n.I0.Data+"("+strings.Join(params, ", ")+")", n.I5, n.I6), n.I7, nil
+	case parser.NodeStatementToken:
+		line := "token " + n.I1.Data
+		if n.I2 != nil {
+			switch def := n.I2.I.(type) {
+			case parser.NodeStatementTokenAnnotation:
+				line += "\t= " + p.raw(def.I1)
+			case parser.NodeStatementTokenPattern:
+				line += "\t~ " + p.raw(def.I1)
+			}
+		}
+		if n.I3 != nil {
+			if push, ok := n.I3.I.(parser.NodeTokenPush); ok {
+				line += " push " + push.I1.Data
+			} else {
+				line += " pop"
+			}
+		}
+		return line, n.I4, nil
+	case parser.NodeStatementKeyword:
+		line := "keyword " + n.I1.Data
+		if n.I2 != nil {
+			line += "\t= " + p.raw(n.I2.I1)
+		}
+		if n.I3 != nil {
+			line += " nocase"
+		}
+		return line, n.I4, nil
+	case parser.NodeStatementDirective:
+		line := "%" + n.I1.Data
+		for i, arg := range n.I2 {
+			tok := arg.I.(parser.Token)
+			switch {
+			case n.I1.Data == "mode" && i == 1 && tok.Type == "action":
+				block, err := formatGrammar(tok.Data)
+				if err != nil {
+					return "", parser.Token{}, err
+				}
+				line += " " + escape(indentBlock(block))
+			case tok.Type == "ident":
+				line += " " + tok.Data
+			default:
+				line += " " + p.raw(tok)
+			}
+		}
+		return line, n.I3, nil
+	}
+	return "", parser.Token{}, fmt.Errorf("unknown statement %T", statement.I)
+}
+
+// indentBlock returns the formatted statements of a %mode block in braces,
+// one tab in.
+func indentBlock(block string) string {
+	if block == "" {
+		return "{}"
+	}
+	lines := strings.SplitAfter(block, "\n")
+	for i, line := range lines {
+		if line != "\n" && line != "" {
+			lines[i] = "\t" + line
+		}
+	}
+	return "{\n" + strings.Join(lines, "") + "}"
+}
+
+func (p *printer) rule(head string, expr parser.NodeExpr, action *parser.Token) string {
+	line := head + "\t="
+	if body := p.expr(expr); body != "" {
+		line += " " + body
+	}
+	if action != nil {
+		line += " " + p.raw(*action)
+	}
+	return line
+}
+
+func (p *printer) expr(expr parser.NodeExpr) string {
+	switch n := expr.I.(type) {
+	case parser.NodeExprOr:
+		alts := []string{p.unit(n.I0), p.unit(n.I2)}
+		for _, ext := range n.I3 {
+			alts = append(alts, p.unit(ext.I1))
+		}
+		return strings.Join(alts, " | ")
+	case parser.NodeExprAnd:
+		parts := make([]string, len(n.I0))
+		for i, ell := range n.I0 {
+			parts[i] = p.unitEll(ell)
+		}
+		return strings.Join(parts, " ")
+	}
+	return ""
+}
+
+func (p *printer) unitEll(ell parser.NodeUnitEll) string {
+	switch n := ell.I.(type) {
+	case parser.NodeUnitEllFull:
+		return p.unit(n.I0) + "..."
+	case parser.NodeUnitEllOpt:
+		return p.unit(n.I0) + "?"
+	case parser.NodeUnitLook:
+		return n.I0.I.(parser.Token).Data + p.unit(n.I1)
+	case parser.NodeUnitPred:
+		return n.I0.I.(parser.Token).Data + p.raw(n.I1)
+	case parser.NodeUnit:
+		return p.unit(n)
+	}
+	return "^"
+}
+
+func (p *printer) unit(u parser.NodeUnit) string {
+	switch n := u.I.(type) {
+	case parser.NodeUnitCall:
+		args := make([]string, len(n.I2.Items))
+		for i, arg := range n.I2.Items {
+			args[i] = p.unit(arg)
+		}
+		return n.I0.Data + "(" + strings.Join(args, ", ") + ")"
+	case parser.NodeUnitToken:
+		return n.I0.Data + "<" + p.raw(n.I2) + ">"
+	case parser.Token:
+		if n.Type == "string" {
+			return p.raw(n)
+		}
+		if n.Type == "dot" {
+			return "."
+		}
+		return n.Data
+	}
+	return ""
+}
+
+// diffLines returns a unified diff of two texts, or "" if they are equal.
+func diffLines(name, a, b string) string {
+	if a == b {
+		return ""
+	}
+	x := splitLines(a)
+	y := splitLines(b)
+	// lcs[i][j] is the length of the longest common subsequence of x[i:] and y[j:].
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	type edit struct {
+		op   byte
+		line string
+		i, j int // lines of a and b before the edit
+	}
+	var edits []edit
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			edits = append(edits, edit{' ', x[i], i, j})
+			i++
+			j++
+		case i < len(x) && (j == len(y) || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{'-', x[i], i, j})
+			i++
+		default:
+			edits = append(edits, edit{'+', y[j], i, j})
+			j++
+		}
+	}
+
+	const context = 3
+	out := &strings.Builder{}
+	fmt.Fprintf(out, "--- %s\n+++ %s\n", name+".orig", name)
+	for k := 0; k < len(edits); {
+		if edits[k].op == ' ' {
+			k++
+			continue
+		}
+		start := max(k-context, 0)
+		end := k
+		for end < len(edits) {
+			if edits[end].op != ' ' {
+				end++
+				continue
+			}
+			same := end
+			for same < len(edits) && edits[same].op == ' ' {
+				same++
+			}
+			if same == len(edits) || same-end > 2*context {
+				end = min(end+context, len(edits))
+				break
+			}
+			end = same
+		}
+		hunk := &strings.Builder{}
+		lines := [2]int{}
+		for _, e := range edits[start:end] {
+			line := e.line
+			if !strings.HasSuffix(line, "\n") {
+				line += "\n\\ No newline at end of file\n"
+			}
+			hunk.WriteString(string(e.op) + line)
+			if e.op != '+' {
+				lines[0]++
+			}
+			if e.op != '-' {
+				lines[1]++
+			}
+		}
+		fmt.Fprintf(out, "@@ -%v,%v +%v,%v @@\n%s", edits[start].i+1, lines[0], edits[start].j+1, lines[1], hunk)
+		k = end
+	}
+	return out.String()
+}
+
+// splitLines splits text after each newline, leaving out the empty line
+// after a final newline.
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		return lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func fmtCommand(args []string) error {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	list := flags.Bool("l", false, "list files whose formatting differs from llgen fmt's")
+	diff := flags.Bool("d", false, "display diffs instead of rewriting files")
+	write := flags.Bool("w", false, "write the result to the file instead of standard output")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: llgen fmt [FLAGS] FILE...\n\nFormats grammar files: aligns definitions, spaces their parts and keeps comments and blank lines between groups.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	for _, path := range flags.Args() {
+		text, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		formatted, err := formatGrammar(string(text))
+		if err != nil {
+			return positioned(path, err)
+		}
+		changed := formatted != string(text)
+		if *list && changed {
+			fmt.Println(path)
+		}
+		if *write && changed {
+			if err := ioutil.WriteFile(path, []byte(formatted), 0644); err != nil {
+				return err
+			}
+		}
+		if *diff {
+			os.Stdout.WriteString(diffLines(path, string(text), formatted))
+		}
+		if !*list && !*write && !*diff {
+			os.Stdout.WriteString(formatted)
+		}
+	}
+	return nil
+}
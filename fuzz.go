@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/allen-b1/llgen/parser"
+)
+
+// writeFuzzTests writes tests for the parser generated from ns to path: a
+// quickcheck-style test that runs on any Go version, and, next to it in a
+// file built only by Go 1.18 and later, a native fuzz target. Both parse
+// the files in the package's testdata directory and inputs made from them
+// and from the grammar's tokens, and fail if the parser panics, does not
+// return, or, if its result has a String method, does not parse what that
+// prints back to the same thing.
+func writeFuzzTests(path string, ns parser.NodeStatements, g *generator) error {
+	if !strings.HasSuffix(path, "_test.go") {
+		return fmt.Errorf("%s: the name of a test file must end in _test.go", path)
+	}
+	if len(g.starts) == 0 || len(g.tokens) == 0 {
+		return fmt.Errorf("fuzz tests need a %%start rule and tokens")
+	}
+	gr, err := newGrammar(ns, g.files)
+	if err != nil {
+		return err
+	}
+
+	texts := []string{" ", "\n"}
+	seen := make(map[string]bool)
+	add := func(text string) {
+		if !seen[text] {
+			seen[text] = true
+			texts = append(texts, text)
+		}
+	}
+	for _, def := range g.tokens {
+		if def.literal != "" {
+			add(def.literal)
+		}
+	}
+	s := newSampler(gr, 1, 0)
+	for _, tok := range gr.tokens {
+		for i := 0; i < 3 && tok.pattern != ""; i++ {
+			add(s.token(tok.name).text)
+		}
+	}
+	tokens := ""
+	for _, text := range texts {
+		tokens += fmt.Sprintf("\t%q,\n", text)
+	}
+
+	quick := fmt.Sprintf(`package parser
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime/debug"
+	"strings"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+// fuzzTimeout is how long a parse can take before it is reported as
+// never returning.
+const fuzzTimeout = 10 * time.Second
+
+// fuzzTokens are texts of the grammar's tokens, which random inputs are
+// made of.
+var fuzzTokens = []string{
+%s}
+
+// fuzzSeeds returns the files in testdata, which random inputs start from.
+func fuzzSeeds(t testing.TB) []string {
+	paths, err := filepath.Glob(filepath.Join("testdata", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seeds []string
+	for _, path := range paths {
+		if info, err := os.Stat(path); err != nil || info.IsDir() {
+			continue
+		}
+		text, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seeds = append(seeds, string(text))
+	}
+	return seeds
+}
+
+// checkParse parses src, failing if the parser panics or does not return.
+// If the result has a String method, what it prints must parse back to a
+// result that prints the same.
+func checkParse(t testing.TB, src string) {
+	done := make(chan string, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Sprintf("panic: %%v\n%%s", r, debug.Stack())
+			}
+		}()
+		out, err := Parse(src)
+		if s, ok := interface{}(out).(fmt.Stringer); ok && err == nil {
+			printed := s.String()
+			again, err := Parse(printed)
+			if err != nil {
+				done <- fmt.Sprintf("printed as %%q, which does not parse: %%v", printed, err)
+				return
+			}
+			if reprinted := interface{}(again).(fmt.Stringer).String(); reprinted != printed {
+				done <- fmt.Sprintf("printed as %%q, which parses and prints as %%q", printed, reprinted)
+				return
+			}
+		}
+		done <- ""
+	}()
+	select {
+	case msg := <-done:
+		if msg != "" {
+			t.Fatalf("%%q: %%s", src, msg)
+		}
+	case <-time.After(fuzzTimeout):
+		t.Fatalf("%%q: parse did not return in %%v", src, fuzzTimeout)
+	}
+}
+
+// quickInput makes a random input: a seed with a few tokens inserted,
+// bytes changed or runs of bytes removed, or else tokens of the grammar in
+// a random order.
+func quickInput(r *rand.Rand, seeds []string) string {
+	if len(seeds) != 0 && r.Intn(2) == 0 {
+		b := seeds[r.Intn(len(seeds))]
+		for n := r.Intn(4); n >= 0; n-- {
+			i := 0
+			if len(b) != 0 {
+				i = r.Intn(len(b))
+			}
+			switch r.Intn(3) {
+			case 0:
+				b = b[:i] + fuzzTokens[r.Intn(len(fuzzTokens))] + b[i:]
+			case 1:
+				b = b[:i] + b[i+r.Intn(len(b)-i+1):]
+			case 2:
+				if len(b) != 0 {
+					b = b[:i] + string(rune(r.Intn(128))) + b[i+1:]
+				}
+			}
+		}
+		return b
+	}
+	b := &strings.Builder{}
+	for n := r.Intn(20); n > 0; n-- {
+		b.WriteString(fuzzTokens[r.Intn(len(fuzzTokens))])
+		if r.Intn(2) == 0 {
+			b.WriteString(" ")
+		}
+	}
+	return b.String()
+}
+
+func TestParseQuick(t *testing.T) {
+	seeds := fuzzSeeds(t)
+	for _, seed := range seeds {
+		checkParse(t, seed)
+	}
+	config := &quick.Config{
+		MaxCount: 1000,
+		Values: func(args []reflect.Value, r *rand.Rand) {
+			args[0] = reflect.ValueOf(quickInput(r, seeds))
+		},
+	}
+	if testing.Short() {
+		config.MaxCount = 100
+	}
+	check := func(src string) bool {
+		checkParse(t, src)
+		return true
+	}
+	if err := quick.Check(check, config); err != nil {
+		t.Error(err)
+	}
+}
+`, tokens)
+
+	fuzz := `//go:build go1.18
+// +build go1.18
+
+package parser
+
+import "testing"
+
+func FuzzParse(f *testing.F) {
+	for _, seed := range fuzzSeeds(f) {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, src string) {
+		checkParse(t, src)
+	})
+}
+`
+
+	if err := ioutil.WriteFile(path, []byte(quick), 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(strings.TrimSuffix(path, "_test.go")+"_go118_test.go", []byte(fuzz), 0644)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"github.com/allen-b1/llgen/parser"
+	"strconv"
 	"strings"
 )
 
@@ -10,6 +11,122 @@ func transform(old string) string {
 	return strings.Replace(strings.Title(strings.Replace(old, "-", " ", -1)), " ", "", -1)
 }
 
+// ref is a unit resolved against the symbol table. Tokens are matched
+// inline, everything else is matched by calling its parse function.
+type ref struct {
+	name  string // symbol name, used in comments and error messages
+	token bool
+	any   bool   // matches any token
+	tag   string // required token data, if any
+	text  string // keyword text, if any
+	typ   string // Go type of the parsed node
+	parse string // parse function
+}
+
+// label names the referenced token in error messages.
+func (r ref) label() string {
+	if r.text != "" {
+		return strconv.Quote(r.text)
+	}
+	return r.name
+}
+
+// newError returns code for a parse error at the current position.
+func newError(msg string) string {
+	return fmt.Sprintf("newError(%q, p.at(curr))", msg)
+}
+
+// wrap returns code that adds the rule name to err.
+func wrap(name string) string {
+	return fmt.Sprintf("wrap(err, %q)", "failed to parse "+name)
+}
+
+// fail marks an error as a cut error if the sequence is past a cut.
+func (g *generator) fail(err string) string {
+	if g.committed {
+		return "cut(" + err + ")"
+	}
+	return err
+}
+
+// mismatch returns a condition that holds when the token at pos is not the referenced token.
+func (r ref) mismatch(pos string) string {
+	if r.any {
+		return fmt.Sprintf("p.at(%s) == nil", pos)
+	}
+	cond := fmt.Sprintf(`p.at(%s) == nil || p.at(%s).Type != %q`, pos, pos, r.name)
+	if r.tag != "" {
+		cond += fmt.Sprintf(` || p.at(%s).Data != %q`, pos, r.tag)
+	}
+	return cond
+}
+
+// match returns a condition that holds when the token at pos is the referenced token.
+func (r ref) match(pos string) string {
+	if r.any {
+		return fmt.Sprintf("p.at(%s) != nil", pos)
+	}
+	cond := fmt.Sprintf(`p.at(%s) != nil && p.at(%s).Type == %q`, pos, pos, r.name)
+	if r.tag != "" {
+		cond += fmt.Sprintf(` && p.at(%s).Data == %q`, pos, r.tag)
+	}
+	return cond
+}
+
+// list is an instantiation of the built-in list(item, sep, options...) construct.
+type list struct {
+	item     ref
+	sep      ref
+	empty    bool
+	trailing bool
+	parse    string
+	desc     string
+}
+
+type generator struct {
+	symbols  map[string]string
+	lists    map[string]*list
+	order    []*list
+	tokens   []tokenDef
+	literals map[string]string // literal text to token name
+	keywords map[string]string // keyword token name to its text
+	starts   []string
+	types    map[string]string // rule name to the Go type of its value
+	header   string
+	state    string // Go type of Parser.State
+	indent   bool   // whether the lexer emits indent and dedent tokens
+	modes    []string
+	mode     string // mode whose tokens are being declared, "" for the default
+
+	macros    map[string]parser.NodeStatementMacro
+	goNames   map[string]string          // macro instance to the Go name of its node
+	instances []parser.NodeStatementExpr // macro instances not yet generated
+
+	committed bool // whether the sequence being generated is past a cut
+
+	coverage bool     // whether parse functions count what they match
+	points   []string // what each coverage counter counts, "rule\tpoint"
+
+	files []string // file each statement was read from
+}
+
+// options choose variants of the generated parser, and say where the
+// statements it is generated from were read.
+type options struct {
+	coverage bool     // count matches of each rule, alternative and optional or repeated part
+	files    []string // file each statement was read from, to say where errors are
+}
+
+// cover returns a statement that counts a coverage point of a rule, or ""
+// without coverage.
+func (g *generator) cover(name string, point string) string {
+	if !g.coverage {
+		return ""
+	}
+	g.points = append(g.points, name+"\t"+point)
+	return fmt.Sprintf("atomic.AddUint64(&coverage[%v], 1)", len(g.points)-1)
+}
+
 func handleUnit(u parser.NodeUnit) (name string, tag string) {
 	if token, ok := u.I.(parser.Token); ok {
 		return token.Data, ""
@@ -20,81 +137,430 @@ func handleUnit(u parser.NodeUnit) (name string, tag string) {
 	panic("invalid tree for unit")
 }
 
-func handleUnitEll(u parser.NodeUnitEll) (name string, tag string, suffix string) {
+func handleUnitEll(u parser.NodeUnitEll) (unit parser.NodeUnit, suffix string) {
 	if unit, ok := u.I.(parser.NodeUnit); ok {
-		name, tag := handleUnit(unit)
-		return name, tag, ""
+		return unit, ""
 	}
 	if unitFull, ok := u.I.(parser.NodeUnitEllFull); ok {
-		name, tag := handleUnit(unitFull.I0)
-		return name, tag, "ell"
+		return unitFull.I0, "ell"
 	}
 	if unitFull, ok := u.I.(parser.NodeUnitEllOpt); ok {
-		name, tag := handleUnit(unitFull.I0)
-		return name, tag, "opt"
+		return unitFull.I0, "opt"
+	}
+	if unitLook, ok := u.I.(parser.NodeUnitLook); ok {
+		if unitLook.I0.I.(parser.Token).Type == "bang" {
+			return unitLook.I1, "not"
+		}
+		return unitLook.I1, "and"
 	}
 	panic("invalid tree for unit-ell")
 }
 
-func generate(n parser.NodeStatementExpr, symbols map[string]string) (string, error) {
+func describeUnit(u parser.NodeUnit) string {
+	if call, ok := u.I.(parser.NodeUnitCall); ok {
+		args := make([]string, len(call.I2.Items))
+		for i, arg := range call.I2.Items {
+			args[i] = describeUnit(arg)
+		}
+		return call.I0.Data + "(" + strings.Join(args, ", ") + ")"
+	}
+	if tok, ok := u.I.(parser.Token); ok && tok.Type == "dot" {
+		return "."
+	}
+	if tok, ok := u.I.(parser.Token); ok && tok.Type == "string" {
+		return strconv.Quote(tok.Data)
+	}
+	name, tag := handleUnit(u)
+	if tag != "" {
+		return fmt.Sprintf("%s<%q>", name, tag)
+	}
+	return name
+}
+
+// resolve looks up the symbol a unit refers to. Errors are at the unit,
+// unless they come from a unit within it.
+func (g *generator) resolve(u parser.NodeUnit) (ref, error) {
+	r, err := g.resolveUnit(u)
+	if _, ok := err.(parser.Error); err != nil && !ok {
+		tok := unitToken(u)
+		err = parser.Error{Message: err.Error(), Line: tok.Line, Col: tok.Col}
+	}
+	return r, err
+}
+
+// unitToken returns the first token of a unit.
+func unitToken(u parser.NodeUnit) parser.Token {
+	switch n := u.I.(type) {
+	case parser.NodeUnitCall:
+		return n.I0
+	case parser.NodeUnitToken:
+		return n.I0
+	}
+	return u.I.(parser.Token)
+}
+
+func (g *generator) resolveUnit(u parser.NodeUnit) (ref, error) {
+	if call, ok := u.I.(parser.NodeUnitCall); ok && call.I0.Data == "list" {
+		return g.resolveList(call)
+	} else if ok {
+		return g.instantiate(call)
+	}
+	if tok, ok := u.I.(parser.Token); ok && tok.Type == "dot" {
+		return ref{name: "any token", token: true, any: true, typ: "Token"}, nil
+	}
+	if tok, ok := u.I.(parser.Token); ok && tok.Type == "string" {
+		name, err := g.literal(tok.Data)
+		if err != nil {
+			return ref{}, err
+		}
+		return ref{name: name, token: true, typ: "Token"}, nil
+	}
+
+	name, tag := handleUnit(u)
+	switch g.symbols[name] {
+	case "token":
+		return ref{name: name, token: true, tag: tag, text: g.keywords[name], typ: "Token"}, nil
+	case "expr":
+		if tag != "" {
+			return ref{}, fmt.Errorf("%s is not a token and cannot be tagged", name)
+		}
+		return ref{name: name, typ: "Node" + g.goName(name), parse: "p.parse" + g.goName(name)}, nil
+	}
+	if m, ok := g.macros[name]; ok {
+		return ref{}, fmt.Errorf("%s expects %v arguments, got 0", name, len(m.I2.Items))
+	}
+	return ref{}, fmt.Errorf("unknown identifier: %s", name)
+}
+
+func (g *generator) resolveList(u parser.NodeUnitCall) (ref, error) {
+	desc := describeUnit(parser.NodeUnit{I: u})
+	if l, ok := g.lists[desc]; ok {
+		return ref{name: desc, typ: listType(l.item), parse: "p." + l.parse}, nil
+	}
+
+	args := u.I2.Items
+	if len(args) < 2 {
+		return ref{}, fmt.Errorf("%s: list expects an item and a separator", desc)
+	}
+	item, err := g.resolve(args[0])
+	if err != nil {
+		return ref{}, err
+	}
+	sep, err := g.resolve(args[1])
+	if err != nil {
+		return ref{}, err
+	}
+	if !sep.token {
+		return ref{}, fmt.Errorf("%s: separator must be a token", desc)
+	}
+
+	l := &list{item: item, sep: sep, desc: desc, parse: fmt.Sprintf("parseList%v", len(g.order))}
+	for _, opt := range args[2:] {
+		switch describeUnit(opt) {
+		case "empty":
+			l.empty = true
+		case "trailing":
+			l.trailing = true
+		default:
+			return ref{}, fmt.Errorf("%s: unknown list option: %s", desc, describeUnit(opt))
+		}
+	}
+	g.lists[desc] = l
+	g.order = append(g.order, l)
+	return ref{name: desc, typ: listType(item), parse: "p." + l.parse}, nil
+}
+
+// listType returns the Go type of lists of item. Rule types all start with
+// Node, so ListOf cannot clash with them, as a rule named atom-list would
+// with NodeAtomList.
+func listType(item ref) string {
+	return "ListOf" + item.typ
+}
+
+// directiveArgs returns the arguments of a directive, checking that each
+// is an identifier or a string as given by kinds.
+func directiveArgs(n parser.NodeStatementDirective, kinds ...string) ([]string, error) {
+	if len(n.I2) != len(kinds) {
+		return nil, fmt.Errorf("%%%s expects %v arguments, got %v", n.I1.Data, len(kinds), len(n.I2))
+	}
+	args := make([]string, len(kinds))
+	for i, arg := range n.I2 {
+		tok := arg.I.(parser.Token)
+		if tok.Type != kinds[i] {
+			return nil, fmt.Errorf("%%%s: argument %v must be %s", n.I1.Data, i+1, kinds[i])
+		}
+		args[i] = tok.Data
+	}
+	return args, nil
+}
+
+func (g *generator) directive(n parser.NodeStatementDirective) error {
+	switch n.I1.Data {
+	case "start":
+		if len(n.I2) == 0 {
+			return fmt.Errorf("%%start expects at least one rule")
+		}
+		for _, arg := range n.I2 {
+			name := arg.I.(parser.Token).Data
+			if g.symbols[name] != "expr" {
+				return fmt.Errorf("%%start: unknown rule: %s", name)
+			}
+			g.starts = append(g.starts, name)
+		}
+		return nil
+	case "type":
+		args, err := directiveArgs(n, "ident", "string")
+		if err != nil {
+			return err
+		}
+		if _, ok := g.macros[args[0]]; !ok && g.symbols[args[0]] != "expr" {
+			return fmt.Errorf("%%type: unknown rule: %s", args[0])
+		}
+		g.types[args[0]] = args[1]
+		return nil
+	case "state":
+		args, err := directiveArgs(n, "string")
+		if err != nil {
+			return err
+		}
+		g.state = args[0]
+		return nil
+	case "indent":
+		if _, err := directiveArgs(n); err != nil {
+			return err
+		}
+		g.indent = true
+		for _, name := range []string{"indent", "dedent"} {
+			if g.symbols[name] == "" {
+				g.symbols[name] = "token"
+			}
+		}
+		return nil
+	case "mode":
+		args, err := directiveArgs(n, "ident", "action")
+		if err != nil {
+			return err
+		}
+		return g.declareMode(args[0], n.I2[1].I.(parser.Token))
+	case "header":
+		args, err := directiveArgs(n, "action")
+		if err != nil {
+			return err
+		}
+		g.header += "\n" + args[0] + "\n"
+		return nil
+	}
+	return fmt.Errorf("unknown directive: %%%s", n.I1.Data)
+}
+
+func (g *generator) generate(n parser.NodeStatementExpr) (string, error) {
 	name := n.I0.Data
+	str := ""
+	var err error
 	if expr, ok := n.I2.I.(parser.NodeExprOr); ok {
-		return generateOr(name, expr, symbols)
+		str, err = g.generateOr(name, expr)
+	} else if expr, ok := n.I2.I.(parser.NodeExprAnd); ok {
+		str, err = g.generateAnd(name, expr)
+	} else {
+		return "", fmt.Errorf("invalid expression")
 	}
-	if expr, ok := n.I2.I.(parser.NodeExprAnd); ok {
-		return generateAnd(name, expr, symbols)
+	if err != nil {
+		return "", err
 	}
-	return "", fmt.Errorf("invalid expression")
+
+	newName := g.goName(name)
+	return str + fmt.Sprintf(`
+// Parse%s parses a prefix of in, returning the number of tokens used.
+func (p *Parser) Parse%s(in []Token) (Node%s, int, error) {
+	p.reset(&sliceSource{tokens: in})
+	return p.parse%s(0)
+}
+`, newName, newName, newName, newName), nil
 }
 
-func generateAll(ns parser.NodeStatements) (string, error) {
-	statements := ns.I0
+// errorAt adds where statement i of statements is to an error about it:
+// the file it was read from, if known, and its line, if the error has no
+// position of its own.
+func (g *generator) errorAt(statements []parser.NodeStatement, i int, err error) error {
+	if i >= len(g.files) {
+		return err
+	}
+	if _, ok := err.(parser.Error); !ok {
+		err = parser.Error{Message: err.Error(), Line: statementLine(statements[i])}
+	}
+	return positioned(g.files[i], err)
+}
 
-	symbols := make(map[string]string)
-	for _, statement := range statements {
+// statementLine returns the line a statement starts on.
+func statementLine(statement parser.NodeStatement) int {
+	switch n := statement.I.(type) {
+	case parser.NodeStatementExpr:
+		return n.I0.Line
+	case parser.NodeStatementMacro:
+		return n.I0.Line
+	case parser.NodeStatementToken:
+		return n.I0.Line
+	case parser.NodeStatementKeyword:
+		return n.I0.Line
+	case parser.NodeStatementDirective:
+		return n.I0.Line
+	case parser.NodeStatementEmpty:
+		return n.I0.Line
+	}
+	return 0
+}
+
+func generateAll(ns parser.NodeStatements, opts options) (string, error) {
+	return newGenerator(opts).generateAll(ns)
+}
+
+func newGenerator(opts options) *generator {
+	return &generator{symbols: make(map[string]string), lists: make(map[string]*list), literals: make(map[string]string), keywords: make(map[string]string), types: make(map[string]string), macros: make(map[string]parser.NodeStatementMacro), goNames: make(map[string]string), coverage: opts.coverage, files: opts.files}
+}
+
+// declare declares the names statements define, which rules can then be
+// resolved against: tokens, keywords, rules and parameterized rules, along
+// with the settings of directives.
+func (g *generator) declare(statements []parser.NodeStatement) error {
+	for i, statement := range statements {
 		if token, ok := statement.I.(parser.NodeStatementToken); ok {
-			symbols[token.I1.Data] = "token"
+			g.symbols[token.I1.Data] = "token"
+			if err := g.declareToken(token); err != nil {
+				return g.errorAt(statements, i, err)
+			}
+		}
+		if keyword, ok := statement.I.(parser.NodeStatementKeyword); ok {
+			g.symbols[keyword.I1.Data] = "token"
+			if err := g.declareKeyword(keyword); err != nil {
+				return g.errorAt(statements, i, err)
+			}
 		}
 		if expr, ok := statement.I.(parser.NodeStatementExpr); ok {
-			symbols[expr.I0.Data] = "expr"
+			g.symbols[expr.I0.Data] = "expr"
 		}
 	}
+	for i, statement := range statements {
+		if macro, ok := statement.I.(parser.NodeStatementMacro); ok {
+			if err := g.declareMacro(macro); err != nil {
+				return g.errorAt(statements, i, err)
+			}
+		}
+	}
+	for i, statement := range statements {
+		if directive, ok := statement.I.(parser.NodeStatementDirective); ok {
+			if err := g.directive(directive); err != nil {
+				return g.errorAt(statements, i, err)
+			}
+		}
+	}
+	return g.checkModes()
+}
+
+// generateRules declares what statements define and emits the code that
+// differs most between grammars: the node types and parse functions of the
+// rules, their values and lists, and the table of tokens the lexer matches.
+// generateAll adds the runtime, the lexer and the entry points around it.
+func (g *generator) generateRules(statements []parser.NodeStatement) (string, error) {
+	if err := g.declare(statements); err != nil {
+		return "", err
+	}
+
+	// index is where each rule and parameterized rule is among statements,
+	// for errors in them and in the rules made from them.
+	index := make(map[string]int)
+	var rules []parser.NodeStatementExpr
+	for i, statement := range statements {
+		switch n := statement.I.(type) {
+		case parser.NodeStatementExpr:
+			index[n.I0.Data] = i
+			rules = append(rules, n)
+		case parser.NodeStatementMacro:
+			index[n.I0.Data] = i
+		}
+	}
+	body := ""
+	for len(rules) != 0 {
+		for _, expr := range rules {
+			generated, err := g.generate(expr)
+			if err != nil {
+				return "", g.errorAt(statements, index[strings.SplitN(expr.I0.Data, "(", 2)[0]], err)
+			}
+			body += generated
+
+			value, err := g.generateValue(expr)
+			if err != nil {
+				return "", g.errorAt(statements, index[strings.SplitN(expr.I0.Data, "(", 2)[0]], err)
+			}
+			body += value
+		}
+		rules, g.instances = g.instances, nil
+	}
+
+	types := make(map[string]bool)
+	for _, l := range g.order {
+		body += g.generateList(l, types)
+	}
+	body += g.generateTokenDefs()
+	return body, nil
+}
+
+func (g *generator) generateAll(ns parser.NodeStatements) (string, error) {
+	body, err := g.generateRules(ns.I0)
+	if err != nil {
+		return "", err
+	}
+	body += g.generateLexer()
+	body += g.generateStarts()
+	body += g.generateCoverage()
 
 	str := `
 package parser
 
 import (
 	"fmt"
-)
-
+` + g.imports() + `)
+` + g.header + `
 type Error struct {
 	Message string
 	Line int
+	Col int // in runes, starting at 1, or 0 if unknown
+	// Cut is set for errors past a cut, which stop alternatives from being tried.
+	Cut bool
 }
 
 func (e Error) Error() string {
+	if e.Col != 0 {
+		return fmt.Sprintf("%s (%v:%v)", e.Message, e.Line, e.Col)
+	}
 	return fmt.Sprintf("%s (%v)", e.Message, e.Line)
 }
 
-func newError(msg string, line int) error {
-	if line == 0 {
-		msg += ": unexpected EOF"
+// newError returns an error at tok, or at the end of input if tok is nil.
+func newError(msg string, tok *Token) error {
+	if tok == nil {
+		return Error{Message: msg + ": unexpected EOF"}
 	}
-	return Error{msg, line}
+	return Error{Message: msg, Line: tok.Line, Col: tok.Col}
 }
 
-func getLineOr0(tokens []Token, index int) int {
-	if len(tokens) > index {
-		return tokens[index].Line
+func cut(err error) error {
+	if e, ok := err.(Error); ok {
+		e.Cut = true
+		return e
 	}
-	return 0
+	return Error{Message: err.Error(), Cut: true}
+}
+
+func isCut(err error) bool {
+	e, ok := err.(Error)
+	return ok && e.Cut
 }
 
 func wrap(err error, msg string) error {
 	if e, ok := err.(Error); ok {
-		return Error{msg + ": " + e.Message, e.Line}
+		return Error{Message: msg + ": " + e.Message, Line: e.Line, Col: e.Col, Cut: e.Cut}
 	} else {
-		return Error{msg + ": " + err.Error(), 0}
+		return Error{Message: msg + ": " + err.Error()}
 	}
 }
 
@@ -102,130 +568,234 @@ type Token struct {
 	Type string
 	Data string
 	Line int
+	Col int
 }
-`
-	for _, statement := range statements {
-		if expr, ok := statement.I.(parser.NodeStatementExpr); ok {
-			generated, err := generate(expr, symbols)
-			if err != nil {
-				return "", err
-			}
-			str += generated
+
+// TokenSource produces tokens on demand. Next returns false at the end of
+// input.
+type TokenSource interface {
+	Next() (Token, bool, error)
+}
+
+type sliceSource struct {
+	tokens []Token
+}
+
+func (s *sliceSource) Next() (Token, bool, error) {
+	if len(s.tokens) == 0 {
+		return Token{}, false, nil
+	}
+	tok := s.tokens[0]
+	s.tokens = s.tokens[1:]
+	return tok, true, nil
+}
+
+// Parser holds the state of a parse. State is for use by predicates.
+//
+// Tokens are pulled from the source as the parser needs them and kept in a
+// buffer until no alternative, optional or repetition that could backtrack
+// over them is still being tried.
+type Parser struct {
+	State ` + g.stateType() + `
+	src TokenSource
+	buf []Token // tokens from position base on
+	base int
+	done bool // whether src is exhausted
+	err error // error from src
+	marks []int // positions the parser may backtrack to, oldest first
+	lookahead int
+}
+
+func (p *Parser) reset(src TokenSource) {
+	*p = Parser{State: p.State, src: src}
+}
+
+// at returns the token at pos, or nil past the end of input.
+func (p *Parser) at(pos int) *Token {
+	for !p.done && pos >= p.base+len(p.buf) {
+		tok, ok, err := p.src.Next()
+		if err != nil {
+			p.err = err
 		}
+		if !ok || err != nil {
+			p.done = true
+			break
+		}
+		p.buf = append(p.buf, tok)
 	}
-	return str, nil
+	if pos >= p.base+len(p.buf) {
+		return nil
+	}
+	return &p.buf[pos-p.base]
+}
+
+func (p *Parser) mark(pos int) {
+	p.marks = append(p.marks, pos)
 }
 
-func generateAnd(name string, expr parser.NodeExprAnd, symbols map[string]string) (string, error) {
-	newName := transform(name)
+func (p *Parser) unmark() {
+	pos := p.marks[len(p.marks)-1]
+	p.marks = p.marks[:len(p.marks)-1]
+	p.release(pos)
+}
+
+// advance moves the newest mark forward once a repetition has matched again.
+func (p *Parser) advance(pos int) {
+	p.marks[len(p.marks)-1] = pos
+	p.release(pos)
+}
+
+// release drops the buffered tokens before pos that no mark still needs.
+func (p *Parser) release(pos int) {
+	if len(p.marks) != 0 && p.marks[0] < pos {
+		pos = p.marks[0]
+	}
+	if n := pos - p.base; n > 0 {
+		p.buf = p.buf[n:]
+		p.base = pos
+	}
+}
+
+// Peek returns the ith token after the current position, for use by
+// predicates. Past the end of input it returns an empty Token.
+func (p *Parser) Peek(i int) Token {
+	if tok := p.at(p.lookahead + i); tok != nil {
+		return *tok
+	}
+	return Token{}
+}
+`
+	return str + body, nil
+}
+
+func (g *generator) generateAnd(name string, expr parser.NodeExprAnd) (string, error) {
+	newName := g.goName(name)
 
 	var units []parser.NodeUnitEll = expr.I0
 	fieldsStr := ""
 	methodStr := ""
 	i := 0
-	for _, unitell := range units {
-		identName, identTag, suffix := handleUnitEll(unitell)
+	g.committed = false
+	coverStr := ""
+	if g.coverage {
+		coverStr += "\n\t" + g.cover(name, "match")
+	}
+	for pos, unitell := range units {
+		if tok, ok := unitell.I.(parser.Token); ok && tok.Type == "cut" {
+			g.committed = true
+			continue
+		}
+		if pred, ok := unitell.I.(parser.NodeUnitPred); ok {
+			methodStr += g.generatePred(newName, name, pred)
+			continue
+		}
+
+		unit, suffix := handleUnitEll(unitell)
+		r, err := g.resolve(unit)
+		if err != nil {
+			return "", err
+		}
+
+		if suffix == "and" || suffix == "not" {
+			methodStr += g.generateLook(newName, name, r, suffix == "not")
+			continue
+		}
 
 		if suffix == "" {
-			if symbols[identName] == "token" {
-				fieldsStr += fmt.Sprintf("\tI%v Token // %s\n", i, identName)
-				if identTag == "" {
-					methodStr += fmt.Sprintf(`
-	if len(in) <= curr || in[curr].Type != "%s" {
-		return Node%s{}, 0, newError("failed to parse %s: %s expected", getLineOr0(in, curr))
-	}
-	out.I%v = in[curr]
-	curr++
-	`, identName, newName, name, identName, i)
-				} else {
-					methodStr += fmt.Sprintf(`
-	if len(in) <= curr || in[curr].Type != "%s" || in[curr].Data != "%s" {
-		return Node%s{}, 0, newError("failed to parse %s: %s expected", getLineOr0(in, curr))
+			if r.token {
+				fieldsStr += fmt.Sprintf("\tI%v Token // %s\n", i, describeUnit(unit))
+				methodStr += fmt.Sprintf(`
+	if %s {
+		return Node%s{}, 0, %s
 	}
-	out.I%v = in[curr]
+	out.I%v = *p.at(curr)
 	curr++
-	`, identName, identTag, newName, name, identName, i)
-				}
-			} else if symbols[identName] == "expr" {
-				fieldsStr += fmt.Sprintf("\tI%v Node%s\n", i, transform(identName))
+	p.release(curr)
+	`, r.mismatch("curr"), newName, g.fail(newError("failed to parse "+name+": "+r.label()+" expected")), i)
+			} else {
+				fieldsStr += fmt.Sprintf("\tI%v %s\n", i, r.typ)
 				methodStr += fmt.Sprintf(`
-	node%v, currChange, err := Parse%s(in[curr:])
+	node%v, currChange, err := %s(curr)
 	if err != nil {
-		return Node%s{}, 0, wrap(err, "failed to parse %s")
+		return Node%s{}, 0, %s
 	}
 	out.I%v = node%v
 	curr += currChange
-				`, i, transform(identName), newName, name, i, i)
-			} else {
-				return "", fmt.Errorf("unknown identifier: %s", identName)
+				`, i, r.parse, newName, g.fail(wrap(name)), i, i)
 			}
 		} else if suffix == "opt" {
-			if symbols[identName] == "token" {
-				fieldsStr += fmt.Sprintf("\tI%v *Token // %s\n", i, identName)
-				if identTag == "" {
-					methodStr += fmt.Sprintf(`
-	if len(in) > curr && in[curr].Type == "%s" {
-		out.I%v = &Token{Type: in[curr].Type, Data: Type: in[curr].Data, Line: in[curr].Line}
-		curr++
-	}
-	`, identName, i)
-				} else {
-					methodStr += fmt.Sprintf(`
-	if len(in) > curr && in[curr].Type == "%s" && in[curr].Data == "%s" {
-		out.I%v = &Token{Type: in[curr].Type, Data: Type: in[curr].Data, Line: in[curr].Line}
+			if g.coverage {
+				part := fmt.Sprintf("part %v (%s?)", pos+1, describeUnit(unit))
+				coverStr += fmt.Sprintf("\n\tif out.I%v != nil {\n\t\t%s\n\t} else {\n\t\t%s\n\t}", i, g.cover(name, part+" taken"), g.cover(name, part+" skipped"))
+			}
+			if r.token {
+				fieldsStr += fmt.Sprintf("\tI%v *Token // %s\n", i, describeUnit(unit))
+				methodStr += fmt.Sprintf(`
+	if %s {
+		tok := *p.at(curr)
+		out.I%v = &tok
 		curr++
+		p.release(curr)
 	}
-	`, identName, identTag, i)
-				}
-			} else if symbols[identName] == "expr" {
-				fieldsStr += fmt.Sprintf("\tI%v *Node%s\n", i, transform(identName))
+	`, r.match("curr"), i)
+			} else {
+				fieldsStr += fmt.Sprintf("\tI%v *%s\n", i, r.typ)
 				methodStr += fmt.Sprintf(`
-	node%v, currChange, err := Parse%s(in[curr:])
+	p.mark(curr)
+	node%v, currChange, err := %s(curr)
+	p.unmark()
 	if err == nil {
 		out.I%v = &node%v
 		curr += currChange
+	} else if isCut(err) {
+		return Node%s{}, 0, %s
 	}
-				`, i, transform(identName), i, i)
-			} else {
-				return "", fmt.Errorf("unknown identifier: %s", identName)
+				`, i, r.parse, i, i, newName, wrap(name))
 			}
 		} else if suffix == "ell" {
+			if g.coverage {
+				part := fmt.Sprintf("part %v (%s...)", pos+1, describeUnit(unit))
+				coverStr += fmt.Sprintf("\n\tif len(out.I%v) == 0 {\n\t\t%s\n\t} else {\n\t\t%s\n\t}", i, g.cover(name, part+" none"), g.cover(name, part+" repeated"))
+			}
+			if !r.token {
+				methodStr += "\n\tp.mark(curr)"
+			}
 			methodStr += `
 	for {`
-			if symbols[identName] == "token" {
-				fieldsStr += fmt.Sprintf("\tI%v []Token // %s\n", i, identName)
-				if identTag == "" {
-					methodStr += fmt.Sprintf(`
-		if len(in) <= curr || in[curr].Type != "%s" {
-			break
-		}
-		out.I%v = append(out.I%v, in[curr])
-		curr++
-	`, identName, i, i)
-				} else {
-					methodStr += fmt.Sprintf(`
-		if len(in) <= curr || in[curr].Type != "%s" || in[curr].Data != "%s" {
+			if r.token {
+				fieldsStr += fmt.Sprintf("\tI%v []Token // %s\n", i, describeUnit(unit))
+				methodStr += fmt.Sprintf(`
+		if %s {
 			break
 		}
-		out.I%v = append(out.I%v, in[curr])
+		out.I%v = append(out.I%v, *p.at(curr))
 		curr++
-	`, identName, identTag, i, i)
-				}
-			} else if symbols[identName] == "expr" {
-				fieldsStr += fmt.Sprintf("\tI%v []Node%s\n", i, transform(identName))
+		p.release(curr)
+	`, r.mismatch("curr"), i, i)
+			} else {
+				fieldsStr += fmt.Sprintf("\tI%v []%s\n", i, r.typ)
 				methodStr += fmt.Sprintf(`
-		node%v, currChange, err := Parse%s(in[curr:])
+		node%v, currChange, err := %s(curr)
 		if err != nil {
+			if isCut(err) {
+				p.unmark()
+				return Node%s{}, 0, %s
+			}
+			break
+		}
+		if currChange == 0 {
 			break
 		}
 		out.I%v = append(out.I%v, node%v)
 		curr += currChange
-				`, i, transform(identName), i, i, i)
-			} else {
-				return "", fmt.Errorf("unknown identifier: %s", identName)
+		p.advance(curr)
+				`, i, r.parse, newName, wrap(name), i, i, i)
 			}
 
 			methodStr += "\n\t}"
+			if !r.token {
+				methodStr += "\n\tp.unmark()"
+			}
 		}
 		i++
 	}
@@ -236,20 +806,79 @@ type Node%s struct {
 }
 `, newName, fieldsStr)
 	str += fmt.Sprintf(`
-func Parse%s(in []Token) (Node%s, int, error) {
+func (p *Parser) parse%s(start int) (Node%s, int, error) {
 	var out Node%s
-	curr := 0
+	curr := start
 `, newName, newName, newName)
 	str += methodStr
+	str += coverStr
 	str += `
-	return out, curr, nil
+	return out, curr - start, nil
 }
 `
 	return str, nil
 }
 
-func generateOr(name string, expr parser.NodeExprOr, symbols map[string]string) (string, error) {
-	newName := transform(name)
+// generateLook emits a lookahead check, which consumes nothing and has no field.
+func (g *generator) generateLook(newName string, name string, r ref, not bool) string {
+	if r.any && not {
+		return fmt.Sprintf(`
+	if %s {
+		return Node%s{}, 0, %s
+	}
+	`, r.match("curr"), newName, g.fail(newError("failed to parse "+name+": end of input expected")))
+	}
+	if r.token && not {
+		return fmt.Sprintf(`
+	if %s {
+		return Node%s{}, 0, %s
+	}
+	`, r.match("curr"), newName, g.fail(newError("failed to parse "+name+": unexpected "+r.label())))
+	}
+	if r.token {
+		return fmt.Sprintf(`
+	if %s {
+		return Node%s{}, 0, %s
+	}
+	`, r.mismatch("curr"), newName, g.fail(newError("failed to parse "+name+": "+r.label()+" expected")))
+	}
+	if not {
+		return fmt.Sprintf(`
+	p.mark(curr)
+	if _, _, err := %s(curr); err == nil {
+		p.unmark()
+		return Node%s{}, 0, %s
+	}
+	p.unmark()
+	`, r.parse, newName, g.fail(newError("failed to parse "+name+": unexpected "+r.label())))
+	}
+	return fmt.Sprintf(`
+	p.mark(curr)
+	if _, _, err := %s(curr); err != nil {
+		p.unmark()
+		return Node%s{}, 0, %s
+	}
+	p.unmark()
+	`, r.parse, newName, g.fail(newError("failed to parse "+name+": "+r.label()+" expected")))
+}
+
+// generatePred emits a semantic predicate, which checks a Go expression
+// that can use the Parser as p.
+func (g *generator) generatePred(newName string, name string, pred parser.NodeUnitPred) string {
+	cond := "!(" + pred.I1.Data + ")"
+	if pred.I0.I.(parser.Token).Type == "bang" {
+		cond = pred.I1.Data
+	}
+	return fmt.Sprintf(`
+	p.lookahead = curr
+	if %s {
+		return Node%s{}, 0, %s
+	}
+	`, cond, newName, g.fail(newError("failed to parse "+name+": predicate failed")))
+}
+
+func (g *generator) generateOr(name string, expr parser.NodeExprOr) (string, error) {
+	newName := g.goName(name)
 	str := fmt.Sprintf(`
 type Node%s struct {
 	I interface{}
@@ -257,7 +886,9 @@ type Node%s struct {
 `, newName)
 
 	str += fmt.Sprintf(`
-func Parse%s(in []Token) (Node%s, int, error) {`, newName, newName)
+func (p *Parser) parse%s(start int) (Node%s, int, error) {
+	p.mark(start)
+	defer p.unmark()`, newName, newName)
 
 	var units []parser.NodeUnit
 	units = append(units, expr.I0, expr.I2)
@@ -265,43 +896,242 @@ func Parse%s(in []Token) (Node%s, int, error) {`, newName, newName)
 		units = append(units, ext.I1)
 	}
 
-	for _, unit := range units {
-		identName := ""
-		musteq := ""
-		if token, ok := unit.I.(parser.Token); ok {
-			identName = token.Data
+	match := ""
+	if g.coverage {
+		match = "\n\t\t" + g.cover(name, "match")
+	}
+	for alt, unit := range units {
+		r, err := g.resolve(unit)
+		if err != nil {
+			return "", err
 		}
-		if unitToken, ok := unit.I.(parser.NodeUnitToken); ok {
-			identName = unitToken.I0.Data
-			musteq = unitToken.I2.Data
+		cover := match
+		if g.coverage {
+			cover += "\n\t\t" + g.cover(name, fmt.Sprintf("alternative %v (%s)", alt+1, describeUnit(unit)))
 		}
 
-		if symbols[identName] == "token" && musteq == "" {
+		if r.token {
 			str += fmt.Sprintf(`
-	if len(in) != 0 && in[0].Type == "%s" {
-		return Node%s{in[0]}, 1, nil
+	if %s {%s
+		return Node%s{*p.at(start)}, 1, nil
 	}
-`, identName, newName)
-		} else if symbols[identName] == "token" && musteq != "" {
-			str += fmt.Sprintf(`
-	if len(in) != 0 && in[0].Type == "%s" && in[0].Data == "%s" {
-		return Node%s{in[0]}, 1, nil
-	}
-`, identName, musteq, newName)
-		} else if symbols[identName] == "expr" {
+`, r.match("start"), cover, newName)
+		} else {
 			str += fmt.Sprintf(`
-	if node, curr, err := Parse%s(in); err == nil {
-		return Node%s{node}, curr, nil
+	if node, n, err := %s(start); err == nil {%s
+		return Node%s{node}, n, nil
+	} else if isCut(err) {
+		return Node%s{nil}, 0, wrap(err, %q)
 	}
-		`, transform(identName), newName)
-		} else {
-			return "", fmt.Errorf("unknown identifier: %s", identName)
+		`, r.parse, cover, newName, newName, "failed to parse "+name)
 		}
 	}
 
 	str += fmt.Sprintf(`
-	return Node%s{nil}, 0, newError("failed to parse %s", getLineOr0(in, 0))
+	return Node%s{nil}, 0, newError("failed to parse %s", p.at(start))
 }
 `, newName, name)
 	return str, nil
 }
+
+// generateList emits the parse function for a list instantiation, and
+// its node type if no other list has emitted it yet.
+func (g *generator) generateList(l *list, types map[string]bool) string {
+	typ := listType(l.item)
+	str := ""
+	if !types[typ] {
+		types[typ] = true
+		str += fmt.Sprintf(`
+type %s struct {
+	Items []%s
+	Seps []Token
+}
+`, typ, l.item.typ)
+	}
+
+	str += fmt.Sprintf(`
+// %s
+func (p *Parser) %s(start int) (%s, int, error) {
+	var out %s
+	curr := start
+	p.mark(start)
+	defer p.unmark()
+`, l.desc, l.parse, typ, typ)
+	if !l.trailing {
+		str += "\tend := start\n"
+	}
+	str += "\tfor {\n"
+
+	if l.item.token {
+		str += fmt.Sprintf(`		if %s {
+			break
+		}
+		out.Items = append(out.Items, *p.at(curr))
+		curr++
+`, l.item.mismatch("curr"))
+	} else {
+		str += fmt.Sprintf(`		node, currChange, err := %s(curr)
+		if err != nil {
+			if isCut(err) {
+				return %s{}, 0, wrap(err, %q)
+			}
+			break
+		}
+		out.Items = append(out.Items, node)
+		curr += currChange
+`, l.item.parse, typ, "failed to parse "+l.desc)
+	}
+
+	if !l.trailing {
+		str += "\t\tend = curr\n"
+	}
+	str += fmt.Sprintf(`		p.advance(curr)
+
+		if %s {
+			return out, curr - start, nil
+		}
+		out.Seps = append(out.Seps, *p.at(curr))
+		curr++
+	}
+`, l.sep.mismatch("curr"))
+
+	if !l.empty {
+		str += fmt.Sprintf(`
+	if len(out.Items) == 0 {
+		return %s{}, 0, newError(%q, p.at(curr))
+	}
+`, typ, "failed to parse "+l.desc+": "+l.item.label()+" expected")
+	}
+	if l.trailing {
+		str += `
+	return out, curr - start, nil
+}
+`
+	} else {
+		str += `
+	if len(out.Seps) > 0 && len(out.Seps) == len(out.Items) {
+		out.Seps = out.Seps[:len(out.Seps)-1]
+	}
+	return out, end - start, nil
+}
+`
+	}
+	return str
+}
+
+// generateStarts emits entry points for each start rule, which require
+// the rule to consume all of its input: ParseRuleFrom, which pulls tokens
+// from a TokenSource, and ParseRuleTokens. Grammars with a lexer also get
+// Parse and ParseReader for the first one. Start rules with a %type return
+// their value instead of their node. Each entry point is a method on Parser
+// and a function using a new Parser.
+func (g *generator) generateStarts() string {
+	str := ""
+	for _, name := range g.starts {
+		newName := g.goName(name)
+		result := g.startType(name)
+		value := "&out"
+		if g.types[name] != "" {
+			value = "out.Value()"
+		}
+		str += fmt.Sprintf(`
+func (p *Parser) Parse%sFrom(src TokenSource) (%s, error) {
+	p.reset(src)
+	out, n, err := p.parse%s(0)
+	if err == nil && p.at(n) != nil {
+		err = newError(%q+p.at(n).Type, p.at(n))
+	}
+	if p.err != nil {
+		err = p.err
+	}
+	if err != nil {
+		var zero %s
+		return zero, err
+	}
+	return %s, nil
+}
+
+func (p *Parser) Parse%sTokens(in []Token) (%s, error) {
+	return p.Parse%sFrom(&sliceSource{tokens: in})
+}
+
+func Parse%sFrom(src TokenSource) (%s, error) {
+	return new(Parser).Parse%sFrom(src)
+}
+
+func Parse%sTokens(in []Token) (%s, error) {
+	return new(Parser).Parse%sTokens(in)
+}
+`, newName, result, newName, "failed to parse "+name+": unexpected ", result, value,
+			newName, result, newName, newName, result, newName, newName, result, newName)
+	}
+
+	if len(g.starts) != 0 && len(g.tokens) != 0 {
+		newName := g.goName(g.starts[0])
+		result := g.startType(g.starts[0])
+		str += fmt.Sprintf(`
+func (p *Parser) Parse(src string) (%s, error) {
+	return p.ParseReader(strings.NewReader(src))
+}
+
+// ParseReader lexes r as the parser needs tokens, so the input never has
+// to be held in memory at once.
+func (p *Parser) ParseReader(r io.Reader) (%s, error) {
+	return p.Parse%sFrom(NewLexer(r))
+}
+
+func Parse(src string) (%s, error) {
+	return new(Parser).Parse(src)
+}
+
+func ParseReader(r io.Reader) (%s, error) {
+	return new(Parser).ParseReader(r)
+}
+`, result, result, newName, result, result)
+	}
+	return str
+}
+
+// generateCoverage emits the coverage counters and WriteCoverage, which
+// llgen coverage reads.
+func (g *generator) generateCoverage() string {
+	if !g.coverage {
+		return ""
+	}
+	points := ""
+	for _, point := range g.points {
+		points += fmt.Sprintf("\t%q,\n", point)
+	}
+	return fmt.Sprintf(`
+var coverage [%v]uint64
+
+var coveragePoints = [...]string{
+%s}
+
+// WriteCoverage writes how many times each rule, alternative of a rule and
+// optional or repeated part of a rule has matched, as "rule\tpoint\tcount"
+// lines.
+func WriteCoverage(w io.Writer) error {
+	for i, point := range coveragePoints {
+		if _, err := fmt.Fprintf(w, "%%s\t%%v\n", point, atomic.LoadUint64(&coverage[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+`, len(g.points), points)
+}
+
+func (g *generator) stateType() string {
+	if g.state != "" {
+		return g.state
+	}
+	return "interface{}"
+}
+
+func (g *generator) startType(name string) string {
+	if typ := g.types[name]; typ != "" {
+		return typ
+	}
+	return "*Node" + g.goName(name)
+}
@@ -0,0 +1,615 @@
+package main
+
+import (
+	"fmt"
+	"github.com/allen-b1/llgen/parser"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// tokenDef is a token the generated lexer knows how to match, either by
+// its literal text or by a regular expression.
+type tokenDef struct {
+	name    string
+	literal string
+	pattern string
+	fold    bool   // match the literal case-insensitively
+	mode    string // lexer mode the token belongs to
+	push    string // mode entered after matching the token
+	pop     bool   // whether matching the token returns to the previous mode
+}
+
+func (g *generator) declareToken(n parser.NodeStatementToken) error {
+	if n.I2 == nil {
+		if n.I3 != nil {
+			return fmt.Errorf("token %s: only tokens the lexer matches can change modes", n.I1.Data)
+		}
+		if g.mode != "" {
+			return fmt.Errorf("token %s: tokens in %%mode %s need a literal or pattern", n.I1.Data, g.mode)
+		}
+		return nil
+	}
+	def := tokenDef{name: n.I1.Data, mode: g.mode}
+	if annotation, ok := n.I2.I.(parser.NodeStatementTokenAnnotation); ok {
+		if annotation.I1.Data == "" {
+			return fmt.Errorf("token %s: empty literal", def.name)
+		}
+		def.literal = annotation.I1.Data
+		if err := g.sameText("token", def); err != nil {
+			return err
+		}
+		if _, ok := g.literals[def.literal]; !ok {
+			g.literals[def.literal] = def.name
+		}
+	}
+	if pattern, ok := n.I2.I.(parser.NodeStatementTokenPattern); ok {
+		if _, err := regexp.Compile(pattern.I1.Data); err != nil {
+			return fmt.Errorf("token %s: %v", def.name, err)
+		}
+		def.pattern = pattern.I1.Data
+	}
+	if n.I3 != nil {
+		if push, ok := n.I3.I.(parser.NodeTokenPush); ok {
+			def.push = push.I1.Data
+		} else {
+			def.pop = true
+		}
+	}
+	g.tokens = append(g.tokens, def)
+	return nil
+}
+
+func (g *generator) declareKeyword(n parser.NodeStatementKeyword) error {
+	def := tokenDef{name: n.I1.Data, literal: n.I1.Data, fold: n.I3 != nil, mode: g.mode}
+	if n.I2 != nil {
+		def.literal = n.I2.I1.Data
+	}
+	if def.literal == "" {
+		return fmt.Errorf("keyword %s: empty literal", def.name)
+	}
+	if err := g.sameText("keyword", def); err != nil {
+		return err
+	}
+	if _, ok := g.literals[def.literal]; !ok {
+		g.literals[def.literal] = def.name
+	}
+	g.keywords[def.name] = def.literal
+	g.tokens = append(g.tokens, def)
+	return nil
+}
+
+// sameText reports a token declared with the text of an earlier one in
+// the same mode, which the lexer would never match since the earlier one
+// wins the tie.
+func (g *generator) sameText(kind string, def tokenDef) error {
+	for _, other := range g.tokens {
+		if other.literal == "" || other.mode != def.mode {
+			continue
+		}
+		if other.literal == def.literal || (other.fold || def.fold) && strings.EqualFold(other.literal, def.literal) {
+			return fmt.Errorf("%s %s has the same text as token %s", kind, def.name, other.name)
+		}
+	}
+	return nil
+}
+
+// declareMode declares the tokens in the block of %mode name { ... },
+// which the lexer only matches while in that mode.
+func (g *generator) declareMode(name string, block parser.Token) error {
+	tokens, err := tokenize(block.Data + "\n")
+	if err == nil {
+		var ns *parser.NodeStatements
+		ns, err = parser.ParseStatementsTokens(tokens)
+		if err == nil {
+			err = g.declareModeTokens(name, ns.I0)
+		}
+	}
+	if e, ok := err.(parser.Error); ok {
+		e.Line += block.Line
+		e.Message = fmt.Sprintf("%%mode %s: %s", name, e.Message)
+		return e
+	}
+	if err != nil {
+		return fmt.Errorf("%%mode %s: %v", name, err)
+	}
+	return nil
+}
+
+func (g *generator) declareModeTokens(name string, statements []parser.NodeStatement) error {
+	if name != "default" {
+		g.mode = name
+		defer func() { g.mode = "" }()
+		if !g.hasMode(name) {
+			g.modes = append(g.modes, name)
+		}
+	}
+	for _, statement := range statements {
+		switch n := statement.I.(type) {
+		case parser.NodeStatementToken:
+			g.symbols[n.I1.Data] = "token"
+			if err := g.declareToken(n); err != nil {
+				return err
+			}
+		case parser.NodeStatementKeyword:
+			g.symbols[n.I1.Data] = "token"
+			if err := g.declareKeyword(n); err != nil {
+				return err
+			}
+		case parser.NodeStatementEmpty:
+		default:
+			return fmt.Errorf("only tokens and keywords can be declared in a mode")
+		}
+	}
+	return nil
+}
+
+// checkModes checks that every mode a token pushes is declared.
+func (g *generator) checkModes() error {
+	for _, def := range g.tokens {
+		if def.push == "" || def.push == "default" {
+			continue
+		}
+		if !g.hasMode(def.push) {
+			return fmt.Errorf("token %s: unknown mode: %s", def.name, def.push)
+		}
+	}
+	return nil
+}
+
+func (g *generator) hasMode(name string) bool {
+	for _, mode := range g.modes {
+		if mode == name {
+			return true
+		}
+	}
+	return false
+}
+
+// literal returns the token matching the literal text, declaring an
+// anonymous token named after the quoted text if there is none.
+func (g *generator) literal(text string) (string, error) {
+	if text == "" {
+		return "", fmt.Errorf("empty literal")
+	}
+	if name, ok := g.literals[text]; ok {
+		return name, nil
+	}
+	name := strconv.Quote(text)
+	g.literals[text] = name
+	g.symbols[name] = "token"
+	g.tokens = append(g.tokens, tokenDef{name: name, literal: text})
+	return name, nil
+}
+
+func (g *generator) hasPatterns() bool {
+	for _, def := range g.tokens {
+		if def.pattern != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *generator) imports() string {
+	str := ""
+	if len(g.tokens) != 0 || g.coverage {
+		str += "\t\"io\"\n"
+	}
+	if g.hasPatterns() {
+		str += "\t\"regexp\"\n"
+	}
+	if len(g.tokens) != 0 {
+		str += "\t\"strings\"\n"
+	}
+	if g.coverage {
+		str += "\t\"sync/atomic\"\n"
+	}
+	if len(g.tokens) != 0 {
+		str += "\t\"unicode/utf8\"\n"
+	}
+	return str
+}
+
+// tokenDefs returns the entries of the tokenDefs table for a mode:
+// literals and keywords first, then patterns.
+func (g *generator) tokenDefs(mode string) string {
+	str := ""
+	for _, def := range g.tokens {
+		if def.mode != mode || def.literal == "" {
+			continue
+		}
+		str += fmt.Sprintf("\t{Type: %q, Literal: %q%s},\n", def.name, def.literal, def.options())
+	}
+	for _, def := range g.tokens {
+		if def.mode != mode || def.pattern == "" {
+			continue
+		}
+		str += fmt.Sprintf("\t{Type: %q, Pattern: regexp.MustCompile(%q)%s},\n", def.name, "^(?:"+def.pattern+")", def.options())
+	}
+	return str
+}
+
+func (def tokenDef) options() string {
+	str := ""
+	if def.fold {
+		str += ", Fold: true"
+	}
+	if def.push != "" {
+		str += fmt.Sprintf(", Push: %q", def.push)
+	}
+	if def.pop {
+		str += ", Pop: true"
+	}
+	return str
+}
+
+// generateTokenDefs emits the table of token definitions the lexer
+// matches, with one list of tokens for each mode if there are modes.
+func (g *generator) generateTokenDefs() string {
+	if len(g.tokens) == 0 {
+		return ""
+	}
+
+	fields := "\tType string\n\tLiteral string\n\tFold bool\n"
+	if g.hasPatterns() {
+		fields += "\tPattern *regexp.Regexp\n"
+	}
+	if len(g.modes) == 0 {
+		return fmt.Sprintf(`
+type tokenDef struct {
+%s}
+
+var tokenDefs = []tokenDef{
+%s}
+`, fields, g.tokenDefs(""))
+	}
+	fields += "\tPush string // mode entered after the token\n\tPop bool // whether the token returns to the previous mode\n"
+	modes := ""
+	for _, mode := range append([]string{""}, g.modes...) {
+		name := mode
+		if name == "" {
+			name = "default"
+		}
+		defs := strings.Replace(g.tokenDefs(mode), "\t", "\t\t", -1)
+		modes += fmt.Sprintf("\t%q: {\n%s\t},\n", name, defs)
+	}
+	return fmt.Sprintf(`
+type tokenDef struct {
+%s}
+
+// tokenDefs holds the tokens of each lexer mode.
+var tokenDefs = map[string][]tokenDef{
+%s}
+`, fields, modes)
+}
+
+// generateLexer emits Lex and NewLexer, which split source text into tokens
+// using the longest match among the token definitions. Literals and keywords are
+// tried before patterns, so they win ties; this is what keeps keywords out
+// of identifiers. Whitespace that no token matches is skipped.
+func (g *generator) generateLexer() string {
+	if len(g.tokens) == 0 {
+		return ""
+	}
+	defs := "tokenDefs"
+	if len(g.modes) != 0 {
+		defs = "tokenDefs[l.mode()]"
+	}
+
+	match := `		if matchLiteral(l.src[l.i:], def) {
+			n = len(def.Literal)
+		}`
+	if g.hasPatterns() {
+		match = `		if def.Pattern != nil {
+			if loc := def.Pattern.FindStringIndex(l.src[l.i:]); loc != nil {
+				n = loc[1]
+			}
+		} else if matchLiteral(l.src[l.i:], def) {
+			n = len(def.Literal)
+		}`
+	}
+
+	str := `
+func matchLiteral(src string, def tokenDef) bool {
+	if def.Fold {
+		return len(src) >= len(def.Literal) && strings.EqualFold(src[:len(def.Literal)], def.Literal)
+	}
+	return strings.HasPrefix(src, def.Literal)
+}
+`
+
+	fields := ""
+	if len(g.modes) != 0 {
+		fields += "\n\tmodes []string // stack of entered modes"
+	}
+	if g.indent {
+		fields += `
+	lineStart bool
+	indents []string // indentation of each open block
+	pending []Token // indent and dedent tokens waiting to be returned`
+	}
+	str += fmt.Sprintf(`
+type lexer struct {
+	src string // input read but not yet lexed, from i on
+	i int
+	r io.Reader // the rest of the input, or nil
+	err error // error from r
+	line int
+	col int // in runes%s
+}
+
+// more reads the next chunk of input into src, returning false at the end
+// of input. Chunks grow with src so that long tokens take few reads.
+func (l *lexer) more() bool {
+	if l.r == nil {
+		return false
+	}
+	size := 4096
+	if len(l.src) > size {
+		size = len(l.src)
+	}
+	buf := make([]byte, size)
+	n, err := io.ReadFull(l.r, buf)
+	l.src += string(buf[:n])
+	if err != nil {
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			l.err = err
+		}
+		l.r = nil
+	}
+	return n > 0
+}
+
+// advance moves past the next n bytes, keeping track of the line and column.
+func (l *lexer) advance(n int) {
+	text := l.src[l.i : l.i+n]
+	if j := strings.LastIndexByte(text, '\n'); j >= 0 {
+		l.line += strings.Count(text, "\n")
+		l.col = 1
+		text = text[j+1:]
+	}
+	l.col += utf8.RuneCountInString(text)
+	l.i += n
+}
+
+func (l *lexer) errorf(format string, args ...interface{}) error {
+	return Error{Message: fmt.Sprintf(format, args...), Line: l.line, Col: l.col}
+}
+
+// validPrefix returns the length of the longest valid UTF-8 prefix of s.
+func validPrefix(s string) int {
+	for i, r := range s {
+		if r == utf8.RuneError {
+			if _, size := utf8.DecodeRuneInString(s[i:]); size == 1 {
+				return i
+			}
+		}
+	}
+	return len(s)
+}
+
+// match returns the index of the longest matching token definition and
+// the length of its match, or -1 if none match.
+func (l *lexer) match() (int, int) {
+	best := -1
+	bestLen := 0
+	for j, def := range %s {
+		n := 0
+%s
+		if n > bestLen {
+			best = j
+			bestLen = n
+		}
+	}
+	return best, bestLen
+}
+`, fields, defs, match)
+
+	if len(g.modes) != 0 {
+		str += `
+func (l *lexer) mode() string {
+	if len(l.modes) == 0 {
+		return "default"
+	}
+	return l.modes[len(l.modes)-1]
+}
+`
+	}
+
+	if g.indent {
+		str += g.generateIndentation()
+	}
+
+	str += `
+// Next returns the next token, or false at the end of input.
+func (l *lexer) Next() (Token, bool, error) {
+	for {
+`
+	if g.indent {
+		str += `		if len(l.pending) != 0 {
+			tok := l.pending[0]
+			l.pending = l.pending[1:]
+			return tok, true, nil
+		}
+`
+	}
+	str += `		l.src = l.src[l.i:]
+		l.i = 0
+		for len(l.src) < 1024 && l.more() {
+		}
+		if l.err != nil {
+			return Token{}, false, l.err
+		}
+`
+	if g.indent {
+		str += `		if l.lineStart {
+			if err := l.indentation(); err != nil {
+				return Token{}, false, err
+			}
+			continue
+		}
+`
+	}
+	str += `		if l.i >= len(l.src) {
+`
+	if g.indent {
+		str += `			if len(l.indents) != 0 {
+				for range l.indents {
+					l.pending = append(l.pending, Token{Type: "dedent", Line: l.line, Col: l.col})
+				}
+				l.indents = nil
+				continue
+			}
+`
+	}
+	if len(g.modes) != 0 {
+		str += `			if len(l.modes) != 0 {
+				return Token{}, false, l.errorf("unexpected end of input in mode %s", l.mode())
+			}
+`
+	}
+	space := `l.src[l.i] == ' ' || l.src[l.i] == '\t' || l.src[l.i] == '\r' || l.src[l.i] == '\n'`
+	if len(g.modes) != 0 {
+		// Whitespace is only skipped in the default mode; other modes
+		// have to match it explicitly.
+		space = `l.mode() == "default" && (` + space + `)`
+	}
+	str += `			return Token{}, false, nil
+		}
+
+		// A match running to the end of what has been read, or no match
+		// at all, might change with more input.
+		best, bestLen := l.match()
+		if (best < 0 && !(` + space + `) || best >= 0 && l.i+bestLen == len(l.src)) && l.more() {
+			continue
+		}
+		if best < 0 {
+			if ` + space + ` {
+`
+	if g.indent {
+		str += `				if l.src[l.i] == '\n' {
+					l.lineStart = true
+				}
+`
+	}
+	str += `				l.advance(1)
+				continue
+			}
+			r, size := utf8.DecodeRuneInString(l.src[l.i:])
+			if r == utf8.RuneError && size == 1 {
+				return Token{}, false, l.errorf("invalid UTF-8")
+			}
+			return Token{}, false, l.errorf("invalid token: %q", l.src[l.i:l.i+size])
+		}
+
+		def := ` + defs + `[best]
+		text := l.src[l.i : l.i+bestLen]
+		if n := validPrefix(text); n < len(text) {
+			l.advance(n)
+			return Token{}, false, l.errorf("invalid UTF-8")
+		}
+		tok := Token{Type: def.Type, Data: text, Line: l.line, Col: l.col}
+		l.advance(bestLen)
+`
+	if len(g.modes) != 0 {
+		str += `		if def.Push != "" {
+			l.modes = append(l.modes, def.Push)
+		}
+		if def.Pop {
+			if len(l.modes) == 0 {
+				return Token{}, false, newError(fmt.Sprintf("unbalanced token: %q", text), &tok)
+			}
+			l.modes = l.modes[:len(l.modes)-1]
+		}
+`
+	}
+	if g.indent && len(g.modes) != 0 {
+		str += "\t\tl.lineStart = strings.HasSuffix(text, \"\\n\") && l.mode() == \"default\"\n"
+	} else if g.indent {
+		str += "\t\tl.lineStart = strings.HasSuffix(text, \"\\n\")\n"
+	}
+	init := ""
+	if g.indent {
+		init = ", lineStart: true"
+	}
+	str += fmt.Sprintf(`		return tok, true, nil
+	}
+}
+
+// NewLexer returns a TokenSource that lexes r as tokens are requested.
+func NewLexer(r io.Reader) TokenSource {
+	return &lexer{r: r, line: 1, col: 1%s}
+}
+
+func Lex(src string) ([]Token, error) {
+	l := &lexer{src: src, line: 1, col: 1%s}
+	out := make([]Token, 0)
+	for {
+		tok, ok, err := l.Next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return out, nil
+		}
+		out = append(out, tok)
+	}
+}
+`, init, init)
+	return str
+}
+
+// generateIndentation emits the lexer method that turns the indentation
+// at the start of each line into indent and dedent tokens. Blank lines are
+// skipped entirely. A line must either keep the indentation of the line
+// before, extend it, or return to that of an enclosing block, which also
+// rejects mixing tabs and spaces inconsistently.
+func (g *generator) generateIndentation() string {
+	return `
+func (l *lexer) indentation() error {
+	for {
+		start := l.i
+		for (l.i < len(l.src) || l.more()) && (l.src[l.i] == ' ' || l.src[l.i] == '\t') {
+			l.advance(1)
+		}
+		if (l.i < len(l.src) || l.more()) && (l.src[l.i] == '\r' || l.src[l.i] == '\n') {
+			if l.src[l.i] == '\r' {
+				l.advance(1)
+			}
+			if (l.i < len(l.src) || l.more()) && l.src[l.i] == '\n' {
+				l.advance(1)
+			}
+			continue
+		}
+		l.lineStart = false
+		if l.i >= len(l.src) {
+			return nil
+		}
+
+		indent := l.src[start:l.i]
+		top := ""
+		if len(l.indents) != 0 {
+			top = l.indents[len(l.indents)-1]
+		}
+		if indent != top && strings.HasPrefix(indent, top) {
+			l.indents = append(l.indents, indent)
+			l.pending = append(l.pending, Token{Type: "indent", Line: l.line, Col: l.col})
+			return nil
+		}
+		for indent != top {
+			if !strings.HasPrefix(top, indent) {
+				return l.errorf("inconsistent indentation")
+			}
+			l.indents = l.indents[:len(l.indents)-1]
+			l.pending = append(l.pending, Token{Type: "dedent", Line: l.line, Col: l.col})
+			top = ""
+			if len(l.indents) != 0 {
+				top = l.indents[len(l.indents)-1]
+			}
+		}
+		return nil
+	}
+}
+`
+}
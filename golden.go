@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// golden is a test case of named sections, each started by a line
+// "-- name --", like
+//
+//	-- input --
+//	1 + 2
+//	-- tree --
+//	NodeExpr
+//	...
+//
+// Text before the first section is a comment.
+type golden struct {
+	comment  string
+	sections []goldenSection
+}
+
+type goldenSection struct {
+	name string
+	text string
+}
+
+func parseGolden(text string) golden {
+	var g golden
+	for _, line := range strings.SplitAfter(text, "\n") {
+		header := strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(header, "-- ") && strings.HasSuffix(header, " --") && len(header) > 6 {
+			g.sections = append(g.sections, goldenSection{name: header[3 : len(header)-3]})
+		} else if g.sections == nil {
+			g.comment += line
+		} else {
+			g.sections[len(g.sections)-1].text += line
+		}
+	}
+	return g
+}
+
+func (g golden) section(name string) (string, bool) {
+	for _, s := range g.sections {
+		if s.name == name {
+			return s.text, true
+		}
+	}
+	return "", false
+}
+
+// set replaces the text of a section, adding the section if there is none.
+func (g *golden) set(name string, text string) {
+	for i := range g.sections {
+		if g.sections[i].name == name {
+			g.sections[i].text = text
+			return
+		}
+	}
+	g.sections = append(g.sections, goldenSection{name: name, text: text})
+}
+
+func (g *golden) remove(name string) {
+	for i := range g.sections {
+		if g.sections[i].name == name {
+			g.sections = append(g.sections[:i], g.sections[i+1:]...)
+			return
+		}
+	}
+}
+
+func (g golden) String() string {
+	str := g.comment
+	for _, s := range g.sections {
+		str += "-- " + s.name + " --\n" + s.text
+		if s.text != "" && !strings.HasSuffix(s.text, "\n") {
+			str += "\n"
+		}
+	}
+	return str
+}
+
+// check compares the result of a test, an output section or an error
+// section, with the golden file at path. With update, a result that
+// differs is written to the file instead, replacing the other section.
+// It returns a description of how the result differs, or "".
+func (g *golden) check(path string, name string, other string, got string, update bool) (string, error) {
+	want, ok := g.section(name)
+	if ok && want == got {
+		return "", nil
+	}
+	if update {
+		g.remove(other)
+		g.set(name, got)
+		return "", ioutil.WriteFile(path, []byte(g.String()), 0644)
+	}
+	if !ok {
+		if wantOther, ok := g.section(other); ok {
+			return fmt.Sprintf("%s: want %s:\n%sgot %s:\n%s", path, other, wantOther, name, got), nil
+		}
+		return fmt.Sprintf("%s: no %s section; got:\n%s", path, name, got), nil
+	}
+	return fmt.Sprintf("%s: %s differs:\n%s", path, name, diffLines(name, want, got)), nil
+}
+
+// treeMain is the program that parses the inputs of golden files, given as
+// a JSON array of base64 on its standard input, and writes the tree or error of each
+// as a JSON array. Each input is also lexed all at once, which must give
+// the same tokens as lexing it a chunk at a time; Lexers says how they
+// differ if they do not.
+const treeMain = `package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"llgen/parser"
+)
+
+type result struct {
+	Tree   string
+	Error  string
+	Lexers string
+}
+
+func print(val reflect.Value) string {
+	if !val.IsValid() || (val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface) && val.IsNil() {
+		return "nil"
+	}
+	if val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface {
+		return print(val.Elem())
+	}
+	if tok, ok := val.Interface().(parser.Token); ok {
+		return tok.Type + "<" + tok.Data + ">"
+	}
+	str := val.Type().Name()
+	if val.Kind() == reflect.Slice {
+		str = "[]" + val.Type().Elem().Name()
+		for i := 0; i < val.Len(); i++ {
+			str += "\n\t" + fmt.Sprint(i) + ": " + strings.Replace(print(val.Index(i)), "\n", "\n\t", -1)
+		}
+	} else if val.Kind() == reflect.Struct {
+		for i := 0; i < val.NumField(); i++ {
+			field := val.Field(i)
+			text := fmt.Sprint(field)
+			if field.CanInterface() {
+				text = print(field)
+			}
+			str += "\n\t" + val.Type().Field(i).Name + ": " + strings.Replace(text, "\n", "\n\t", -1)
+		}
+	} else {
+		return fmt.Sprint(val.Interface())
+	}
+	return str
+}
+
+// compareLexers lexes src a chunk at a time, as Parse does, and all at
+// once, as Lex does, and describes how the two differ, if they do.
+func compareLexers(src string) string {
+	whole, wholeErr := parser.Lex(src)
+	var streamed []parser.Token
+	l := parser.NewLexer(strings.NewReader(src))
+	for {
+		tok, ok, err := l.Next()
+		if err != nil || !ok {
+			if fmt.Sprint(err) != fmt.Sprint(wholeErr) {
+				return fmt.Sprintf("NewLexer ends with error %v after %v tokens, but Lex with %v", err, len(streamed), wholeErr)
+			}
+			if err != nil {
+				return ""
+			}
+			break
+		}
+		streamed = append(streamed, tok)
+	}
+	for i := 0; i < len(streamed) || i < len(whole); i++ {
+		if i >= len(streamed) || i >= len(whole) || streamed[i] != whole[i] {
+			return fmt.Sprintf("NewLexer gives %v tokens and Lex %v, differing at token %v", len(streamed), len(whole), i)
+		}
+	}
+	return ""
+}
+
+func main() {
+	var inputs [][]byte
+	if err := json.NewDecoder(os.Stdin).Decode(&inputs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	results := make([]result, len(inputs))
+	for i, b := range inputs {
+		input := string(b)
+		results[i].Lexers = compareLexers(input)
+		out, err := parser.Parse(input)
+		if err != nil {
+			results[i].Error = err.Error()
+		} else {
+			results[i].Tree = print(reflect.ValueOf(out))
+		}
+	}
+	json.NewEncoder(os.Stdout).Encode(results)
+}
+`
+
+// runGoldenTests parses the input section of each golden file with the
+// generated parser src, and checks the tree, or the error, it gives. It
+// returns how each file that failed differs. Lex and NewLexer giving
+// different tokens is a failure of its own, which update never writes.
+func runGoldenTests(src string, paths []string, update bool) ([]string, error) {
+	tests := make([]golden, len(paths))
+	inputs := make([][]byte, len(paths)) // as bytes, which JSON keeps even if they are not UTF-8
+	for i, path := range paths {
+		text, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		tests[i] = parseGolden(string(text))
+		input, ok := tests[i].section("input")
+		if !ok {
+			return nil, fmt.Errorf("%s: no input section", path)
+		}
+		inputs[i] = []byte(input)
+	}
+
+	stdin, err := json.Marshal(inputs)
+	if err != nil {
+		return nil, err
+	}
+	out, err := goRun(src, treeMain, string(stdin))
+	if err != nil {
+		return nil, err
+	}
+	var results []struct {
+		Tree   string
+		Error  string
+		Lexers string
+	}
+	if err := json.Unmarshal(out, &results); err != nil || len(results) != len(paths) {
+		return nil, fmt.Errorf("reading the trees: %v", err)
+	}
+
+	var failed []string
+	for i, path := range paths {
+		var msg string
+		if results[i].Error != "" {
+			msg, err = tests[i].check(path, "error", "tree", results[i].Error+"\n", update)
+		} else {
+			msg, err = tests[i].check(path, "tree", "error", results[i].Tree+"\n", update)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if msg != "" {
+			failed = append(failed, msg)
+		}
+		if results[i].Lexers != "" {
+			failed = append(failed, fmt.Sprintf("%s: %s\n", path, results[i].Lexers))
+		}
+	}
+	return failed, nil
+}
+
+func testCommand(args []string) error {
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	update := flags.Bool("update", false, "rewrite the tree or error section of the files whose result differs")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: llgen test [FLAGS] GRAMMAR FILE...\n\nParses the input section of each golden file, or of each .txt file in a directory, and checks the tree or error section against the result.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() < 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	ns, files, err := loadGrammarOpen(flags.Arg(0), nil)
+	if err != nil {
+		return err
+	}
+	g := newGenerator(options{files: files})
+	src, err := g.generateAll(ns)
+	if err != nil {
+		return err
+	}
+	if len(g.starts) == 0 || len(g.tokens) == 0 {
+		return fmt.Errorf("testing inputs needs a %%start rule and tokens")
+	}
+
+	var paths []string
+	for _, arg := range flags.Args()[1:] {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(arg, "*.txt"))
+		if err != nil {
+			return err
+		}
+		paths = append(paths, matches...)
+	}
+
+	failed, err := runGoldenTests(src, paths, *update)
+	if err != nil {
+		return err
+	}
+	for _, msg := range failed {
+		fmt.Print(msg)
+	}
+	if failed != nil {
+		return fmt.Errorf("%v of %v tests failed", len(failed), len(paths))
+	}
+	fmt.Printf("ok %v tests\n", len(paths))
+	return nil
+}
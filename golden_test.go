@@ -0,0 +1,547 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/ast"
+	goimporter "go/importer"
+	goparser "go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata with the results")
+
+// readGolden returns the golden files matching pattern in testdata.
+func readGolden(t *testing.T, pattern string) map[string]golden {
+	paths, err := filepath.Glob(filepath.Join("testdata", pattern))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paths == nil {
+		t.Fatalf("no files match testdata/%s", pattern)
+	}
+	tests := make(map[string]golden)
+	for _, path := range paths {
+		text, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tests[path] = parseGolden(string(text))
+	}
+	return tests
+}
+
+func checkGolden(t *testing.T, path string, test *golden, name string, other string, got string) {
+	msg, err := test.check(path, name, other, got, *update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg != "" {
+		t.Error(msg)
+	}
+}
+
+// typeCheck parses and type-checks a generated parser, with the standard
+// library packages it imports read from source by imp.
+func typeCheck(src string, imp types.Importer) error {
+	fset := token.NewFileSet()
+	file, err := goparser.ParseFile(fset, "parser.go", src, 0)
+	if err != nil {
+		return err
+	}
+	config := &types.Config{Importer: imp}
+	_, err = config.Check("parser", fset, []*ast.File{file}, nil)
+	return err
+}
+
+// TestGenerate generates the parser of the grammar section of each file in
+// testdata/generate, checking the generator's error against the error
+// section, or else the code of the grammar's rules against the rules
+// section, or the whole parser against the output section in the files that
+// have one. Parsers must type-check. Other sections are files the grammar
+// can import.
+func TestGenerate(t *testing.T) {
+	imp := goimporter.ForCompiler(token.NewFileSet(), "source", nil)
+	for path, test := range readGolden(t, "generate/*.txt") {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			open := make(map[string]string)
+			for _, s := range test.sections {
+				open[s.name] = s.text
+			}
+			if _, ok := open["grammar"]; !ok {
+				t.Fatal("no grammar section")
+			}
+			ns, files, err := loadGrammarOpen("grammar", open)
+			var out string
+			if err == nil {
+				out, err = generateAll(ns, options{files: files})
+			}
+			if err != nil {
+				checkGolden(t, path, &test, "error", "output", err.Error()+"\n")
+				return
+			}
+			if _, ok := test.section("output"); ok {
+				checkGolden(t, path, &test, "output", "error", out+"\n")
+			} else {
+				rules, err := newGenerator(options{files: files}).generateRules(ns.I0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkGolden(t, path, &test, "rules", "error", rules+"\n")
+			}
+			if err := typeCheck(out, imp); err != nil {
+				t.Errorf("%s: output does not type-check: %v", path, err)
+			}
+		})
+	}
+}
+
+// TestParse parses the input section of each file in testdata/parse with
+// llgen's own parser, checking the tree it prints, as llgen -tree does, or
+// the error.
+func TestParse(t *testing.T) {
+	for path, test := range readGolden(t, "parse/*.txt") {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			input, ok := test.section("input")
+			if !ok {
+				t.Fatal("no input section")
+			}
+			ns, err := parseGrammar(input, "")
+			if err != nil {
+				checkGolden(t, path, &test, "error", "tree", err.Error()+"\n")
+				return
+			}
+			checkGolden(t, path, &test, "tree", "error", print(*ns)+"\n")
+		})
+	}
+}
+
+// TestFormat formats the input section of each file in testdata/format,
+// as llgen fmt does, checking the result against the output section, or
+// the error against the error section. Formatting the output again must
+// not change it.
+func TestFormat(t *testing.T) {
+	for path, test := range readGolden(t, "format/*.txt") {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			input, ok := test.section("input")
+			if !ok {
+				t.Fatal("no input section")
+			}
+			out, err := formatGrammar(input)
+			if err != nil {
+				checkGolden(t, path, &test, "error", "output", err.Error()+"\n")
+				return
+			}
+			checkGolden(t, path, &test, "output", "error", out)
+			again, err := formatGrammar(out)
+			if err != nil {
+				t.Fatalf("formatting the output: %v", err)
+			}
+			if again != out {
+				t.Errorf("%s: formatting the output again changes it:\n%s", path, diffLines("output", out, again))
+			}
+		})
+	}
+}
+
+// TestGrammar runs the golden files in each directory of testdata with the
+// parser generated from the grammar of the same name, like testdata/calc
+// with testdata/calc.llg, as llgen test does.
+func TestGrammar(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs generated parsers")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("no go command")
+	}
+	grammars, err := filepath.Glob(filepath.Join("testdata", "*.llg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, grammar := range grammars {
+		grammar := grammar
+		t.Run(filepath.Base(grammar), func(t *testing.T) {
+			t.Parallel()
+			ns, files, err := loadGrammarOpen(grammar, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			src, err := generateAll(ns, options{files: files})
+			if err != nil {
+				t.Fatal(err)
+			}
+			paths, err := filepath.Glob(filepath.Join(strings.TrimSuffix(grammar, ".llg"), "*.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if paths == nil {
+				t.Fatalf("no golden files for %s", grammar)
+			}
+			failed, err := runGoldenTests(src, paths, *update)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, msg := range failed {
+				t.Error(msg)
+			}
+		})
+	}
+}
+
+// readGoldenGrammar reads the grammar section of a golden file.
+func readGoldenGrammar(t *testing.T, test golden) *grammar {
+	text, ok := test.section("grammar")
+	if !ok {
+		t.Fatal("no grammar section")
+	}
+	ns, files, err := loadGrammarOpen("grammar", map[string]string{"grammar": text})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := newGrammar(ns, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+// TestGraph writes the graph of the grammar section of each file in
+// testdata/graph, as llgen graph does, checking it against the dot section.
+func TestGraph(t *testing.T) {
+	for path, test := range readGolden(t, "graph/*.txt") {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			g := readGoldenGrammar(t, test)
+			checkGolden(t, path, &test, "dot", "error", g.graphDot("grammar", true))
+		})
+	}
+}
+
+// TestDiagram writes the diagram page of the grammar section of each file
+// in testdata/diagram, as llgen diagram does, checking it against the page
+// section and that every link on the page leads to an element of it.
+func TestDiagram(t *testing.T) {
+	links := regexp.MustCompile(`href="#([^"]*)"`)
+	for path, test := range readGolden(t, "diagram/*.txt") {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			page := readGoldenGrammar(t, test).diagramPage("grammar")
+			checkGolden(t, path, &test, "page", "error", page)
+			for _, link := range links.FindAllStringSubmatch(page, -1) {
+				if !strings.Contains(page, ` id="`+link[1]+`"`) {
+					t.Errorf("%s: nothing has the id of the link to #%s", path, link[1])
+				}
+			}
+		})
+	}
+}
+
+// TestExport writes the grammar section of each file in testdata/export
+// in each notation, with and without -inline, checking the result against
+// the section named after the notation, like w3c or w3c -inline, and the
+// warnings against the section of that name followed by "warnings".
+func TestExport(t *testing.T) {
+	for path, test := range readGolden(t, "export/*.txt") {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			g := readGoldenGrammar(t, test)
+			for _, format := range []string{"iso", "w3c", "abnf"} {
+				for _, inline := range []bool{false, true} {
+					name := format
+					if inline {
+						name += " -inline"
+					}
+					text, warnings, err := exportGrammar(g, format, inline)
+					if err != nil {
+						t.Fatal(err)
+					}
+					checkGolden(t, path, &test, name, "error", text)
+					checkGolden(t, path, &test, name+" warnings", "error", strings.Join(append(warnings, ""), "\n"))
+				}
+			}
+		})
+	}
+}
+
+// TestCoverage parses the input sections of each file in testdata/coverage
+// with the coverage parser of its grammar section, as llgen coverage does,
+// checking the report against the report section.
+func TestCoverage(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs generated parsers")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("no go command")
+	}
+	for path, test := range readGolden(t, "coverage/*.txt") {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			text, ok := test.section("grammar")
+			if !ok {
+				t.Fatal("no grammar section")
+			}
+			src, _, r, err := coverageParser("grammar", map[string]string{"grammar": text})
+			if err != nil {
+				t.Fatal(err)
+			}
+			dir := t.TempDir()
+			var inputs []string
+			for _, s := range test.sections {
+				if s.name == "input" {
+					input := filepath.Join(dir, fmt.Sprint(len(inputs)))
+					if err := ioutil.WriteFile(input, []byte(s.text), 0644); err != nil {
+						t.Fatal(err)
+					}
+					inputs = append(inputs, input)
+				}
+			}
+			if err := r.runCorpus(src, inputs); err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, path, &test, "report", "error", r.text())
+		})
+	}
+}
+
+// TestCoverageProfile checks that adding profiles sums their counts, and
+// that lines that are not a rule, a point and a count are errors.
+func TestCoverageProfile(t *testing.T) {
+	r := &coverageReport{counts: make(map[string]uint64)}
+	if err := r.add("a", "sum\tmatch\t2\n\nsum\tpart 2 (more...) none\t0\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.add("b", "sum\tmatch\t3\n"); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.counts["sum\tmatch"]; got != 5 {
+		t.Errorf("got count %v, want 5", got)
+	}
+
+	for _, profile := range []string{
+		"sum\tmatch\t1\nsum\tmatch\n",
+		"sum\tmatch\t1\nsum\tmatch\t-1\n",
+		"sum\tmatch\t1\nsum\tmatch 1\n",
+		"sum\tmatch\t1\nsum\t1\n",
+		"sum\tmatch\t1\n1\n",
+	} {
+		err := r.add("profile", profile)
+		if err == nil || err.Error() != "profile:2: rule, point and count expected" {
+			t.Errorf("%q: got error %v", profile, err)
+		}
+	}
+}
+
+// bufferMain parses 100000 words pulled one at a time with the parser of
+// testdata/stream.llg, printing the most tokens it ever held at once.
+const bufferMain = `package main
+
+import (
+	"fmt"
+
+	"llgen/parser"
+)
+
+type words struct {
+	p    *parser.Parser
+	n    int
+	most int
+}
+
+func (w *words) Next() (parser.Token, bool, error) {
+	if n := w.p.Buffered(); n > w.most {
+		w.most = n
+	}
+	if w.n == 100000 {
+		return parser.Token{}, false, nil
+	}
+	w.n++
+	return parser.Token{Type: "word", Data: "a", Line: 1, Col: 2*w.n - 1}, true, nil
+}
+
+func main() {
+	p := &parser.Parser{}
+	src := &words{p: p}
+	if _, err := p.ParseWordsFrom(src); err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(src.most)
+}
+`
+
+// TestBuffer checks that a parser pulling tokens from a TokenSource drops
+// those it has consumed, even where nothing can backtrack and so nothing
+// marks a position, as in a repetition of a token.
+func TestBuffer(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs generated parsers")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("no go command")
+	}
+	ns, files, err := loadGrammarOpen(filepath.Join("testdata", "stream.llg"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := generateAll(ns, options{files: files})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src += "\nfunc (p *Parser) Buffered() int {\n\treturn len(p.buf)\n}\n"
+	out, err := goRun(src, bufferMain, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := strconv.Atoi(strings.TrimSpace(string(out))); err != nil || got > 1 {
+		t.Errorf("the parser held %s tokens at once, want at most 1", strings.TrimSpace(string(out)))
+	}
+}
+
+// TestSamples makes sentences of testdata/calc.llg, as llgen gen-samples
+// does, checking that the same seed gives the same sentences and that the
+// grammar's own parser parses them.
+func TestSamples(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs generated parsers")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("no go command")
+	}
+	path := filepath.Join("testdata", "calc.llg")
+	g, err := readGrammar(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := func(seed int64) []string {
+		s := newSampler(g, seed, 10)
+		var texts []string
+		for i := 0; i < 50; i++ {
+			texts = append(texts, sampleText(s.sample("expr", g.ruleOf["expr"].body, 1, nil)))
+		}
+		return texts
+	}
+	texts := samples(1)
+	if again := samples(1); strings.Join(again, "\n") != strings.Join(texts, "\n") {
+		t.Errorf("seed 1 gives different samples:\n%s\nthen:\n%s", strings.Join(texts, "\n"), strings.Join(again, "\n"))
+	}
+	if other := samples(2); strings.Join(other, "\n") == strings.Join(texts, "\n") {
+		t.Errorf("seeds 1 and 2 give the same samples")
+	}
+
+	ns, files, err := loadGrammarOpen(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := generateAll(ns, options{files: files})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs := make([][]byte, len(texts))
+	for i, text := range texts {
+		inputs[i] = []byte(text)
+	}
+	stdin, err := json.Marshal(inputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := goRun(src, treeMain, string(stdin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []struct {
+		Error  string
+		Lexers string
+	}
+	if err := json.Unmarshal(out, &results); err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range results {
+		if result.Error != "" || result.Lexers != "" {
+			t.Errorf("sample %q: %s%s", texts[i], result.Error, result.Lexers)
+		}
+	}
+}
+
+// TestFuzz writes the fuzz tests of testdata/calc.llg's parser, as -fuzz
+// does, and runs them, starting from a few samples, in a module of their
+// own.
+func TestFuzz(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs generated parsers")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("no go command")
+	}
+	ns, files, err := loadGrammarOpen(filepath.Join("testdata", "calc.llg"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := newGenerator(options{files: files})
+	src, err := g.generateAll(ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "parser", "testdata"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, text := range map[string]string{
+		"go.mod":                       "module llgen\n\ngo 1.16\n",
+		"parser/parser.go":             src,
+		"parser/testdata/sample-1.txt": "1 + (2 - 3)",
+		"parser/testdata/sample-2.txt": "((4))",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeFuzzTests(filepath.Join(dir, "parser", "parser_fuzz_test.go"), ns, g); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "parser", "parser_fuzz_go118_test.go")); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("go", "test", "-short", "-run", "TestParseQuick|FuzzParse", "./parser")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("the fuzz tests fail: %v\n%s", err, out)
+	}
+}
+
+// TestImport converts the grammar in the first section of each file in
+// testdata/convert, which is named like the file it would be, checking the
+// result against the output section and the warnings against the warnings
+// section. The result must generate a parser.
+func TestImport(t *testing.T) {
+	for path, test := range readGolden(t, "convert/*.txt") {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			if len(test.sections) == 0 {
+				t.Fatal("no grammar section")
+			}
+			src := test.sections[0]
+			text, warnings, err := convertGrammar(src.name, src.text, extensions[filepath.Ext(src.name)])
+			if err != nil {
+				checkGolden(t, path, &test, "error", "output", err.Error()+"\n")
+				return
+			}
+			checkGolden(t, path, &test, "output", "error", text)
+			checkGolden(t, path, &test, "warnings", "error", strings.Join(append(warnings, ""), "\n"))
+
+			ns, err := parseGrammar(text, "")
+			if err != nil {
+				t.Fatalf("output does not parse: %v", err)
+			}
+			if _, err := generateAll(*ns, options{}); err != nil {
+				t.Errorf("output does not generate a parser: %v", err)
+			}
+		})
+	}
+}
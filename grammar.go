@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+	"github.com/allen-b1/llgen/parser"
+	"strconv"
+)
+
+// grammar is the rules and tokens of a grammar file in a form that is
+// easier to walk than the syntax tree, for the commands that describe a
+// grammar rather than generate a parser from it. Names in rules are
+// resolved by the generator, so they mean what they do in the parser.
+type grammar struct {
+	rules   []*grammarRule // in the order they are defined
+	ruleOf  map[string]*grammarRule
+	tokens  []*grammarToken
+	tokenOf map[string]*grammarToken
+	starts  []string
+	gen     *generator // the declarations names are resolved against
+}
+
+type grammarRule struct {
+	name   string
+	params []string // parameters of a parameterized rule
+	body   term
+	line   int
+}
+
+type grammarToken struct {
+	name    string
+	literal string // text the token is matched by, if any
+	pattern string // regular expression the token is matched by, if any
+	fold    bool   // whether a keyword is matched case-insensitively
+	mode    string // mode the token is declared in, "" for the default
+	line    int
+}
+
+// term is a part of a rule's expression.
+type term struct {
+	op    string // one of the ops below
+	name  string // name of the rule, token, parameter or called rule, or of the token a text matches
+	text  string // token data for tagged tokens and strings, code for predicates
+	items []term // parts, alternatives, the repeated or checked term, or call arguments
+
+	empty    bool // list options
+	trailing bool
+}
+
+const (
+	opSeq   = "seq"   // items in order
+	opOr    = "or"    // first of items that matches
+	opOpt   = "opt"   // items[0], optionally
+	opMany  = "many"  // items[0], zero or more times
+	opList  = "list"  // items[0] separated by items[1]
+	opRule  = "rule"  // a rule by name
+	opCall  = "call"  // a parameterized rule with items as arguments
+	opParam = "param" // a parameter of the rule
+	opToken = "token" // a token by name, with data text if tagged
+	opText  = "text"  // a token by its text
+	opAny   = "any"   // any token
+	opAnd   = "and"   // lookahead that items[0] matches
+	opNot   = "not"   // lookahead that items[0] does not match
+	opPred  = "pred"  // a Go predicate, negated if name is "not"
+	opCut   = "cut"
+)
+
+// readGrammar loads a grammar file and the files it imports.
+func readGrammar(path string) (*grammar, error) {
+	ns, files, err := loadGrammarOpen(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newGrammar(ns, files)
+}
+
+// newGrammar collects the rules and tokens of the statements of a
+// grammar, including the tokens of %mode blocks. files are where the
+// statements were read from, as for options.files.
+func newGrammar(ns parser.NodeStatements, files []string) (*grammar, error) {
+	gen := newGenerator(options{files: files})
+	if err := gen.declare(ns.I0); err != nil {
+		return nil, err
+	}
+	g := &grammar{ruleOf: make(map[string]*grammarRule), tokenOf: make(map[string]*grammarToken), starts: gen.starts, gen: gen}
+	if err := g.collect(ns.I0, ""); err != nil {
+		return nil, err
+	}
+	for i, statement := range ns.I0 {
+		var err error
+		switch n := statement.I.(type) {
+		case parser.NodeStatementExpr:
+			g.ruleOf[n.I0.Data].body, err = g.expr(n.I2, nil)
+		case parser.NodeStatementMacro:
+			rule := g.ruleOf[n.I0.Data]
+			params := make(map[string]bool)
+			for _, param := range rule.params {
+				params[param] = true
+			}
+			rule.body, err = g.expr(n.I5, params)
+		}
+		if err != nil {
+			return nil, gen.errorAt(ns.I0, i, err)
+		}
+	}
+	return g, nil
+}
+
+func (g *grammar) collect(statements []parser.NodeStatement, mode string) error {
+	for _, statement := range statements {
+		switch n := statement.I.(type) {
+		case parser.NodeStatementToken:
+			tok := &grammarToken{name: n.I1.Data, mode: mode, line: n.I1.Line}
+			if n.I2 != nil {
+				switch def := n.I2.I.(type) {
+				case parser.NodeStatementTokenAnnotation:
+					tok.literal = def.I1.Data
+				case parser.NodeStatementTokenPattern:
+					tok.pattern = def.I1.Data
+				}
+			}
+			g.addToken(tok)
+		case parser.NodeStatementKeyword:
+			tok := &grammarToken{name: n.I1.Data, literal: n.I1.Data, mode: mode, line: n.I1.Line}
+			if n.I2 != nil {
+				tok.literal = n.I2.I1.Data
+			}
+			tok.fold = n.I3 != nil
+			g.addToken(tok)
+		case parser.NodeStatementExpr:
+			g.addRule(&grammarRule{name: n.I0.Data, line: n.I0.Line})
+		case parser.NodeStatementMacro:
+			rule := &grammarRule{name: n.I0.Data, line: n.I0.Line}
+			for _, param := range n.I2.Items {
+				rule.params = append(rule.params, param.Data)
+			}
+			g.addRule(rule)
+		case parser.NodeStatementDirective:
+			if n.I1.Data == "indent" {
+				g.addToken(&grammarToken{name: "indent", line: n.I1.Line})
+				g.addToken(&grammarToken{name: "dedent", line: n.I1.Line})
+			}
+			if n.I1.Data != "mode" || len(n.I2) != 2 {
+				continue
+			}
+			block := n.I2[1].I.(parser.Token)
+			tokens, err := tokenize(block.Data + "\n")
+			if err != nil {
+				return err
+			}
+			inner, err := parser.ParseStatementsTokens(tokens)
+			if err != nil {
+				return err
+			}
+			if err := g.collect(inner.I0, n.I2[0].I.(parser.Token).Data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (g *grammar) addToken(tok *grammarToken) {
+	if _, ok := g.tokenOf[tok.name]; ok {
+		return
+	}
+	g.tokens = append(g.tokens, tok)
+	g.tokenOf[tok.name] = tok
+}
+
+func (g *grammar) addRule(rule *grammarRule) {
+	g.rules = append(g.rules, rule)
+	g.ruleOf[rule.name] = rule
+}
+
+func (g *grammar) expr(expr parser.NodeExpr, params map[string]bool) (term, error) {
+	switch n := expr.I.(type) {
+	case parser.NodeExprOr:
+		units := []parser.NodeUnit{n.I0, n.I2}
+		for _, ext := range n.I3 {
+			units = append(units, ext.I1)
+		}
+		t := term{op: opOr}
+		for _, u := range units {
+			item, err := g.unit(u, params)
+			if err != nil {
+				return term{}, err
+			}
+			t.items = append(t.items, item)
+		}
+		return t, nil
+	case parser.NodeExprAnd:
+		t := term{op: opSeq}
+		for _, u := range n.I0 {
+			item, err := g.unitEll(u, params)
+			if err != nil {
+				return term{}, err
+			}
+			t.items = append(t.items, item)
+		}
+		if len(t.items) == 1 {
+			return t.items[0], nil
+		}
+		return t, nil
+	}
+	return term{}, fmt.Errorf("invalid expression")
+}
+
+func (g *grammar) unitEll(u parser.NodeUnitEll, params map[string]bool) (term, error) {
+	if tok, ok := u.I.(parser.Token); ok && tok.Type == "cut" {
+		return term{op: opCut}, nil
+	}
+	if pred, ok := u.I.(parser.NodeUnitPred); ok {
+		t := term{op: opPred, text: pred.I1.Data}
+		if pred.I0.I.(parser.Token).Type == "bang" {
+			t.name = "not"
+		}
+		return t, nil
+	}
+	unit, suffix := handleUnitEll(u)
+	item, err := g.unit(unit, params)
+	if err != nil {
+		return term{}, err
+	}
+	switch suffix {
+	case "ell":
+		return term{op: opMany, items: []term{item}}, nil
+	case "opt":
+		return term{op: opOpt, items: []term{item}}, nil
+	case "and":
+		return term{op: opAnd, items: []term{item}}, nil
+	case "not":
+		return term{op: opNot, items: []term{item}}, nil
+	}
+	return item, nil
+}
+
+func (g *grammar) unit(u parser.NodeUnit, params map[string]bool) (term, error) {
+	switch n := u.I.(type) {
+	case parser.NodeUnitCall:
+		var args []term
+		for _, arg := range n.I2.Items {
+			if n.I0.Data == "list" && len(args) >= 2 {
+				switch describeUnit(arg) {
+				case "empty", "trailing":
+					continue
+				}
+				return term{}, fmt.Errorf("%s: unknown list option: %s", describeUnit(u), describeUnit(arg))
+			}
+			t, err := g.unit(arg, params)
+			if err != nil {
+				return term{}, err
+			}
+			args = append(args, t)
+		}
+		if n.I0.Data != "list" {
+			m, ok := g.gen.macros[n.I0.Data]
+			if !ok {
+				return term{}, fmt.Errorf("unknown parameterized rule: %s", describeUnit(u))
+			}
+			if len(args) != len(m.I2.Items) {
+				return term{}, fmt.Errorf("%s: %s expects %v arguments, got %v", describeUnit(u), n.I0.Data, len(m.I2.Items), len(args))
+			}
+			return term{op: opCall, name: n.I0.Data, items: args}, nil
+		}
+		if len(args) != 2 {
+			return term{}, fmt.Errorf("%s: list expects an item and a separator", describeUnit(u))
+		}
+		t := term{op: opList, items: args}
+		for _, opt := range n.I2.Items[2:] {
+			t.empty = t.empty || describeUnit(opt) == "empty"
+			t.trailing = t.trailing || describeUnit(opt) == "trailing"
+		}
+		return t, nil
+	}
+
+	// Parameters are bound when the rule is called, so only they are not
+	// resolved here.
+	tok := unitToken(u)
+	_, tag := handleUnit(u)
+	if tok.Type == "ident" && params[tok.Data] && tag != "" {
+		return term{op: opToken, name: tok.Data, text: tag}, nil
+	} else if tok.Type == "ident" && params[tok.Data] {
+		return term{op: opParam, name: tok.Data}, nil
+	}
+	r, err := g.gen.resolve(u)
+	switch {
+	case err != nil:
+		return term{}, err
+	case r.any:
+		return term{op: opAny}, nil
+	case tok.Type == "string":
+		return term{op: opText, name: r.name, text: tok.Data}, nil
+	case r.token:
+		return term{op: opToken, name: r.name, text: tag}, nil
+	}
+	return term{op: opRule, name: r.name}, nil
+}
+
+// subst replaces the parameters in a term with their arguments.
+func (t term) subst(args map[string]term) term {
+	if arg, ok := args[t.name]; ok && t.op == opParam {
+		return arg
+	} else if ok && t.op == opToken && arg.op == opToken {
+		t.name = arg.name
+	}
+	if t.items == nil {
+		return t
+	}
+	items := make([]term, len(t.items))
+	for i, item := range t.items {
+		items[i] = item.subst(args)
+	}
+	t.items = items
+	return t
+}
+
+// String returns the term in grammar syntax.
+func (t term) String() string {
+	switch t.op {
+	case opSeq, opOr:
+		sep := " "
+		if t.op == opOr {
+			sep = " | "
+		}
+		str := ""
+		for i, item := range t.items {
+			if i != 0 {
+				str += sep
+			}
+			if item.op == opSeq || item.op == opOr {
+				str += "(" + item.String() + ")"
+			} else {
+				str += item.String()
+			}
+		}
+		return str
+	case opOpt:
+		return t.items[0].String() + "?"
+	case opMany:
+		return t.items[0].String() + "..."
+	case opAnd:
+		return "&" + t.items[0].String()
+	case opNot:
+		return "!" + t.items[0].String()
+	case opPred:
+		if t.name == "not" {
+			return "!{ " + t.text + " }"
+		}
+		return "&{ " + t.text + " }"
+	case opCut:
+		return "^"
+	case opAny:
+		return "."
+	case opText:
+		return strconv.Quote(t.text)
+	case opToken:
+		if t.text != "" {
+			return fmt.Sprintf("%s<%q>", t.name, t.text)
+		}
+		return t.name
+	case opList, opCall:
+		name := t.name
+		if t.op == opList {
+			name = "list"
+		}
+		str := name + "("
+		for i, item := range t.items {
+			if i != 0 {
+				str += ", "
+			}
+			str += item.String()
+		}
+		if t.empty {
+			str += ", empty"
+		}
+		if t.trailing {
+			str += ", trailing"
+		}
+		return str + ")"
+	}
+	return t.name
+}
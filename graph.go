@@ -0,0 +1,407 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// refs returns the rules and tokens a term uses, in the order they first
+// appear. A call uses the called rule and whatever its arguments use.
+func (g *grammar) refs(t term) []string {
+	var names []string
+	seen := make(map[string]bool)
+	var walk func(t term)
+	walk = func(t term) {
+		name := ""
+		switch t.op {
+		case opRule, opCall, opToken, opText:
+			name = t.name
+		}
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+		for _, item := range t.items {
+			walk(item)
+		}
+	}
+	walk(t)
+	return names
+}
+
+// nullable reports whether each rule can match without consuming input.
+func (g *grammar) nullable() map[string]bool {
+	nullable := make(map[string]bool)
+	for changed := true; changed; {
+		changed = false
+		for _, rule := range g.rules {
+			if !nullable[rule.name] && rule.params == nil && g.termNullable(rule.body, nullable, nil, 0) {
+				nullable[rule.name] = true
+				changed = true
+			}
+		}
+	}
+	return nullable
+}
+
+// termNullable reports whether t can match without consuming input, given
+// the rules known to be nullable and whether each parameter's argument is.
+func (g *grammar) termNullable(t term, nullable map[string]bool, params map[string]bool, depth int) bool {
+	switch t.op {
+	case opSeq:
+		for _, item := range t.items {
+			if !g.termNullable(item, nullable, params, depth) {
+				return false
+			}
+		}
+		return true
+	case opOr:
+		for _, item := range t.items {
+			if g.termNullable(item, nullable, params, depth) {
+				return true
+			}
+		}
+		return false
+	case opOpt, opMany, opAnd, opNot, opPred, opCut:
+		return true
+	case opList:
+		return t.empty || g.termNullable(t.items[0], nullable, params, depth)
+	case opRule:
+		return nullable[t.name]
+	case opParam:
+		return params[t.name]
+	case opCall:
+		rule := g.ruleOf[t.name]
+		if depth >= maxDepth || len(t.items) != len(rule.params) {
+			return false
+		}
+		args := make(map[string]bool)
+		for i, param := range rule.params {
+			args[param] = g.termNullable(t.items[i], nullable, params, depth)
+		}
+		return g.termNullable(rule.body, nullable, args, depth+1)
+	}
+	return false
+}
+
+// leftRefs returns the rules a term can call before it consumes any input,
+// which would call themselves forever if they lead back to the term's rule.
+func (g *grammar) leftRefs(t term, nullable map[string]bool) []string {
+	var names []string
+	seen := make(map[string]bool)
+	var walk func(t term, args map[string]term, depth int)
+	walk = func(t term, args map[string]term, depth int) {
+		switch t.op {
+		case opSeq:
+			for _, item := range t.items {
+				walk(item, args, depth)
+				if !g.termNullable(item, nullable, nil, 0) {
+					return
+				}
+			}
+		case opOr, opOpt, opMany, opAnd, opNot:
+			for _, item := range t.items {
+				walk(item, args, depth)
+			}
+		case opList:
+			walk(t.items[0], args, depth)
+		case opParam:
+			if arg, ok := args[t.name]; ok {
+				walk(arg, nil, depth)
+			}
+		case opRule, opCall:
+			if !seen[t.name] {
+				seen[t.name] = true
+				names = append(names, t.name)
+			}
+			rule := g.ruleOf[t.name]
+			if t.op == opCall && depth < maxDepth && len(t.items) == len(rule.params) {
+				inner := make(map[string]term)
+				for i, param := range rule.params {
+					inner[param] = t.items[i]
+				}
+				walk(rule.body, inner, depth+1)
+			}
+		}
+	}
+	walk(t, nil, 0)
+	return names
+}
+
+// first returns the tokens a term can start with: token names, quoted
+// texts that no token is declared with, and "." for any token.
+func (g *grammar) first(t term, nullable map[string]bool) []string {
+	var names []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	visited := make(map[string]bool)
+	var walk func(t term, args map[string]term, depth int)
+	walk = func(t term, args map[string]term, depth int) {
+		switch t.op {
+		case opSeq:
+			for _, item := range t.items {
+				walk(item, args, depth)
+				if !g.termNullable(item, nullable, nil, 0) {
+					return
+				}
+			}
+		case opOr, opOpt, opMany:
+			for _, item := range t.items {
+				walk(item, args, depth)
+			}
+		case opList:
+			walk(t.items[0], args, depth)
+			if g.termNullable(t.items[0], nullable, nil, 0) {
+				walk(t.items[1], args, depth)
+			}
+		case opToken, opText:
+			add(t.name)
+		case opAny:
+			add(".")
+		case opParam:
+			if arg, ok := args[t.name]; ok {
+				walk(arg, nil, depth)
+			}
+		case opRule:
+			if !visited[t.name] {
+				visited[t.name] = true
+				walk(g.ruleOf[t.name].body, nil, depth)
+			}
+		case opCall:
+			rule := g.ruleOf[t.name]
+			if depth < maxDepth && len(t.items) == len(rule.params) {
+				inner := make(map[string]term)
+				for i, param := range rule.params {
+					inner[param] = t.items[i]
+				}
+				walk(rule.body, inner, depth+1)
+			}
+		}
+	}
+	walk(t, nil, 0)
+	return names
+}
+
+// cycles returns the strongly connected components of a graph of rules
+// that contain a cycle, using Tarjan's algorithm. Components are listed in
+// the order of their first rule, with their rules in grammar order.
+func (g *grammar) cycles(edges map[string][]string) [][]string {
+	index := make(map[string]int)
+	low := make(map[string]int)
+	onStack := make(map[string]bool)
+	var stack []string
+	var components [][]string
+
+	var connect func(name string)
+	connect = func(name string) {
+		index[name] = len(index)
+		low[name] = index[name]
+		stack = append(stack, name)
+		onStack[name] = true
+		for _, next := range edges[name] {
+			if _, ok := index[next]; !ok {
+				connect(next)
+				if low[next] < low[name] {
+					low[name] = low[next]
+				}
+			} else if onStack[next] && index[next] < low[name] {
+				low[name] = index[next]
+			}
+		}
+		if low[name] != index[name] {
+			return
+		}
+		var component []string
+		for {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[top] = false
+			component = append(component, top)
+			if top == name {
+				break
+			}
+		}
+		if len(component) > 1 || contains(edges[name], name) {
+			components = append(components, component)
+		}
+	}
+
+	order := make(map[string]int)
+	for i, rule := range g.rules {
+		order[rule.name] = i
+		if _, ok := index[rule.name]; !ok {
+			connect(rule.name)
+		}
+	}
+	for _, component := range components {
+		sort.Slice(component, func(i, j int) bool { return order[component[i]] < order[component[j]] })
+	}
+	sort.Slice(components, func(i, j int) bool { return order[components[i][0]] < order[components[j][0]] })
+	return components
+}
+
+// reachable returns the rules that can be reached from the start rules, or
+// from the first rule if there are none.
+func (g *grammar) reachable(edges map[string][]string) map[string]bool {
+	roots := g.starts
+	if roots == nil && g.rules != nil {
+		roots = []string{g.rules[0].name}
+	}
+	reached := make(map[string]bool)
+	var visit func(name string)
+	visit = func(name string) {
+		if reached[name] {
+			return
+		}
+		reached[name] = true
+		for _, next := range edges[name] {
+			visit(next)
+		}
+	}
+	for _, root := range roots {
+		visit(root)
+	}
+	return reached
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// graphDot returns the dependency graph of the rules in the DOT language.
+// Rules on a recursive cycle and the references between them are blue,
+// left-recursive ones are red instead, and unreachable rules are dashed.
+func (g *grammar) graphDot(title string, tokens bool) string {
+	nullable := g.nullable()
+	edges := make(map[string][]string)
+	left := make(map[string][]string)
+	for _, rule := range g.rules {
+		for _, name := range g.refs(rule.body) {
+			if g.ruleOf[name] != nil {
+				edges[rule.name] = append(edges[rule.name], name)
+			}
+		}
+		left[rule.name] = g.leftRefs(rule.body, nullable)
+	}
+
+	recursive := make(map[string]int) // rule to its component, from 1
+	leftRecursive := make(map[string]int)
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "digraph %s {\n", strconv.Quote(title))
+	for i, component := range g.cycles(edges) {
+		fmt.Fprintf(b, "\t// recursive: %s\n", strings.Join(component, ", "))
+		for _, name := range component {
+			recursive[name] = i + 1
+		}
+	}
+	for i, component := range g.cycles(left) {
+		fmt.Fprintf(b, "\t// left-recursive: %s\n", strings.Join(component, ", "))
+		for _, name := range component {
+			leftRecursive[name] = i + 1
+		}
+	}
+	reached := g.reachable(edges)
+	var unreachable []string
+	for _, rule := range g.rules {
+		if !reached[rule.name] {
+			unreachable = append(unreachable, rule.name)
+		}
+	}
+	if unreachable != nil {
+		fmt.Fprintf(b, "\t// unreachable: %s\n", strings.Join(unreachable, ", "))
+	}
+
+	b.WriteString("\tnode [shape=box];\n")
+	for _, rule := range g.rules {
+		var attrs []string
+		if rule.params != nil {
+			attrs = append(attrs, "label="+strconv.Quote(rule.name+"("+strings.Join(rule.params, ", ")+")"))
+		}
+		if leftRecursive[rule.name] != 0 {
+			attrs = append(attrs, "color=red")
+		} else if recursive[rule.name] != 0 {
+			attrs = append(attrs, "color=blue")
+		}
+		if !reached[rule.name] {
+			attrs = append(attrs, "style=dashed", "fontcolor=gray")
+		}
+		b.WriteString("\t" + strconv.Quote(rule.name) + dotAttrs(attrs) + ";\n")
+	}
+	if tokens {
+		used := make(map[string]bool)
+		for _, rule := range g.rules {
+			for _, name := range g.refs(rule.body) {
+				if g.ruleOf[name] == nil && !used[name] {
+					used[name] = true
+					fmt.Fprintf(b, "\t%s [shape=ellipse];\n", strconv.Quote(name))
+				}
+			}
+		}
+	}
+
+	for _, rule := range g.rules {
+		for _, name := range g.refs(rule.body) {
+			if g.ruleOf[name] == nil && !tokens {
+				continue
+			}
+			var attrs []string
+			if leftRecursive[name] != 0 && leftRecursive[name] == leftRecursive[rule.name] && contains(left[rule.name], name) {
+				attrs = append(attrs, "color=red")
+			} else if recursive[name] != 0 && recursive[name] == recursive[rule.name] {
+				attrs = append(attrs, "color=blue")
+			}
+			fmt.Fprintf(b, "\t%s -> %s%s;\n", strconv.Quote(rule.name), strconv.Quote(name), dotAttrs(attrs))
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func dotAttrs(attrs []string) string {
+	if attrs == nil {
+		return ""
+	}
+	return " [" + strings.Join(attrs, ", ") + "]"
+}
+
+func graphCommand(args []string) error {
+	flags := flag.NewFlagSet("graph", flag.ExitOnError)
+	out := flags.String("o", "", "write the graph to `file` instead of standard output")
+	tokens := flags.Bool("tokens", true, "whether to include tokens in the graph")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: llgen graph [FLAGS] FILE\n\nWrites the graph of which rules use which rules and tokens in the DOT language.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	g, err := readGrammar(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	dot := g.graphDot(filepath.Base(flags.Arg(0)), *tokens)
+	if *out == "" {
+		_, err = os.Stdout.WriteString(dot)
+		return err
+	}
+	return ioutil.WriteFile(*out, []byte(dot), 0644)
+}
@@ -0,0 +1,899 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Terms that only other grammar notations have, which the importers turn
+// into what llgen can express.
+const (
+	opPlus  = "plus"  // items[0], one or more times
+	opClass = "class" // a character class, with text in Go regexp syntax without the brackets
+)
+
+// lazy marks repetitions in lexer rules that match as few times as they can.
+const lazy = "lazy"
+
+// importer turns a grammar in another notation into llgen syntax. The
+// notation's reader fills in the rules, and write takes care of what llgen
+// cannot express directly.
+type importer struct {
+	path     string
+	rules    []*importRule // parser rules
+	lexRules []*importRule // rules that become tokens
+	tokens   []string      // tokens declared without a definition
+	literals map[string]string
+	start    string
+	warnings []string
+
+	names   map[string]string // original name to llgen name
+	dropped map[string]bool   // rules that only match whitespace, which the lexer skips
+	helpers map[string]string // term to the name of the helper rule or token made for it
+	counts  map[string]int    // helpers made for each rule
+	extra   []string          // tokens made for character classes in parser rules
+	out     []string          // rules in llgen syntax
+}
+
+type importRule struct {
+	name     string
+	body     term
+	line     int
+	fragment bool // only used inside other lexer rules
+	skip     bool // matched but not passed on by the lexer
+}
+
+func (im *importer) warnf(line int, format string, args ...interface{}) {
+	im.warnings = append(im.warnings, fmt.Sprintf("%s:%v: %s", filepath.Base(im.path), line, fmt.Sprintf(format, args...)))
+}
+
+// ftoken is a token of a grammar in another notation.
+type ftoken struct {
+	typ  string // ident, string, class, action, directive or punct
+	text string
+	fold bool // a string followed by i, which pigeon matches ignoring case
+	line int
+}
+
+// scanForeign splits the text of a grammar in another notation into
+// tokens. The notations share C-style comments, quoted strings, bracketed
+// character classes and Go or C code in braces.
+func scanForeign(src string) ([]ftoken, error) {
+	var out []ftoken
+	line := 1
+	i := 0
+	for i < len(src) {
+		r, size := utf8.DecodeRuneInString(src[i:])
+		start := i
+		switch {
+		case r == '\n':
+			line++
+			i++
+			continue
+		case unicode.IsSpace(r):
+			i += size
+			continue
+		case strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			continue
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("%v: unterminated comment", line)
+			}
+			line += strings.Count(src[i:i+end+4], "\n")
+			i += end + 4
+			continue
+		case strings.HasPrefix(src[i:], "%{"):
+			end := strings.Index(src[i:], "%}")
+			if end < 0 {
+				return nil, fmt.Errorf("%v: unterminated %%{", line)
+			}
+			out = append(out, ftoken{typ: "action", text: src[i+2 : i+end], line: line})
+			i += end + 2
+		case r == '{':
+			end, err := scanAction(src, i)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", line, err)
+			}
+			out = append(out, ftoken{typ: "action", text: src[i+1 : end-1], line: line})
+			i = end
+		case r == '\'' || r == '"':
+			j := i + 1
+			for j < len(src) && src[j] != byte(r) && src[j] != '\n' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) || src[j] != byte(r) {
+				return nil, fmt.Errorf("%v: unterminated string", line)
+			}
+			tok := ftoken{typ: "string", text: unescapeForeign(src[i+1 : j]), line: line}
+			i = j + 1
+			if i < len(src) && src[i] == 'i' && (i+1 == len(src) || !isForeignIdent(rune(src[i+1]))) {
+				tok.fold = true
+				i++
+			}
+			out = append(out, tok)
+		case r == '[':
+			j := i + 1
+			for j < len(src) && src[j] != ']' && src[j] != '\n' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) || src[j] != ']' {
+				return nil, fmt.Errorf("%v: unterminated character class", line)
+			}
+			tok := ftoken{typ: "class", text: src[i+1 : j], line: line}
+			i = j + 1
+			if i < len(src) && src[i] == 'i' && (i+1 == len(src) || !isForeignIdent(rune(src[i+1]))) {
+				tok.fold = true
+				i++
+			}
+			out = append(out, tok)
+		case r == '%' && strings.HasPrefix(src[i:], "%%"):
+			out = append(out, ftoken{typ: "punct", text: "%%", line: line})
+			i += 2
+		case r == '%' && i+1 < len(src) && unicode.IsLetter(rune(src[i+1])):
+			i++
+			for i < len(src) && (isForeignIdent(rune(src[i])) || src[i] == '-') {
+				i++
+			}
+			out = append(out, ftoken{typ: "directive", text: src[start:i], line: line})
+		case isForeignIdent(r) && !unicode.IsDigit(r):
+			for i < len(src) {
+				r, size := utf8.DecodeRuneInString(src[i:])
+				if !isForeignIdent(r) {
+					break
+				}
+				i += size
+			}
+			out = append(out, ftoken{typ: "ident", text: src[start:i], line: line})
+		default:
+			text := string(r)
+			for _, op := range []string{"->", "..", "<-", "+=", "::"} {
+				if strings.HasPrefix(src[i:], op) {
+					text = op
+				}
+			}
+			if r == '←' || r == '⟵' {
+				text = "<-"
+			}
+			i += len(text)
+			if r == '←' || r == '⟵' {
+				i += size - len(text)
+			}
+			out = append(out, ftoken{typ: "punct", text: text, line: line})
+		}
+	}
+	return out, nil
+}
+
+// fparser reads the tokens of a grammar in another notation.
+type fparser struct {
+	toks []ftoken
+	pos  int
+}
+
+// at returns the token i ahead, or one of type eof past the end.
+func (p *fparser) at(i int) ftoken {
+	if p.pos+i >= len(p.toks) {
+		line := 0
+		if len(p.toks) != 0 {
+			line = p.toks[len(p.toks)-1].line
+		}
+		return ftoken{typ: "eof", line: line}
+	}
+	return p.toks[p.pos+i]
+}
+
+func (p *fparser) next() ftoken {
+	tok := p.at(0)
+	p.pos++
+	return tok
+}
+
+// is reports whether the next token has type typ and, unless text is
+// empty, the given text.
+func (p *fparser) is(typ string, text string) bool {
+	tok := p.at(0)
+	return tok.typ == typ && (text == "" || tok.text == text)
+}
+
+func (p *fparser) accept(typ string, text string) bool {
+	if p.is(typ, text) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *fparser) expect(typ string, text string) (ftoken, error) {
+	if !p.is(typ, text) {
+		want := typ
+		if text != "" {
+			want = strconv.Quote(text)
+		}
+		return ftoken{}, p.errorf("%s expected", want)
+	}
+	return p.next(), nil
+}
+
+func (p *fparser) errorf(format string, args ...interface{}) error {
+	tok := p.at(0)
+	got := "end of file"
+	if tok.typ != "eof" {
+		got = strconv.Quote(tok.text)
+	}
+	return fmt.Errorf("%v: %s, got %s", tok.line, fmt.Sprintf(format, args...), got)
+}
+
+func isForeignIdent(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// unescapeForeign decodes the C, Go and ANTLR escapes in a quoted string.
+func unescapeForeign(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'v':
+			b.WriteByte('\v')
+		case '0':
+			b.WriteByte(0)
+		case 'x', 'u', 'U':
+			digits := map[byte]int{'x': 2, 'u': 4, 'U': 8}[s[i]]
+			hex := ""
+			if s[i] == 'u' && strings.HasPrefix(s[i+1:], "{") && strings.Contains(s[i:], "}") {
+				hex = s[i+2 : i+strings.Index(s[i:], "}")]
+				i += len(hex) + 2
+			} else if i+digits < len(s) {
+				hex = s[i+1 : i+1+digits]
+				i += digits
+			}
+			if r, err := strconv.ParseUint(hex, 16, 32); err == nil {
+				b.WriteRune(rune(r))
+			}
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// goClass translates the inside of a character class of ANTLR or pigeon,
+// which escape code points as \uXXXX, into Go regexp syntax.
+func goClass(class string) string {
+	var b strings.Builder
+	for i := 0; i < len(class); i++ {
+		switch {
+		case class[i] == '\\' && i+1 < len(class) && class[i+1] == 'u':
+			hex := ""
+			if strings.HasPrefix(class[i+2:], "{") && strings.Contains(class[i:], "}") {
+				hex = class[i+3 : i+strings.Index(class[i:], "}")]
+				i += len(hex) + 3
+			} else if i+6 <= len(class) {
+				hex = class[i+2 : i+6]
+				i += 5
+			}
+			b.WriteString(`\x{` + hex + `}`)
+		case class[i] == '\\' && i+1 < len(class):
+			b.WriteString(class[i : i+2])
+			i++
+		case class[i] == '[':
+			b.WriteString(`\[`)
+		default:
+			b.WriteByte(class[i])
+		}
+	}
+	return b.String()
+}
+
+// classChar writes r for use in a character class.
+func classChar(r rune) string {
+	if strings.ContainsRune(`\]-^[`, r) {
+		return `\` + string(r)
+	}
+	if !unicode.IsPrint(r) {
+		return fmt.Sprintf(`\x{%x}`, r)
+	}
+	return string(r)
+}
+
+// isLayout reports whether a term only ever matches whitespace.
+func (im *importer) isLayout(t term, depth int) bool {
+	switch t.op {
+	case opText:
+		return strings.TrimSpace(t.text) == ""
+	case opClass:
+		re, err := regexp.Compile("^[" + t.text + "]$")
+		if err != nil {
+			return false
+		}
+		matched := false
+		for r := rune(0); r < 0x3000; r++ {
+			if re.MatchString(string(r)) {
+				if !unicode.IsSpace(r) {
+					return false
+				}
+				matched = true
+			}
+		}
+		return matched
+	case opSeq, opOr, opOpt, opMany, opPlus:
+		for _, item := range t.items {
+			if !im.isLayout(item, depth) {
+				return false
+			}
+		}
+		return true
+	case opRule:
+		rule := im.lexRule(t.name)
+		if rule == nil {
+			rule = im.rule(t.name)
+		}
+		return rule != nil && depth < 20 && im.isLayout(rule.body, depth+1)
+	}
+	return false
+}
+
+func (im *importer) rule(name string) *importRule {
+	for _, rule := range im.rules {
+		if rule.name == name {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (im *importer) lexRule(name string) *importRule {
+	for _, rule := range im.lexRules {
+		if rule.name == name {
+			return rule
+		}
+	}
+	return nil
+}
+
+// regexp returns a Go regular expression matching what a lexer rule
+// matches, with the lexer rules it uses inlined, or false if there is none.
+func (im *importer) regexp(t term, depth int) (string, bool) {
+	join := func(items []term, sep string) (string, bool) {
+		var parts []string
+		for _, item := range items {
+			part, ok := im.regexp(item, depth)
+			if !ok {
+				return "", false
+			}
+			if sep == "" && im.alternation(item, depth) {
+				part = "(?:" + part + ")"
+			}
+			parts = append(parts, part)
+		}
+		return strings.Join(parts, sep), true
+	}
+	switch t.op {
+	case opText:
+		if t.name == "fold" {
+			return "(?i:" + regexp.QuoteMeta(t.text) + ")", true
+		}
+		return regexp.QuoteMeta(t.text), true
+	case opClass:
+		if t.name == "fold" {
+			return "(?i:[" + t.text + "])", true
+		}
+		return "[" + t.text + "]", true
+	case opAny:
+		return "(?s:.)", true
+	case opSeq:
+		return join(t.items, "")
+	case opOr:
+		return join(t.items, "|")
+	case opOpt, opMany, opPlus:
+		inner, ok := join(t.items, "")
+		if !ok {
+			return "", false
+		}
+		if !im.single(t.items, depth) {
+			inner = "(?:" + inner + ")"
+		}
+		suffix := map[string]string{opOpt: "?", opMany: "*", opPlus: "+"}[t.op]
+		if t.name == lazy {
+			suffix += "?"
+		}
+		return inner + suffix, true
+	case opRule, opToken:
+		rule := im.lexRule(t.name)
+		if rule == nil || depth >= 20 {
+			return "", false
+		}
+		return im.regexp(rule.body, depth+1)
+	}
+	return "", false
+}
+
+// alternation reports whether the regular expression of a term is an
+// alternation, which needs a group in a sequence.
+func (im *importer) alternation(t term, depth int) bool {
+	if rule := im.lexRule(t.name); (t.op == opRule || t.op == opToken) && rule != nil && depth < 20 {
+		return im.alternation(rule.body, depth+1)
+	}
+	return t.op == opOr && len(t.items) > 1
+}
+
+// single reports whether the regular expression of a sequence of terms is a
+// single character, class or group, which a repetition needs no group for.
+func (im *importer) single(items []term, depth int) bool {
+	if len(items) != 1 {
+		return false
+	}
+	t := items[0]
+	switch t.op {
+	case opClass, opAny:
+		return true
+	case opText:
+		return utf8.RuneCountInString(t.text) == 1 || t.name == "fold"
+	case opSeq, opOr:
+		return im.alternation(t, depth) || im.single(t.items, depth)
+	case opRule, opToken:
+		rule := im.lexRule(t.name)
+		return rule != nil && depth < 20 && im.single([]term{rule.body}, depth+1)
+	}
+	return false
+}
+
+// sanitize returns an llgen name for a name from another notation, which
+// may use underscores and start with one.
+func (im *importer) sanitize(name string) string {
+	if llgen, ok := im.names[name]; ok {
+		return llgen
+	}
+	base := strings.Trim(strings.Replace(name, "_", "-", -1), "-")
+	for strings.Contains(base, "--") {
+		base = strings.Replace(base, "--", "-", -1)
+	}
+	if base == "" {
+		base = "ws"
+	} else if r, _ := utf8.DecodeRuneInString(base); !unicode.IsLetter(r) {
+		base = "r-" + base
+	}
+	if _, ok := keywords[base]; ok || base == "list" {
+		base += "-rule"
+	}
+	llgen := base
+	for i := 2; im.taken(llgen); i++ {
+		llgen = fmt.Sprintf("%s-%v", base, i)
+	}
+	im.names[name] = llgen
+	return llgen
+}
+
+func (im *importer) taken(name string) bool {
+	for _, taken := range im.names {
+		if taken == name {
+			return true
+		}
+	}
+	for _, taken := range im.helpers {
+		if taken == name {
+			return true
+		}
+	}
+	return false
+}
+
+// write returns the grammar in llgen syntax.
+func (im *importer) write() string {
+	im.names = make(map[string]string)
+	im.dropped = make(map[string]bool)
+	im.helpers = make(map[string]string)
+	im.counts = make(map[string]int)
+	b := &strings.Builder{}
+
+	for _, rule := range im.rules {
+		im.sanitize(rule.name)
+	}
+	for _, rule := range im.lexRules {
+		im.sanitize(rule.name)
+	}
+	for _, name := range im.tokens {
+		im.sanitize(name)
+	}
+	start := im.start
+	if start == "" && im.rules != nil {
+		start = im.rules[0].name
+	}
+	if start != "" {
+		fmt.Fprintf(b, "%%start %s\n", im.sanitize(start))
+	}
+
+	declared := make(map[string]bool)
+	for _, rule := range im.lexRules {
+		if rule.fragment {
+			continue
+		}
+		if rule.skip {
+			if !im.isLayout(rule.body, 0) {
+				im.warnf(rule.line, "%s is skipped by the lexer, which llgen's lexer only does for whitespace; it is left out", rule.name)
+			}
+			im.dropped[rule.name] = true
+			continue
+		}
+		name := im.sanitize(rule.name)
+		declared[rule.name] = true
+		if rule.body.op == opText && rule.body.name != "fold" {
+			fmt.Fprintf(b, "token %s = %s\n", name, strconv.Quote(rule.body.text))
+			continue
+		}
+		pattern, ok := im.regexp(rule.body, 0)
+		if ok {
+			re, err := regexp.Compile("^(?:" + pattern + ")$")
+			ok = err == nil && !re.MatchString("")
+		}
+		if !ok {
+			im.warnf(rule.line, "%s cannot be written as a regular expression; it is declared without one", rule.name)
+			fmt.Fprintf(b, "token %s\n", name)
+			continue
+		}
+		fmt.Fprintf(b, "token %s ~ %s\n", name, rawQuote(pattern))
+	}
+	for _, name := range im.tokens {
+		if declared[name] || im.lexRule(name) != nil {
+			continue
+		}
+		declared[name] = true
+		if literal, ok := im.literals[name]; ok {
+			fmt.Fprintf(b, "token %s = %s\n", im.sanitize(name), strconv.Quote(literal))
+		} else {
+			fmt.Fprintf(b, "token %s\n", im.sanitize(name))
+		}
+	}
+
+	for _, rule := range im.rules {
+		if rule.skip {
+			im.dropped[rule.name] = true
+		}
+	}
+	for _, rule := range im.rules {
+		if rule.skip {
+			im.warnf(rule.line, "%s only matches whitespace, which llgen's lexer skips; it is left out", rule.name)
+			continue
+		}
+		body := im.prepare(im.leftRecursion(rule), rule)
+		im.define(im.sanitize(rule.name), body, rule)
+	}
+	b.WriteString(strings.Join(im.extra, "") + "\n" + strings.Join(im.out, ""))
+	return b.String()
+}
+
+// rawQuote quotes a regular expression in backticks if it can be, which
+// keeps its backslashes readable.
+func rawQuote(s string) string {
+	if !strings.ContainsAny(s, "`\n") {
+		return "`" + s + "`"
+	}
+	return strconv.Quote(s)
+}
+
+// leftRecursion rewrites a rule whose alternatives start with the rule
+// itself, a R | b, as b (a)... since llgen's parsers are top-down.
+func (im *importer) leftRecursion(rule *importRule) term {
+	alts := []term{rule.body}
+	if rule.body.op == opOr {
+		alts = rule.body.items
+	}
+	var base, tails []term
+	for _, alt := range alts {
+		items := []term{alt}
+		if alt.op == opSeq {
+			items = alt.items
+		}
+		if len(items) != 0 && items[0].op == opRule && items[0].name == rule.name {
+			if len(items) > 1 {
+				tails = append(tails, term{op: opSeq, items: items[1:]})
+			}
+			continue
+		}
+		base = append(base, alt)
+	}
+	if tails == nil {
+		return rule.body
+	}
+	if base == nil {
+		im.warnf(rule.line, "%s is left-recursive with no other alternative; it is kept as is", rule.name)
+		return rule.body
+	}
+	im.warnf(rule.line, "%s is left-recursive; it is rewritten as a repetition, which changes the shape of its tree", rule.name)
+	return term{op: opSeq, items: []term{alternatives(base), {op: opMany, items: []term{alternatives(tails)}}}}
+}
+
+func alternatives(alts []term) term {
+	if len(alts) == 1 {
+		return alts[0]
+	}
+	return term{op: opOr, items: alts}
+}
+
+// prepare resolves the names in a parser rule's term, leaves out what llgen
+// cannot express and turns character classes into tokens.
+func (im *importer) prepare(t term, rule *importRule) term {
+	switch t.op {
+	case opRule, opToken:
+		if im.dropped[t.name] {
+			return term{op: opSeq}
+		}
+		if im.lexRule(t.name) != nil || contains(im.tokens, t.name) {
+			return term{op: opToken, name: im.sanitize(t.name), text: t.text}
+		}
+		if im.rule(t.name) == nil {
+			im.warnf(rule.line, "%s uses %s, which is not defined", rule.name, t.name)
+		}
+		return term{op: opRule, name: im.sanitize(t.name)}
+	case opPred:
+		im.warnf(rule.line, "%s: predicate {%s} is left out", rule.name, strings.TrimSpace(t.text))
+		return term{op: opSeq}
+	case opText:
+		if t.name == "fold" {
+			im.warnf(rule.line, "%s: %q is matched exactly, not ignoring case", rule.name, t.text)
+		}
+		for _, lex := range im.lexRules {
+			if !lex.fragment && lex.body.op == opText && lex.body.name == "" && lex.body.text == t.text {
+				return term{op: opToken, name: im.sanitize(lex.name)}
+			}
+		}
+		return term{op: opText, text: t.text}
+	case opClass, opPlus, opMany, opOpt, opSeq, opOr:
+		if t.op != opSeq && t.op != opOr && im.lexical(t) {
+			return im.anonymousToken(t, rule)
+		}
+	}
+	if t.items == nil {
+		return t
+	}
+	items := make([]term, 0, len(t.items))
+	for _, item := range t.items {
+		item = im.prepare(item, rule)
+		if t.op == opSeq && item.op == opSeq {
+			items = append(items, item.items...)
+		} else {
+			items = append(items, item)
+		}
+	}
+	t.items = items
+	if t.op == opOr {
+		return im.emptyAlternative(t)
+	}
+	if t.op != opSeq && (len(items) == 0 || items[0].op == opSeq && items[0].items == nil) {
+		return term{op: opSeq}
+	}
+	return t
+}
+
+// emptyAlternative turns alternatives one of which matches nothing, as in
+// a | b | (nothing), into (a | b)?.
+func (im *importer) emptyAlternative(t term) term {
+	var alts []term
+	empty := false
+	for _, alt := range t.items {
+		if alt.op == opSeq && alt.items == nil {
+			empty = true
+		} else {
+			alts = append(alts, alt)
+		}
+	}
+	if !empty {
+		return t
+	}
+	if alts == nil {
+		return term{op: opSeq}
+	}
+	return term{op: opOpt, items: []term{alternatives(alts)}}
+}
+
+// lexical reports whether a term only matches characters, with at least one
+// character class, so that it is best matched as a single token.
+func (im *importer) lexical(t term) bool {
+	found := false
+	var walk func(t term) bool
+	walk = func(t term) bool {
+		switch t.op {
+		case opClass:
+			found = true
+			return true
+		case opText:
+			return true
+		case opOpt, opMany, opPlus, opSeq, opOr:
+			for _, item := range t.items {
+				if !walk(item) {
+					return false
+				}
+			}
+			return true
+		}
+		return false
+	}
+	return walk(t) && found
+}
+
+// anonymousToken declares a token for a term that only matches characters
+// in a parser rule. Since tokens cannot match nothing, an optional or
+// repeated term becomes an optional or repeated token.
+func (im *importer) anonymousToken(t term, rule *importRule) term {
+	wrap := ""
+	if t.op == opOpt {
+		wrap, t = t.op, t.items[0]
+	} else if t.op == opMany {
+		wrap, t = t.op, term{op: opPlus, items: t.items, name: t.name}
+	}
+	pattern, _ := im.regexp(t, 0)
+	name, ok := im.helpers["token "+pattern]
+	if !ok {
+		name = im.sanitize(rule.name + "-token")
+		im.helpers["token "+pattern] = name
+		im.extra = append(im.extra, fmt.Sprintf("token %s ~ %s\n", name, rawQuote(pattern)))
+	}
+	tok := term{op: opToken, name: name}
+	if wrap != "" {
+		return term{op: wrap, items: []term{tok}}
+	}
+	return tok
+}
+
+// define writes a rule, with helper rules for the parts that llgen only
+// allows as whole rules: alternatives inside a sequence, and optional or
+// repeated sequences and alternatives.
+func (im *importer) define(name string, t term, rule *importRule) {
+	i := len(im.out)
+	im.out = append(im.out, "")
+	if t.op == opOr && len(t.items) > 1 {
+		var alts []string
+		for _, alt := range t.items {
+			alts = append(alts, im.unit(alt, name, rule))
+		}
+		im.out[i] = name + " = " + strings.Join(alts, " | ") + "\n"
+		return
+	}
+	items := []term{t}
+	if t.op == opSeq {
+		items = t.items
+	}
+	var parts []string
+	for _, item := range items {
+		parts = append(parts, im.unitEll(item, name, rule)...)
+	}
+	im.out[i] = strings.TrimRight(name+" = "+strings.Join(parts, " "), " ") + "\n"
+}
+
+func (im *importer) unitEll(t term, name string, rule *importRule) []string {
+	switch t.op {
+	case opOpt:
+		return []string{im.unit(t.items[0], name, rule) + "?"}
+	case opMany:
+		return []string{im.unit(t.items[0], name, rule) + "..."}
+	case opPlus:
+		unit := im.unit(t.items[0], name, rule)
+		return []string{unit, unit + "..."}
+	case opAnd:
+		return []string{"&" + im.unit(t.items[0], name, rule)}
+	case opNot:
+		return []string{"!" + im.unit(t.items[0], name, rule)}
+	}
+	return []string{im.unit(t, name, rule)}
+}
+
+// unit writes a term that must be a single unit, making a helper rule for
+// it if it is not one.
+func (im *importer) unit(t term, name string, rule *importRule) string {
+	switch t.op {
+	case opRule, opToken, opText, opAny:
+		return t.String()
+	case opSeq, opOr, opOpt, opMany, opPlus, opAnd, opNot:
+		if t.op == opSeq && len(t.items) == 1 {
+			return im.unit(t.items[0], name, rule)
+		}
+		desc := t.String()
+		if helper, ok := im.helpers[desc]; ok {
+			return helper
+		}
+		im.counts[name]++
+		helper := im.sanitize(fmt.Sprintf("%s-%v", name, im.counts[name]))
+		im.helpers[desc] = helper
+		im.define(helper, t, rule)
+		return helper
+	}
+	return t.String()
+}
+
+// readers are the notations that can be imported, by name.
+var readers = map[string]func(im *importer, src string) error{
+	"antlr": readANTLR,
+	"yacc":  readYacc,
+	"peg":   readPEG,
+}
+
+// extensions are the notations of grammar files by their extensions.
+var extensions = map[string]string{".g4": "antlr", ".y": "yacc", ".yy": "yacc", ".peg": "peg"}
+
+// convertGrammar converts src, the text of the grammar file at path in
+// the given notation, to llgen syntax. It also returns warnings about what
+// the conversion changes or leaves out.
+func convertGrammar(path string, src string, from string) (string, []string, error) {
+	read, ok := readers[from]
+	if !ok {
+		return "", nil, fmt.Errorf("unknown notation %q; use -from antlr, yacc or peg", from)
+	}
+	im := &importer{path: path, literals: make(map[string]string)}
+	if err := read(im, src); err != nil {
+		return "", nil, fmt.Errorf("%s:%v", path, err)
+	}
+	text := im.write()
+	if _, err := parseGrammar(text, ""); err != nil {
+		return "", nil, fmt.Errorf("%s: the imported grammar does not parse: %v", path, err)
+	}
+	return text, im.warnings, nil
+}
+
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	from := flags.String("from", "", "notation of the file: antlr, yacc or peg (pigeon); by default, guessed from the extension")
+	out := flags.String("o", "", "write the grammar to `file` instead of standard output")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: llgen import [FLAGS] FILE\n\nConverts an ANTLR4, yacc or pigeon PEG grammar into llgen syntax.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	path := flags.Arg(0)
+	if *from == "" {
+		*from = extensions[filepath.Ext(path)]
+	}
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	text, warnings, err := convertGrammar(path, string(src), *from)
+	if err != nil {
+		return err
+	}
+
+	for _, warning := range warnings {
+		fmt.Fprintln(os.Stderr, "llgen: warning:", warning)
+	}
+	if *out == "" {
+		_, err = os.Stdout.WriteString(text)
+		return err
+	}
+	return ioutil.WriteFile(*out, []byte(text), 0644)
+}
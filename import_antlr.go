@@ -0,0 +1,286 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// antlrRule is the rule an ANTLR reader is in.
+type antlrRule struct {
+	im      *importer
+	name    string
+	line    int
+	skip    bool
+	actions bool // whether an action was already reported
+}
+
+// readANTLR reads an ANTLR4 combined, parser or lexer grammar. Rules
+// starting with an uppercase letter are lexer rules and become tokens.
+func readANTLR(im *importer, src string) error {
+	toks, err := scanForeign(src)
+	if err != nil {
+		return err
+	}
+	p := &fparser{toks: toks}
+	for !p.is("eof", "") {
+		switch {
+		case p.accept("ident", "lexer"), p.accept("ident", "parser"):
+		case p.accept("ident", "grammar"):
+			if _, err := p.expect("ident", ""); err != nil {
+				return err
+			}
+			if _, err := p.expect("punct", ";"); err != nil {
+				return err
+			}
+		case p.is("ident", "options") && p.at(1).typ == "action", p.is("ident", "channels") && p.at(1).typ == "action":
+			p.pos += 2
+		case p.is("ident", "tokens") && p.at(1).typ == "action":
+			for _, name := range strings.Split(p.at(1).text, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					im.tokens = append(im.tokens, name)
+				}
+			}
+			p.pos += 2
+		case p.is("ident", "import"):
+			im.warnf(p.next().line, "imported grammars are not read; import them separately and use %%import")
+			for !p.is("eof", "") && !p.accept("punct", ";") {
+				p.next()
+			}
+		case p.is("ident", "mode") && p.at(1).typ == "ident":
+			p.next()
+			mode := p.next()
+			im.warnf(mode.line, "lexer mode %s is not imported; its tokens are declared in the default mode", mode.text)
+			if _, err := p.expect("punct", ";"); err != nil {
+				return err
+			}
+		case p.is("punct", "@"):
+			line := p.next().line
+			for !p.is("eof", "") && !p.is("action", "") {
+				p.next()
+			}
+			p.next()
+			im.warnf(line, "named action is left out")
+		default:
+			if err := p.antlrRule(im); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *fparser) antlrRule(im *importer) error {
+	fragment := p.accept("ident", "fragment")
+	for p.accept("ident", "public") || p.accept("ident", "private") || p.accept("ident", "protected") {
+	}
+	name, err := p.expect("ident", "")
+	if err != nil {
+		return err
+	}
+	r, _ := utf8.DecodeRuneInString(name.text)
+	c := &antlrRule{im: im, name: name.text, line: name.line}
+
+	for !p.is("punct", ":") {
+		tok := p.next()
+		switch {
+		case tok.typ == "eof":
+			return p.errorf("%q expected", ":")
+		case tok.text == "options":
+			p.accept("action", "")
+		case tok.typ == "class" || tok.text == "returns" || tok.text == "locals":
+			if tok.typ != "class" {
+				p.next()
+			}
+			im.warnf(tok.line, "%s: arguments, return values and locals are left out", c.name)
+		case tok.typ == "action":
+			im.warnf(tok.line, "%s: action is left out", c.name)
+		}
+	}
+	p.next()
+	body, err := p.antlrAlts(c)
+	if err != nil {
+		return err
+	}
+	if _, err := p.expect("punct", ";"); err != nil {
+		return err
+	}
+	for p.is("ident", "catch") || p.is("ident", "finally") {
+		im.warnf(p.next().line, "%s: exception handler is left out", c.name)
+		p.accept("class", "")
+		p.accept("action", "")
+	}
+
+	rule := &importRule{name: c.name, body: body, line: c.line, fragment: fragment, skip: c.skip}
+	if unicode.IsUpper(r) {
+		im.lexRules = append(im.lexRules, rule)
+	} else {
+		im.rules = append(im.rules, rule)
+	}
+	return nil
+}
+
+func (p *fparser) antlrAlts(c *antlrRule) (term, error) {
+	var alts []term
+	for {
+		alt, err := p.antlrSeq(c)
+		if err != nil {
+			return term{}, err
+		}
+		alts = append(alts, alt)
+		if !p.accept("punct", "|") {
+			return alternatives(alts), nil
+		}
+	}
+}
+
+func (p *fparser) antlrSeq(c *antlrRule) (term, error) {
+	t := term{op: opSeq}
+	for {
+		tok := p.at(0)
+		if tok.typ == "eof" || tok.typ == "punct" && (tok.text == ";" || tok.text == "|" || tok.text == ")") {
+			break
+		}
+		if p.accept("punct", "#") {
+			if _, err := p.expect("ident", ""); err != nil {
+				return term{}, err
+			}
+			continue
+		}
+		if p.accept("punct", "->") {
+			p.antlrCommands(c)
+			continue
+		}
+		item, ok, err := p.antlrElement(c)
+		if err != nil {
+			return term{}, err
+		}
+		if ok {
+			t.items = append(t.items, item)
+		}
+	}
+	if len(t.items) == 1 {
+		return t.items[0], nil
+	}
+	return t, nil
+}
+
+// antlrCommands reads the lexer commands after ->. skip and the hidden
+// channel drop the token; the others are not supported.
+func (p *fparser) antlrCommands(c *antlrRule) {
+	for p.is("ident", "") {
+		cmd := p.next()
+		arg := ""
+		if p.accept("punct", "(") {
+			arg = p.next().text
+			p.accept("punct", ")")
+		}
+		switch {
+		case cmd.text == "skip", cmd.text == "channel" && arg == "HIDDEN":
+			c.skip = true
+		default:
+			c.im.warnf(cmd.line, "%s: lexer command %s is not supported", c.name, cmd.text)
+		}
+		if !p.accept("punct", ",") {
+			return
+		}
+	}
+}
+
+// antlrElement reads an element of an alternative with its label and
+// suffix. Actions are left out, so ok is false for them.
+func (p *fparser) antlrElement(c *antlrRule) (t term, ok bool, err error) {
+	if p.is("ident", "") && p.at(1).typ == "punct" && (p.at(1).text == "=" || p.at(1).text == "+=") {
+		p.pos += 2
+	}
+	if t, ok, err = p.antlrAtom(c); !ok || err != nil {
+		return t, ok, err
+	}
+	if p.accept("punct", "<") {
+		for !p.is("eof", "") && !p.accept("punct", ">") {
+			p.next()
+		}
+	}
+	if op, ok := map[string]string{"?": opOpt, "*": opMany, "+": opPlus}[p.at(0).text]; ok && p.at(0).typ == "punct" {
+		p.next()
+		t = term{op: op, items: []term{t}}
+		if p.accept("punct", "?") {
+			t.name = lazy
+		}
+	}
+	return t, true, nil
+}
+
+func (p *fparser) antlrAtom(c *antlrRule) (t term, ok bool, err error) {
+	tok := p.next()
+	switch {
+	case tok.typ == "action":
+		if p.accept("punct", "?") {
+			return term{op: opPred, text: tok.text}, true, nil
+		}
+		if !c.actions {
+			c.im.warnf(tok.line, "%s: actions are left out", c.name)
+			c.actions = true
+		}
+		return term{}, false, nil
+	case tok.typ == "ident" && tok.text == "EOF":
+		t = term{op: opNot, items: []term{{op: opAny}}}
+	case tok.typ == "ident":
+		t = term{op: opRule, name: tok.text}
+		p.accept("class", "")
+	case tok.typ == "string" && p.accept("punct", ".."):
+		end, err := p.expect("string", "")
+		if err != nil {
+			return term{}, false, err
+		}
+		from, _ := utf8.DecodeRuneInString(tok.text)
+		to, _ := utf8.DecodeRuneInString(end.text)
+		t = term{op: opClass, text: classChar(from) + "-" + classChar(to)}
+	case tok.typ == "string":
+		t = term{op: opText, text: tok.text}
+	case tok.typ == "class":
+		t = term{op: opClass, text: goClass(tok.text)}
+	case tok.typ == "punct" && tok.text == ".":
+		t = term{op: opAny}
+	case tok.typ == "punct" && tok.text == "~":
+		inner, _, err := p.antlrAtom(c)
+		if err != nil {
+			return term{}, false, err
+		}
+		t = c.negate(inner, tok.line)
+	case tok.typ == "punct" && tok.text == "(":
+		if t, err = p.antlrAlts(c); err != nil {
+			return term{}, false, err
+		}
+		if _, err := p.expect("punct", ")"); err != nil {
+			return term{}, false, err
+		}
+	default:
+		p.pos--
+		return term{}, false, p.errorf("element expected")
+	}
+	return t, true, nil
+}
+
+// negate returns the character class of characters that do not match t,
+// which must be a set of characters.
+func (c *antlrRule) negate(t term, line int) term {
+	set := ""
+	items := []term{t}
+	if t.op == opOr {
+		items = t.items
+	}
+	for _, item := range items {
+		switch {
+		case item.op == opClass && !strings.HasPrefix(item.text, "^"):
+			set += item.text
+		case item.op == opText && utf8.RuneCountInString(item.text) == 1:
+			r, _ := utf8.DecodeRuneInString(item.text)
+			set += classChar(r)
+		default:
+			c.im.warnf(line, "%s: only sets of characters can be negated; ~%s matches any character instead", c.name, item.String())
+			return term{op: opAny}
+		}
+	}
+	return term{op: opClass, text: "^" + set}
+}
@@ -0,0 +1,237 @@
+package main
+
+import "regexp"
+
+// readPEG reads a pigeon PEG grammar. PEGs have no separate lexer, so the
+// rules that only match characters become tokens afterwards.
+func readPEG(im *importer, src string) error {
+	toks, err := scanForeign(src)
+	if err != nil {
+		return err
+	}
+	p := &fparser{toks: toks}
+	if tok := p.at(0); tok.typ == "action" {
+		p.next()
+		im.warnf(tok.line, "initializer code is left out")
+	}
+	for !p.is("eof", "") {
+		name, err := p.expect("ident", "")
+		if err != nil {
+			return err
+		}
+		p.accept("string", "")
+		if !p.accept("punct", "<-") && !p.accept("punct", "=") {
+			return p.errorf("%q expected", "<-")
+		}
+		rule := &importRule{name: name.text, line: name.line}
+		if rule.body, err = p.pegChoice(im, rule); err != nil {
+			return err
+		}
+		p.accept("punct", ";")
+		im.rules = append(im.rules, rule)
+	}
+	im.pegTokens()
+	return nil
+}
+
+// pegRuleStart reports whether a rule definition starts at the current
+// token, which ends the previous rule.
+func (p *fparser) pegRuleStart() bool {
+	if !p.is("ident", "") {
+		return false
+	}
+	i := 1
+	if p.at(i).typ == "string" {
+		i++
+	}
+	return p.at(i).typ == "punct" && (p.at(i).text == "<-" || p.at(i).text == "=")
+}
+
+func (p *fparser) pegChoice(im *importer, rule *importRule) (term, error) {
+	var alts []term
+	for {
+		alt, err := p.pegSeq(im, rule)
+		if err != nil {
+			return term{}, err
+		}
+		alts = append(alts, alt)
+		if !p.accept("punct", "/") {
+			return alternatives(alts), nil
+		}
+	}
+}
+
+func (p *fparser) pegSeq(im *importer, rule *importRule) (term, error) {
+	var items []term
+	for {
+		tok := p.at(0)
+		if tok.typ == "eof" || tok.typ == "punct" && (tok.text == "/" || tok.text == ")" || tok.text == ";") || p.pegRuleStart() {
+			return seqOf(items), nil
+		}
+		if tok.typ == "action" {
+			p.next()
+			im.warnf(tok.line, "%s: action is left out", rule.name)
+			continue
+		}
+		if p.is("ident", "") && p.at(1).typ == "punct" && p.at(1).text == ":" {
+			p.pos += 2
+		}
+		item, err := p.pegPrefixed(im, rule)
+		if err != nil {
+			return term{}, err
+		}
+		if item.op != opSeq || item.items != nil {
+			items = append(items, item)
+		}
+	}
+}
+
+// pegPrefixed reads a primary with its & or ! lookahead and its suffix.
+// Predicates with code, &{...} and !{...}, become predicate terms, and
+// state changes, #{...}, are left out.
+func (p *fparser) pegPrefixed(im *importer, rule *importRule) (term, error) {
+	if p.is("punct", "#") && p.at(1).typ == "action" {
+		im.warnf(p.next().line, "%s: state code is left out", rule.name)
+		p.next()
+		return term{op: opSeq}, nil
+	}
+	for _, op := range []string{"&", "!"} {
+		if !p.accept("punct", op) {
+			continue
+		}
+		if tok := p.at(0); tok.typ == "action" {
+			p.next()
+			pred := term{op: opPred, text: tok.text}
+			if op == "!" {
+				pred.name = "not"
+			}
+			return pred, nil
+		}
+		item, err := p.pegSuffixed(im, rule)
+		if err != nil {
+			return term{}, err
+		}
+		if op == "&" {
+			return term{op: opAnd, items: []term{item}}, nil
+		}
+		return term{op: opNot, items: []term{item}}, nil
+	}
+	return p.pegSuffixed(im, rule)
+}
+
+func (p *fparser) pegSuffixed(im *importer, rule *importRule) (term, error) {
+	var t term
+	tok := p.next()
+	switch {
+	case tok.typ == "ident":
+		t = term{op: opRule, name: tok.text}
+	case tok.typ == "string":
+		t = term{op: opText, text: tok.text}
+		if tok.fold {
+			t.name = "fold"
+		}
+	case tok.typ == "class":
+		t = term{op: opClass, text: goClass(tok.text)}
+		if tok.fold {
+			t.name = "fold"
+		}
+	case tok.typ == "punct" && tok.text == ".":
+		t = term{op: opAny}
+	case tok.typ == "punct" && tok.text == "(":
+		var err error
+		if t, err = p.pegChoice(im, rule); err != nil {
+			return term{}, err
+		}
+		if _, err := p.expect("punct", ")"); err != nil {
+			return term{}, err
+		}
+	default:
+		p.pos--
+		return term{}, p.errorf("expression expected")
+	}
+	if op, ok := map[string]string{"?": opOpt, "*": opMany, "+": opPlus}[p.at(0).text]; ok && p.at(0).typ == "punct" {
+		p.next()
+		t = term{op: op, items: []term{t}}
+	}
+	return t, nil
+}
+
+// pegTokens turns the rules that only match characters, with at least one
+// character class or any character, into lexer rules. A rule qualifies
+// once the rules it uses do, so recursive rules stay parser rules, as do
+// the start rule and rules that match nothing or only whitespace, which
+// llgen's lexer skips. Lexer rules that no parser rule uses are fragments
+// of the others.
+func (im *importer) pegTokens() {
+	start := im.start
+	if start == "" && im.rules != nil {
+		start = im.rules[0].name
+	}
+	for _, rule := range im.rules {
+		rule.skip = im.isLayout(rule.body, 0)
+	}
+	for changed := true; changed; {
+		changed = false
+		for i, rule := range im.rules {
+			if rule.name == start || rule.skip || !im.pegLexical(rule.body) {
+				continue
+			}
+			pattern, ok := im.regexp(rule.body, 0)
+			if !ok {
+				continue
+			}
+			if re, err := regexp.Compile("^(?:" + pattern + ")$"); err != nil || re.MatchString("") {
+				continue
+			}
+			im.lexRules = append(im.lexRules, rule)
+			im.rules = append(im.rules[:i], im.rules[i+1:]...)
+			changed = true
+			break
+		}
+	}
+
+	used := make(map[string]bool)
+	var walk func(t term)
+	walk = func(t term) {
+		if t.op == opRule {
+			used[t.name] = true
+		}
+		for _, item := range t.items {
+			walk(item)
+		}
+	}
+	for _, rule := range im.rules {
+		walk(rule.body)
+	}
+	for _, rule := range im.lexRules {
+		rule.fragment = !used[rule.name]
+	}
+}
+
+// pegLexical reports whether a term only matches characters, using lexer
+// rules, with at least one character class or any character.
+func (im *importer) pegLexical(t term) bool {
+	found := false
+	var walk func(t term) bool
+	walk = func(t term) bool {
+		switch t.op {
+		case opClass, opAny:
+			found = true
+			return true
+		case opText:
+			return true
+		case opRule:
+			found = true
+			return im.lexRule(t.name) != nil
+		case opOpt, opMany, opPlus, opSeq, opOr:
+			for _, item := range t.items {
+				if !walk(item) {
+					return false
+				}
+			}
+			return true
+		}
+		return false
+	}
+	return walk(t) && found
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+var yaccSection = regexp.MustCompile(`(?m)^%%`)
+
+// readYacc reads the declarations and rules of a yacc or bison grammar.
+// yacc has no lexer, so tokens are declared without definitions, except
+// for bison's string aliases such as %token LE "<=".
+func readYacc(im *importer, src string) error {
+	if sections := yaccSection.FindAllStringIndex(src, 2); len(sections) == 2 {
+		src = src[:sections[1][0]]
+	}
+	toks, err := scanForeign(src)
+	if err != nil {
+		return err
+	}
+	p := &fparser{toks: toks}
+	precedence := false
+	for !p.accept("punct", "%%") {
+		tok := p.next()
+		switch {
+		case tok.typ == "eof":
+			return p.errorf("%q expected", "%%")
+		case tok.typ == "action":
+			im.warnf(tok.line, "prologue code is left out")
+		case tok.text == "%start":
+			name, err := p.expect("ident", "")
+			if err != nil {
+				return err
+			}
+			im.start = name.text
+		case tok.text == "%left" || tok.text == "%right" || tok.text == "%nonassoc" || tok.text == "%precedence":
+			if !precedence {
+				im.warnf(tok.line, "precedence and associativity are not supported; ambiguous rules such as expr: expr '+' expr need rewriting by precedence level")
+				precedence = true
+			}
+			p.yaccTokens(im)
+		case tok.text == "%token":
+			p.yaccTokens(im)
+		case tok.typ == "directive":
+			for !p.is("eof", "") && !p.is("directive", "") && !p.is("punct", "%%") {
+				p.next()
+			}
+		}
+	}
+
+	for !p.is("eof", "") {
+		name, err := p.expect("ident", "")
+		if err != nil {
+			return err
+		}
+		p.accept("class", "")
+		if _, err := p.expect("punct", ":"); err != nil {
+			return err
+		}
+		body, err := p.yaccAlts(im, name)
+		if err != nil {
+			return err
+		}
+		p.accept("punct", ";")
+		if rule := im.rule(name.text); rule != nil {
+			rule.body = alternatives(append(alternativesOf(rule.body), alternativesOf(body)...))
+			continue
+		}
+		im.rules = append(im.rules, &importRule{name: name.text, body: body, line: name.line})
+	}
+	return nil
+}
+
+func alternativesOf(t term) []term {
+	if t.op == opOr {
+		return t.items
+	}
+	return []term{t}
+}
+
+// yaccTokens reads the tokens declared by %token or a precedence
+// declaration, with their optional types, numbers and string aliases.
+func (p *fparser) yaccTokens(im *importer) {
+	if p.accept("punct", "<") {
+		for !p.is("eof", "") && !p.accept("punct", ">") {
+			p.next()
+		}
+	}
+	for {
+		switch {
+		case p.is("ident", ""):
+			name := p.next().text
+			if !contains(im.tokens, name) {
+				im.tokens = append(im.tokens, name)
+			}
+			if p.is("ident", "") && strings.Trim(p.at(0).text, "0123456789") == "" {
+				p.next()
+			}
+			if p.is("string", "") && len(p.at(0).text) > 1 {
+				im.literals[name] = p.next().text
+			}
+		case p.is("string", ""):
+			p.next()
+		default:
+			return
+		}
+	}
+}
+
+func (p *fparser) yaccAlts(im *importer, name ftoken) (term, error) {
+	var alts []term
+	actions := false
+	var items []term
+	recovery := false // whether the alternative uses the error token
+	end := func() {
+		if !recovery {
+			alts = append(alts, seqOf(items))
+		}
+		items, recovery = nil, false
+	}
+	for {
+		tok := p.at(0)
+		switch {
+		case tok.typ == "eof" || tok.typ == "punct" && (tok.text == ";" || tok.text == "%%"),
+			tok.typ == "ident" && p.at(1).typ == "punct" && p.at(1).text == ":",
+			tok.typ == "ident" && p.at(1).typ == "class" && p.at(2).text == ":":
+			end()
+			return alternatives(alts), nil
+		case tok.typ == "punct" && tok.text == "|":
+			p.next()
+			end()
+		case tok.typ == "action":
+			p.next()
+			if !actions {
+				im.warnf(tok.line, "%s: actions are left out", name.text)
+				actions = true
+			}
+		case tok.text == "%prec":
+			p.next()
+			p.next()
+			im.warnf(tok.line, "%s: %%prec is not supported", name.text)
+		case tok.text == "%empty":
+			p.next()
+		case tok.typ == "directive":
+			im.warnf(p.next().line, "%s: %s is not supported", name.text, tok.text)
+			p.accept("action", "")
+		case tok.typ == "ident" && tok.text == "error":
+			p.next()
+			im.warnf(tok.line, "%s: the alternative with the error token for recovery is left out", name.text)
+			recovery = true
+		case tok.typ == "ident":
+			p.next()
+			p.accept("class", "")
+			items = append(items, term{op: opRule, name: tok.text})
+		case tok.typ == "string":
+			p.next()
+			items = append(items, im.yaccLiteral(tok.text))
+		default:
+			return term{}, p.errorf("symbol expected")
+		}
+	}
+}
+
+// yaccLiteral refers to a character literal or a string alias of a token.
+func (im *importer) yaccLiteral(text string) term {
+	for name, literal := range im.literals {
+		if literal == text {
+			return term{op: opToken, name: name}
+		}
+	}
+	return term{op: opText, text: text}
+}
+
+func seqOf(items []term) term {
+	if len(items) == 1 {
+		return items[0]
+	}
+	return term{op: opSeq, items: items}
+}
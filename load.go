@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"github.com/allen-b1/llgen/parser"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// loader reads a grammar file along with the files it imports, merging
+// their statements into one grammar in the order they appear.
+type loader struct {
+	loaded  map[string]bool   // files already merged, by path and prefix
+	loading []string          // files being loaded, innermost last
+	defined map[string]string // rule, token and keyword names to where they are defined
+	open    map[string]string // text of files being edited, by path, read instead of the files
+	out     []parser.NodeStatement
+	files   []string // file each statement of out was read from
+}
+
+func loadGrammar(path string) (parser.NodeStatements, error) {
+	ns, _, err := loadGrammarOpen(path, nil)
+	return ns, err
+}
+
+// loadGrammarOpen loads a grammar, using the text in open for the files
+// there instead of what is saved, as the language server does. It also
+// returns the file each statement was read from, for options.files.
+func loadGrammarOpen(path string, open map[string]string) (parser.NodeStatements, []string, error) {
+	l := &loader{loaded: make(map[string]bool), defined: make(map[string]string), open: open}
+	if err := l.load(path, "", ""); err != nil {
+		return parser.NodeStatements{}, nil, err
+	}
+	return parser.NodeStatements{I0: l.out}, l.files, nil
+}
+
+// load merges the statements of a file, prefixing the names it defines
+// with prefix. from is the position of the %import that names the file,
+// if any, for errors about the file as a whole.
+func (l *loader) load(path string, prefix string, from string) error {
+	for i, loading := range l.loading {
+		if loading == path {
+			return fmt.Errorf("%s: import cycle: %s", from, strings.Join(append(l.loading[i:], path), " -> "))
+		}
+	}
+	key := prefix + ":" + path
+	if l.loaded[key] {
+		return nil
+	}
+	l.loaded[key] = true
+
+	l.loading = append(l.loading, path)
+	defer func() { l.loading = l.loading[:len(l.loading)-1] }()
+
+	body, err := l.read(path)
+	if err != nil && from != "" {
+		return fmt.Errorf("%s: %v", from, err)
+	} else if err != nil {
+		return err
+	}
+	ns, err := parseGrammar(string(body), prefix)
+	if err != nil {
+		return positioned(path, err)
+	}
+
+	for _, statement := range ns.I0 {
+		if n, ok := statement.I.(parser.NodeStatementDirective); ok && n.I1.Data == "import" {
+			if err := l.include(path, n); err != nil {
+				return err
+			}
+			continue
+		}
+		var name parser.Token
+		kind := "rule"
+		switch n := statement.I.(type) {
+		case parser.NodeStatementExpr:
+			name = n.I0
+		case parser.NodeStatementMacro:
+			name = n.I0
+		case parser.NodeStatementToken:
+			name, kind = n.I1, "token"
+		case parser.NodeStatementKeyword:
+			name, kind = n.I1, "keyword"
+		}
+		if name.Data != "" {
+			where := fmt.Sprintf("%s:%v", path, name.Line)
+			if prev, ok := l.defined[name.Data]; ok {
+				return fmt.Errorf("%s: %s %s is already defined at %s", where, kind, name.Data, prev)
+			}
+			l.defined[name.Data] = where
+		}
+		l.out = append(l.out, statement)
+		l.files = append(l.files, path)
+	}
+	return nil
+}
+
+func (l *loader) read(path string) ([]byte, error) {
+	if text, ok := l.open[path]; ok {
+		return []byte(text), nil
+	}
+	return ioutil.ReadFile(path)
+}
+
+// include loads the file of an %import directive in the file at path.
+// Imported paths are relative to the importing file.
+func (l *loader) include(path string, n parser.NodeStatementDirective) error {
+	from := fmt.Sprintf("%s:%v:%v", path, n.I0.Line, n.I0.Col)
+	var args []string
+	var err error
+	if len(n.I2) == 2 {
+		args, err = directiveArgs(n, "ident", "string")
+	} else {
+		args, err = directiveArgs(n, "string")
+		args = append([]string{""}, args...)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", from, err)
+	}
+	prefix := ""
+	if args[0] != "" {
+		prefix = args[0] + "-"
+	}
+	return l.load(filepath.Join(filepath.Dir(path), args[1]), prefix, from)
+}
+
+// positioned adds the file name to an error from it.
+func positioned(path string, err error) error {
+	if e, ok := err.(parser.Error); ok {
+		if e.Col == 0 {
+			return fmt.Errorf("%s:%v: %s", path, e.Line, e.Message)
+		}
+		return fmt.Errorf("%s:%v:%v: %s", path, e.Line, e.Col, e.Message)
+	}
+	return err
+}
+
+// parseGrammar parses the text of a grammar file. With a prefix, every
+// token, keyword, rule and mode the file defines is renamed to start with
+// it, along with the references to them.
+func parseGrammar(text string, prefix string) (*parser.NodeStatements, error) {
+	tokens, err := tokenize(text)
+	if err != nil {
+		return nil, err
+	}
+	ns, err := parser.ParseStatementsTokens(tokens)
+	if err != nil || prefix == "" {
+		return ns, err
+	}
+
+	names := make(map[string]bool)
+	if err := definedNames(ns.I0, names); err != nil {
+		return nil, err
+	}
+	if err := rename(tokens, names, prefix); err != nil {
+		return nil, err
+	}
+	return parser.ParseStatementsTokens(tokens)
+}
+
+func definedNames(statements []parser.NodeStatement, names map[string]bool) error {
+	for _, statement := range statements {
+		switch n := statement.I.(type) {
+		case parser.NodeStatementToken:
+			names[n.I1.Data] = true
+		case parser.NodeStatementKeyword:
+			names[n.I1.Data] = true
+		case parser.NodeStatementExpr:
+			names[n.I0.Data] = true
+		case parser.NodeStatementMacro:
+			names[n.I0.Data] = true
+		case parser.NodeStatementDirective:
+			if n.I1.Data != "mode" || len(n.I2) != 2 {
+				continue
+			}
+			names[n.I2[0].I.(parser.Token).Data] = true
+			block, err := tokenize(n.I2[1].I.(parser.Token).Data + "\n")
+			if err != nil {
+				return err
+			}
+			inner, err := parser.ParseStatementsTokens(block)
+			if err != nil {
+				return err
+			}
+			if err := definedNames(inner.I0, names); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rename prefixes the identifiers among tokens that are in names, except
+// for directive names. The tokens of %mode blocks, which are only lexed
+// later, are renamed in their text.
+func rename(tokens []parser.Token, names map[string]bool, prefix string) error {
+	for i := range tokens {
+		tok := &tokens[i]
+		if tok.Type == "ident" && names[tok.Data] && (i == 0 || tokens[i-1].Type != "percent") {
+			tok.Data = prefix + tok.Data
+		}
+		if tok.Type == "action" && i >= 3 && tokens[i-3].Type == "percent" && tokens[i-2].Data == "mode" {
+			block, err := renameText(tok.Data, names, prefix)
+			if err != nil {
+				return err
+			}
+			tok.Data = block
+		}
+	}
+	return nil
+}
+
+func renameText(text string, names map[string]bool, prefix string) (string, error) {
+	tokens, err := tokenize(text)
+	if err != nil {
+		return "", err
+	}
+	lines := strings.SplitAfter(text, "\n")
+	for i := len(tokens) - 1; i >= 0; i-- {
+		tok := tokens[i]
+		if tok.Type != "ident" || !names[tok.Data] || (i > 0 && tokens[i-1].Type == "percent") {
+			continue
+		}
+		line := lines[tok.Line-1]
+		col := 0
+		for j := 1; j < tok.Col; j++ {
+			_, size := utf8.DecodeRuneInString(line[col:])
+			col += size
+		}
+		lines[tok.Line-1] = line[:col] + prefix + line[col:]
+	}
+	return strings.Join(lines, ""), nil
+}
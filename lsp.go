@@ -0,0 +1,695 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/allen-b1/llgen/parser"
+)
+
+// lspServer answers Language Server Protocol requests about grammar files,
+// read from in and answered on out as JSON-RPC messages with headers.
+type lspServer struct {
+	in       *bufio.Reader
+	out      io.Writer
+	open     map[string]string // text of the open documents, by path
+	shutdown bool
+}
+
+type lspRequest struct {
+	ID     *json.RawMessage `json:"id"`
+	Method string           `json:"method"`
+	Params json.RawMessage  `json:"params"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"` // in UTF-16 code units
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+// lspParams holds the parameters of the requests and notifications the
+// server handles, each of which uses some of them.
+type lspParams struct {
+	TextDocument struct {
+		URI  string `json:"uri"`
+		Text string `json:"text"`
+	} `json:"textDocument"`
+	ContentChanges []struct {
+		Text string `json:"text"`
+	} `json:"contentChanges"`
+	Position lspPosition `json:"position"`
+	Context  struct {
+		IncludeDeclaration bool `json:"includeDeclaration"`
+	} `json:"context"`
+	NewName string `json:"newName"`
+}
+
+// lspError is an error with a JSON-RPC error code.
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *lspError) Error() string {
+	return e.Message
+}
+
+// serve handles messages until the client sends exit or closes the input.
+func (s *lspServer) serve() error {
+	for {
+		body, err := s.read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var req lspRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			s.send(map[string]interface{}{"jsonrpc": "2.0", "id": nil, "error": &lspError{-32700, err.Error()}})
+			continue
+		}
+		if req.Method == "exit" {
+			if !s.shutdown {
+				return fmt.Errorf("exit before shutdown")
+			}
+			return nil
+		}
+
+		var params lspParams
+		json.Unmarshal(req.Params, &params)
+		result, err := s.handle(req.Method, params)
+		if req.ID == nil {
+			continue
+		}
+		msg := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+		if e, ok := err.(*lspError); ok {
+			msg["error"] = e
+		} else if err != nil {
+			msg["error"] = &lspError{-32603, err.Error()}
+		} else {
+			msg["result"] = result
+		}
+		if err := s.send(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// read returns the body of the next message.
+func (s *lspServer) read() ([]byte, error) {
+	length := -1
+	for {
+		line, err := s.in.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if i := strings.IndexByte(line, ':'); i >= 0 && strings.EqualFold(line[:i], "Content-Length") {
+			if length, err = strconv.Atoi(strings.TrimSpace(line[i+1:])); err != nil {
+				return nil, fmt.Errorf("invalid Content-Length: %v", err)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("message without Content-Length")
+	}
+	body := make([]byte, length)
+	_, err := io.ReadFull(s.in, body)
+	return body, err
+}
+
+func (s *lspServer) send(msg interface{}) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.out, "Content-Length: %v\r\n\r\n%s", len(body), body)
+	return err
+}
+
+func (s *lspServer) handle(method string, params lspParams) (interface{}, error) {
+	path := uriPath(params.TextDocument.URI)
+	switch method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":   1, // the whole text on each change
+				"definitionProvider": true,
+				"referencesProvider": true,
+				"hoverProvider":      true,
+				"renameProvider":     true,
+				"completionProvider": map[string]interface{}{"triggerCharacters": []string{"%"}},
+			},
+			"serverInfo": map[string]string{"name": "llgen"},
+		}, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		s.open[path] = params.TextDocument.Text
+		return nil, s.publish()
+	case "textDocument/didChange":
+		if n := len(params.ContentChanges); n != 0 {
+			s.open[path] = params.ContentChanges[n-1].Text
+		}
+		return nil, s.publish()
+	case "textDocument/didSave":
+		return nil, s.publish()
+	case "textDocument/didClose":
+		delete(s.open, path)
+		if err := s.send(diagnosticsMessage(params.TextDocument.URI, []interface{}{})); err != nil {
+			return nil, err
+		}
+		return nil, s.publish()
+	case "textDocument/definition":
+		idx := s.index(path)
+		sym, ok := idx.at(path, s.text(path), params.Position)
+		if !ok {
+			return nil, nil
+		}
+		def, ok := idx.defs[sym.name]
+		if !ok {
+			return nil, nil
+		}
+		return s.location(def), nil
+	case "textDocument/references":
+		idx := s.index(path)
+		sym, ok := idx.at(path, s.text(path), params.Position)
+		if !ok {
+			return nil, nil
+		}
+		locations := []lspLocation{}
+		for _, other := range idx.symbols {
+			if other.name == sym.name && (!other.def || params.Context.IncludeDeclaration) {
+				locations = append(locations, s.location(other))
+			}
+		}
+		return locations, nil
+	case "textDocument/hover":
+		return s.hover(path, params.Position), nil
+	case "textDocument/rename":
+		return s.rename(path, params.Position, params.NewName)
+	case "textDocument/completion":
+		return s.complete(path, params.Position), nil
+	}
+	if strings.HasPrefix(method, "$/") || method == "initialized" {
+		return nil, nil
+	}
+	return nil, &lspError{-32601, "unsupported method: " + method}
+}
+
+// text returns the text of a file, open or saved.
+func (s *lspServer) text(path string) string {
+	if text, ok := s.open[path]; ok {
+		return text
+	}
+	text, _ := ioutil.ReadFile(path)
+	return string(text)
+}
+
+func (s *lspServer) location(sym lspSymbol) lspLocation {
+	text := s.text(sym.path)
+	return lspLocation{URI: pathURI(sym.path), Range: lspRange{
+		Start: lspPos(text, sym.line, sym.col),
+		End:   lspPos(text, sym.line, sym.col+sym.length),
+	}}
+}
+
+func uriPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	return filepath.Clean(filepath.FromSlash(u.Path))
+}
+
+func pathURI(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+// lspPos converts a line and a column in runes, both counted from 1, to an
+// LSP position, which counts lines from 0 and columns in UTF-16 code units.
+func lspPos(text string, line, col int) lspPosition {
+	units := 0
+	for i, r := range []rune(lineOf(text, line)) {
+		if i+1 >= col {
+			break
+		}
+		units++
+		if r >= 0x10000 {
+			units++
+		}
+	}
+	return lspPosition{Line: line - 1, Character: units}
+}
+
+// runeCol returns the column in runes, from 1, of an LSP position.
+func runeCol(text string, pos lspPosition) int {
+	units := 0
+	col := 1
+	for _, r := range lineOf(text, pos.Line+1) {
+		if units >= pos.Character {
+			break
+		}
+		units++
+		if r >= 0x10000 {
+			units++
+		}
+		col++
+	}
+	return col
+}
+
+func lineOf(text string, line int) string {
+	lines := strings.Split(text, "\n")
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+	return lines[line-1]
+}
+
+// lspSymbol is where a rule, token or keyword name appears in a file.
+type lspSymbol struct {
+	path      string
+	name      string // as the merged grammar knows it, with the namespace of an import
+	prefix    string // namespace prefix of the file's import
+	line, col int    // of its first rune, from 1
+	length    int    // in runes
+	def       bool
+	kind      string // rule, parameterized rule, token or keyword, for definitions
+	end       int    // last line of the statement, for definitions
+}
+
+// lspIndex is the symbols of a file and of the files it imports.
+type lspIndex struct {
+	symbols []lspSymbol
+	defs    map[string]lspSymbol
+}
+
+// index finds the symbols of a file and those it imports, recursively,
+// as they would be merged by loadGrammar.
+func (s *lspServer) index(path string) *lspIndex {
+	idx := &lspIndex{defs: make(map[string]lspSymbol)}
+	seen := make(map[string]bool)
+	var visit func(path, prefix string)
+	visit = func(path, prefix string) {
+		if seen[prefix+":"+path] {
+			return
+		}
+		seen[prefix+":"+path] = true
+		symbols, imports := fileSymbols(s.text(path))
+		defined := make(map[string]bool)
+		for _, sym := range symbols {
+			if sym.def {
+				defined[sym.name] = true
+			}
+		}
+		for _, sym := range symbols {
+			if defined[sym.name] {
+				sym.name = prefix + sym.name
+			}
+			sym.path, sym.prefix = path, prefix
+			idx.symbols = append(idx.symbols, sym)
+			if _, ok := idx.defs[sym.name]; sym.def && !ok {
+				idx.defs[sym.name] = sym
+			}
+		}
+		for _, imp := range imports {
+			ns := ""
+			if imp[0] != "" {
+				ns = imp[0] + "-"
+			}
+			visit(filepath.Join(filepath.Dir(path), imp[1]), ns)
+		}
+	}
+	visit(path, "")
+	return idx
+}
+
+// at returns the symbol at a position in a file.
+func (idx *lspIndex) at(path, text string, pos lspPosition) (lspSymbol, bool) {
+	col := runeCol(text, pos)
+	for _, sym := range idx.symbols {
+		if sym.path == path && sym.line == pos.Line+1 && sym.col <= col && col <= sym.col+sym.length {
+			return sym, true
+		}
+	}
+	return lspSymbol{}, false
+}
+
+// fileSymbols returns the names a grammar file defines and uses, and its
+// %import directives as namespace and file. It finds what it can in a
+// file that does not parse.
+func fileSymbols(text string) ([]lspSymbol, [][2]string) {
+	var symbols []lspSymbol
+	var imports [][2]string
+	var scan func(text string, line, col int)
+	scan = func(text string, line, col int) {
+		src := &source{comments: make(map[int]string), text: make(map[[2]int]string)}
+		tokens, _ := tokenizeSource(text, src)
+		// shift moves a token of text to where text is in the file.
+		shift := func(tok parser.Token) parser.Token {
+			if tok.Line == 1 {
+				tok.Col += col - 1
+			}
+			tok.Line += line - 1
+			return tok
+		}
+		add := func(tok parser.Token, def bool, kind string) {
+			tok = shift(tok)
+			symbols = append(symbols, lspSymbol{name: tok.Data, line: tok.Line, col: tok.Col, length: utf8.RuneCountInString(tok.Data), def: def, kind: kind})
+		}
+		for len(tokens) != 0 {
+			n := 0
+			for n < len(tokens) && tokens[n].Type != "newline" {
+				n++
+			}
+			statement := tokens[:n]
+			end := line
+			if n < len(tokens) {
+				end = shift(tokens[n]).Line
+				n++
+			}
+			tokens = tokens[n:]
+			if len(statement) < 2 {
+				continue
+			}
+			first := len(symbols)
+			switch {
+			case statement[0].Type == "kw-token" || statement[0].Type == "kw-keyword":
+				add(statement[1], true, strings.TrimPrefix(statement[0].Type, "kw-"))
+			case statement[0].Type == "percent":
+				args := statement[2:]
+				switch statement[1].Data {
+				case "start", "type":
+					for _, arg := range args {
+						if arg.Type == "ident" {
+							add(arg, false, "")
+						}
+					}
+				case "mode":
+					if len(args) == 2 && args[1].Type == "action" {
+						raw := src.text[[2]int{args[1].Line, args[1].Col}]
+						at := shift(args[1])
+						scan(raw[1:len(raw)-1], at.Line, at.Col+1)
+					}
+				case "import":
+					if len(args) == 1 && args[0].Type == "string" {
+						imports = append(imports, [2]string{"", args[0].Data})
+					} else if len(args) == 2 && args[1].Type == "string" {
+						imports = append(imports, [2]string{args[0].Data, args[1].Data})
+					}
+				}
+			case statement[0].Type == "ident":
+				rest := statement[1:]
+				params := make(map[string]bool)
+				kind := "rule"
+				if rest[0].Type == "lparen" {
+					kind = "parameterized rule"
+					for len(rest) != 0 && rest[0].Type != "rparen" {
+						if rest[0].Type == "ident" {
+							params[rest[0].Data] = true
+						}
+						rest = rest[1:]
+					}
+				}
+				add(statement[0], true, kind)
+				ruleRefs(rest, params, func(tok parser.Token) { add(tok, false, "") })
+			}
+			for i := first; i < len(symbols); i++ {
+				symbols[i].end = end
+			}
+		}
+	}
+	scan(text, 1, 1)
+	return symbols, imports
+}
+
+// ruleRefs calls ref for each identifier in the tokens of a rule's body
+// that names a rule or token: not parameters or the options of a list.
+func ruleRefs(tokens []parser.Token, params map[string]bool, ref func(tok parser.Token)) {
+	type call struct {
+		list bool
+		arg  int
+	}
+	var calls []call
+	for i, tok := range tokens {
+		next := parser.Token{}
+		if i+1 < len(tokens) {
+			next = tokens[i+1]
+		}
+		switch tok.Type {
+		case "lparen":
+			calls = append(calls, call{list: i > 0 && tokens[i-1].Data == "list"})
+		case "rparen":
+			if len(calls) != 0 {
+				calls = calls[:len(calls)-1]
+			}
+		case "comma":
+			if len(calls) != 0 {
+				calls[len(calls)-1].arg++
+			}
+		case "ident":
+			option := len(calls) != 0 && calls[len(calls)-1].list && calls[len(calls)-1].arg >= 2
+			builtin := tok.Data == "list" && next.Type == "lparen"
+			if !params[tok.Data] && !option && !builtin {
+				ref(tok)
+			}
+		}
+	}
+}
+
+// publish sends the diagnostics of each open document.
+func (s *lspServer) publish() error {
+	for path := range s.open {
+		diagnostics := []interface{}{}
+		if d := s.diagnose(path); d != nil {
+			diagnostics = append(diagnostics, d)
+		}
+		if err := s.send(diagnosticsMessage(pathURI(path), diagnostics)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func diagnosticsMessage(uri string, diagnostics []interface{}) interface{} {
+	return map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  "textDocument/publishDiagnostics",
+		"params":  map[string]interface{}{"uri": uri, "diagnostics": diagnostics},
+	}
+}
+
+// diagnose returns the first error in a grammar: from tokenizing, parsing,
+// loading it or generating its parser, which mostly say where they are.
+// Those that do not are put on the first symbol of the file they name.
+func (s *lspServer) diagnose(path string) interface{} {
+	ns, files, err := loadGrammarOpen(path, s.open)
+	if err == nil {
+		_, err = generateAll(ns, options{files: files})
+	}
+	if err == nil {
+		return nil
+	}
+	text := s.text(path)
+	msg := err.Error()
+	line, col, length := 1, 1, 0
+	if rest := strings.TrimPrefix(msg, path+":"); rest != msg {
+		parts := strings.SplitN(rest, ":", 3)
+		line, _ = strconv.Atoi(parts[0])
+		if len(parts) == 3 {
+			if c, err := strconv.Atoi(parts[1]); err == nil {
+				col = c
+				rest = parts[2]
+			} else {
+				rest = parts[1] + ":" + parts[2]
+			}
+		} else if len(parts) == 2 {
+			rest = parts[1]
+		}
+		msg = strings.TrimSpace(rest)
+		length = 1
+	} else if sym, ok := s.index(path).mentioned(path, msg); ok {
+		line, col, length = sym.line, sym.col, sym.length
+	}
+	return map[string]interface{}{
+		"range":    lspRange{Start: lspPos(text, line, col), End: lspPos(text, line, col+length)},
+		"severity": 1,
+		"source":   "llgen",
+		"message":  msg,
+	}
+}
+
+// mentioned returns the symbol of a file that an error is most likely
+// about: the definition, or else the first use, of the first name in the
+// message that the file has, leaving out directive names.
+func (idx *lspIndex) mentioned(path, msg string) (lspSymbol, bool) {
+	words := strings.FieldsFunc(msg, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '%'
+	})
+	for _, word := range words {
+		if strings.HasPrefix(word, "%") {
+			continue
+		}
+		var use *lspSymbol
+		for i, sym := range idx.symbols {
+			if sym.path != path || sym.name != word {
+				continue
+			}
+			if sym.def {
+				return sym, true
+			}
+			if use == nil {
+				use = &idx.symbols[i]
+			}
+		}
+		if use != nil {
+			return *use, true
+		}
+	}
+	return lspSymbol{}, false
+}
+
+// hover describes the symbol at a position: its definition as written and,
+// for rules, the tokens it can start with.
+func (s *lspServer) hover(path string, pos lspPosition) interface{} {
+	idx := s.index(path)
+	sym, ok := idx.at(path, s.text(path), pos)
+	if !ok {
+		return nil
+	}
+	def, ok := idx.defs[sym.name]
+	if !ok {
+		return nil
+	}
+	lines := strings.Split(s.text(def.path), "\n")
+	if def.end > len(lines) {
+		def.end = len(lines)
+	}
+	value := fmt.Sprintf("%s %s\n```\n%s\n```", def.kind, def.name, strings.Join(lines[def.line-1:def.end], "\n"))
+	if ns, _, err := loadGrammarOpen(path, s.open); err == nil && def.kind == "rule" {
+		if g, err := newGrammar(ns, nil); err == nil && g.ruleOf[def.name] != nil {
+			nullable := g.nullable()
+			first := g.first(g.ruleOf[def.name].body, nullable)
+			if nullable[def.name] {
+				first = append(first, "(nothing)")
+			}
+			value += "\n\nFIRST: " + strings.Join(first, ", ")
+		}
+	}
+	return map[string]interface{}{
+		"contents": map[string]string{"kind": "markdown", "value": value},
+		"range":    s.location(sym).Range,
+	}
+}
+
+// rename renames a rule or token everywhere the files of a grammar use
+// it. Names from imports with a namespace are renamed in their own file.
+func (s *lspServer) rename(path string, pos lspPosition, name string) (interface{}, error) {
+	idx := s.index(path)
+	sym, ok := idx.at(path, s.text(path), pos)
+	if !ok {
+		return nil, &lspError{-32602, "no rule or token here"}
+	}
+	def, ok := idx.defs[sym.name]
+	if !ok {
+		return nil, &lspError{-32602, sym.name + " is not defined"}
+	}
+	if def.prefix != "" {
+		return nil, &lspError{-32602, sym.name + " is imported with a namespace; rename it in " + filepath.Base(def.path)}
+	}
+	r, _ := utf8.DecodeRuneInString(name)
+	valid := unicode.IsLetter(r)
+	for _, r := range name {
+		valid = valid && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-')
+	}
+	if _, keyword := keywords[name]; !valid || keyword || name == "list" {
+		return nil, &lspError{-32602, fmt.Sprintf("%q is not a valid name", name)}
+	}
+	if _, ok := idx.defs[name]; ok {
+		return nil, &lspError{-32602, name + " is already defined"}
+	}
+
+	changes := make(map[string][]interface{})
+	for _, other := range idx.symbols {
+		if other.name == sym.name && other.prefix == "" {
+			uri := pathURI(other.path)
+			changes[uri] = append(changes[uri], map[string]interface{}{"range": s.location(other).Range, "newText": name})
+		}
+	}
+	return map[string]interface{}{"changes": changes}, nil
+}
+
+// directives are completed after a %.
+var directives = []string{"start", "type", "state", "indent", "mode", "header", "import"}
+
+// complete lists the names that can be written at a position: directives
+// after a %, otherwise the rules, tokens and keywords of the grammar.
+func (s *lspServer) complete(path string, pos lspPosition) interface{} {
+	line := []rune(lineOf(s.text(path), pos.Line+1))
+	col := runeCol(s.text(path), pos) - 1
+	if col > len(line) {
+		col = len(line)
+	}
+	start := col
+	for start > 0 && (unicode.IsLetter(line[start-1]) || unicode.IsDigit(line[start-1]) || line[start-1] == '-') {
+		start--
+	}
+	items := []interface{}{}
+	if start > 0 && line[start-1] == '%' {
+		for _, name := range directives {
+			items = append(items, map[string]interface{}{"label": name, "kind": 14})
+		}
+		return items
+	}
+
+	idx := s.index(path)
+	kinds := map[string]int{"rule": 3, "parameterized rule": 3, "token": 21, "keyword": 14}
+	for _, sym := range idx.symbols {
+		if def, ok := idx.defs[sym.name]; ok && def == sym {
+			items = append(items, map[string]interface{}{"label": sym.name, "kind": kinds[sym.kind], "detail": sym.kind})
+		}
+	}
+	items = append(items, map[string]interface{}{"label": "list", "kind": 3, "detail": "built in"})
+	return items
+}
+
+func lspCommand(args []string) error {
+	flags := flag.NewFlagSet("lsp", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: llgen lsp\n\nRuns a language server for grammar files, speaking the Language Server Protocol over standard input and output.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	s := &lspServer{in: bufio.NewReader(os.Stdin), out: os.Stdout, open: make(map[string]string)}
+	return s.serve()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const lspGrammar = "token num ~ `[0-9]+`\n%start sum\nsum = term \"+\" term\nterm = num | group\ngroup = \"(\" sum \")\"\n"
+
+// TestLSP runs the language server over a scripted session and checks the
+// messages it answers with.
+func TestLSP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calc.llg")
+	uri := pathURI(path)
+	doc := map[string]interface{}{"uri": uri}
+	at := func(line, character int) map[string]interface{} {
+		return map[string]interface{}{"textDocument": doc, "position": map[string]int{"line": line, "character": character}}
+	}
+
+	var in bytes.Buffer
+	id := 0
+	send := func(method string, params interface{}, request bool) {
+		msg := map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params}
+		if request {
+			id++
+			msg["id"] = id
+		}
+		body, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&in, "Content-Length: %v\r\n\r\n%s", len(body), body)
+	}
+	send("initialize", map[string]interface{}{}, true)
+	send("initialized", map[string]interface{}{}, false)
+	send("textDocument/didOpen", map[string]interface{}{"textDocument": map[string]interface{}{
+		"uri": uri, "text": strings.Replace(lspGrammar, `sum ")"`, `summ ")"`, 1),
+	}}, false)
+	send("textDocument/didChange", map[string]interface{}{"textDocument": doc, "contentChanges": []map[string]string{{"text": lspGrammar}}}, false)
+	send("textDocument/definition", at(2, 7), true)
+	references := at(2, 7)
+	references["context"] = map[string]bool{"includeDeclaration": true}
+	send("textDocument/references", references, true)
+	send("textDocument/hover", at(2, 7), true)
+	rename := at(3, 0)
+	rename["newName"] = "operand"
+	send("textDocument/rename", rename, true)
+	send("textDocument/completion", at(4, 12), true)
+	send("textDocument/completion", at(1, 1), true)
+	send("shutdown", nil, true)
+	send("exit", nil, false)
+
+	var out bytes.Buffer
+	s := &lspServer{in: bufio.NewReader(&in), out: &out, open: make(map[string]string)}
+	if err := s.serve(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The answers are read back with the server's own framing.
+	r := &lspServer{in: bufio.NewReader(&out)}
+	var msgs []map[string]json.RawMessage
+	for {
+		body, err := r.read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		var msg map[string]json.RawMessage
+		if err := json.Unmarshal(body, &msg); err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+
+	rng := func(line, start, end int) string {
+		return fmt.Sprintf(`{"end":{"character":%v,"line":%v},"start":{"character":%v,"line":%v}}`, end, line, start, line)
+	}
+	loc := func(line, start, end int) string {
+		return fmt.Sprintf(`{"range":%s,"uri":%q}`, rng(line, start, end), uri)
+	}
+	diagnostics := func(list string) string {
+		return fmt.Sprintf(`{"diagnostics":[%s],"uri":%q}`, list, uri)
+	}
+	want := []struct {
+		method string // of a notification, or "" for the answer to the next request
+		json   string
+	}{
+		{"", ""}, // initialize, checked below
+		{"textDocument/publishDiagnostics", diagnostics(`{"message":"unknown identifier: summ","range":` + rng(4, 12, 13) + `,"severity":1,"source":"llgen"}`)},
+		{"textDocument/publishDiagnostics", diagnostics("")},
+		{"", loc(3, 0, 4)},
+		{"", "[" + loc(2, 6, 10) + "," + loc(2, 15, 19) + "," + loc(3, 0, 4) + "]"},
+		{"", ""}, // hover, checked below
+		{"", fmt.Sprintf(`{"changes":{%q:[{"newText":"operand","range":%s},{"newText":"operand","range":%s},{"newText":"operand","range":%s}]}}`,
+			uri, rng(2, 6, 10), rng(2, 15, 19), rng(3, 0, 4))},
+		{"", `[{"detail":"token","kind":21,"label":"num"},{"detail":"rule","kind":3,"label":"sum"},{"detail":"rule","kind":3,"label":"term"},{"detail":"rule","kind":3,"label":"group"},{"detail":"built in","kind":3,"label":"list"}]`},
+		{"", `[{"kind":14,"label":"start"},{"kind":14,"label":"type"},{"kind":14,"label":"state"},{"kind":14,"label":"indent"},{"kind":14,"label":"mode"},{"kind":14,"label":"header"},{"kind":14,"label":"import"}]`},
+		{"", "null"}, // shutdown
+	}
+	if len(msgs) != len(want) {
+		t.Fatalf("got %v messages, want %v", len(msgs), len(want))
+	}
+	id = 0
+	for i, w := range want {
+		msg := msgs[i]
+		if w.method != "" {
+			if got := string(msg["method"]); got != fmt.Sprintf("%q", w.method) {
+				t.Errorf("message %v: got method %s, want %q", i, got, w.method)
+			} else if got := canonical(t, msg["params"]); got != canonical(t, []byte(w.json)) {
+				t.Errorf("message %v: got %s, want %s", i, got, w.json)
+			}
+			continue
+		}
+		id++
+		if got := string(msg["id"]); got != fmt.Sprint(id) {
+			t.Errorf("message %v: got id %s, want %v", i, got, id)
+		}
+		if e, ok := msg["error"]; ok {
+			t.Errorf("message %v: error %s", i, e)
+		} else if got := canonical(t, msg["result"]); w.json != "" && got != canonical(t, []byte(w.json)) {
+			t.Errorf("message %v: got %s, want %s", i, got, w.json)
+		}
+	}
+
+	var initialize struct {
+		Capabilities struct {
+			DefinitionProvider bool `json:"definitionProvider"`
+			RenameProvider     bool `json:"renameProvider"`
+		} `json:"capabilities"`
+	}
+	if err := json.Unmarshal(msgs[0]["result"], &initialize); err != nil || !initialize.Capabilities.DefinitionProvider || !initialize.Capabilities.RenameProvider {
+		t.Errorf("initialize: got %s", msgs[0]["result"])
+	}
+	var hover struct {
+		Contents struct {
+			Value string `json:"value"`
+		} `json:"contents"`
+		Range lspRange `json:"range"`
+	}
+	if err := json.Unmarshal(msgs[5]["result"], &hover); err != nil {
+		t.Fatal(err)
+	}
+	if first := strings.SplitN(hover.Contents.Value, "\n", 2)[0]; first != "rule term" {
+		t.Errorf("hover: got first line %q, want %q", first, "rule term")
+	}
+	if !strings.Contains(hover.Contents.Value, "\nFIRST: ") {
+		t.Errorf("hover: got %q, want the FIRST tokens", hover.Contents.Value)
+	}
+}
+
+// canonical returns JSON with the keys of its objects sorted, to compare
+// messages whatever order the server writes their fields in.
+func canonical(t *testing.T, data []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
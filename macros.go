@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"github.com/allen-b1/llgen/parser"
+	"unicode"
+)
+
+// maxDepth limits how deeply calls of parameterized rules can be nested,
+// which stops rules that call themselves with growing arguments. The
+// commands that walk a grammar's calls stop at the same depth.
+const maxDepth = 10
+
+func (g *generator) declareMacro(n parser.NodeStatementMacro) error {
+	name := n.I0.Data
+	if name == "list" {
+		return fmt.Errorf("list is built in and cannot be redefined")
+	}
+	if _, ok := g.macros[name]; ok || g.symbols[name] != "" {
+		return fmt.Errorf("%s is already defined", name)
+	}
+	params := make(map[string]bool)
+	for _, param := range n.I2.Items {
+		if params[param.Data] {
+			return fmt.Errorf("%s: duplicate parameter %s", name, param.Data)
+		}
+		params[param.Data] = true
+	}
+	g.macros[name] = n
+	return nil
+}
+
+// goName returns the name a rule's node and parse function are based on.
+func (g *generator) goName(name string) string {
+	if goName, ok := g.goNames[name]; ok {
+		return goName
+	}
+	return transform(name)
+}
+
+// instantiate resolves a call of a parameterized rule. Each distinct call
+// becomes a rule of its own, named after the call, which is generated
+// along with the others.
+func (g *generator) instantiate(u parser.NodeUnitCall) (ref, error) {
+	name := u.I0.Data
+	desc := describeUnit(parser.NodeUnit{I: u})
+	m, ok := g.macros[name]
+	if !ok {
+		return ref{}, fmt.Errorf("unknown parameterized rule: %s", desc)
+	}
+	params, args := m.I2.Items, u.I2.Items
+	if len(args) != len(params) {
+		return ref{}, fmt.Errorf("%s: %s expects %v arguments, got %v", desc, name, len(params), len(args))
+	}
+
+	if g.symbols[desc] == "" {
+		if callDepth(parser.NodeUnit{I: u}) > maxDepth {
+			return ref{}, fmt.Errorf("%s: calls nested too deeply", name)
+		}
+
+		bindings := make(map[string]parser.NodeUnit)
+		for i, param := range params {
+			bindings[param.Data] = args[i]
+		}
+		expr, err := substExpr(m.I5, bindings)
+		if err != nil {
+			return ref{}, fmt.Errorf("%s: %v", desc, err)
+		}
+
+		g.symbols[desc] = "expr"
+		g.goNames[desc] = g.instanceName(name, args)
+		if typ, ok := g.types[name]; ok {
+			g.types[desc] = typ
+		}
+		g.instances = append(g.instances, parser.NodeStatementExpr{
+			I0: parser.Token{Type: "ident", Data: desc, Line: u.I0.Line, Col: u.I0.Col},
+			I1: m.I4,
+			I2: expr,
+			I3: m.I6,
+			I4: m.I7,
+		})
+	}
+	return ref{name: desc, typ: "Node" + g.goName(desc), parse: "p.parse" + g.goName(desc)}, nil
+}
+
+func callDepth(u parser.NodeUnit) int {
+	call, ok := u.I.(parser.NodeUnitCall)
+	if !ok {
+		return 0
+	}
+	depth := 0
+	for _, arg := range call.I2.Items {
+		if d := callDepth(arg); d > depth {
+			depth = d
+		}
+	}
+	return depth + 1
+}
+
+// instanceName returns a Go name for an instance of a parameterized rule,
+// made of the rule name and its arguments: bracketed(expr) is
+// Bracketed_Expr. A number is added if that is already taken.
+func (g *generator) instanceName(name string, args []parser.NodeUnit) string {
+	base := transform(name)
+	for _, arg := range args {
+		base += "_" + mangle(describeUnit(arg))
+	}
+	taken := make(map[string]bool)
+	for _, goName := range g.goNames {
+		taken[goName] = true
+	}
+	goName := base
+	for i := 2; taken[goName]; i++ {
+		goName = fmt.Sprintf("%s%v", base, i)
+	}
+	return goName
+}
+
+// mangle turns the description of a unit into an identifier by keeping its
+// letters and digits, capitalizing each word.
+func mangle(desc string) string {
+	str := ""
+	upper := true
+	for _, r := range desc {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		str += string(r)
+	}
+	if str == "" {
+		return "X"
+	}
+	return str
+}
+
+// substExpr replaces the parameters in the body of a parameterized rule
+// with their arguments.
+func substExpr(expr parser.NodeExpr, bindings map[string]parser.NodeUnit) (parser.NodeExpr, error) {
+	var err error
+	switch n := expr.I.(type) {
+	case parser.NodeExprOr:
+		if n.I0, err = substUnit(n.I0, bindings); err != nil {
+			return expr, err
+		}
+		if n.I2, err = substUnit(n.I2, bindings); err != nil {
+			return expr, err
+		}
+		ext := make([]parser.NodeExprOrExt, len(n.I3))
+		for i, e := range n.I3 {
+			if e.I1, err = substUnit(e.I1, bindings); err != nil {
+				return expr, err
+			}
+			ext[i] = e
+		}
+		n.I3 = ext
+		return parser.NodeExpr{I: n}, nil
+	case parser.NodeExprAnd:
+		units := make([]parser.NodeUnitEll, len(n.I0))
+		for i, u := range n.I0 {
+			if units[i], err = substUnitEll(u, bindings); err != nil {
+				return expr, err
+			}
+		}
+		n.I0 = units
+		return parser.NodeExpr{I: n}, nil
+	}
+	return expr, fmt.Errorf("invalid expression")
+}
+
+func substUnitEll(u parser.NodeUnitEll, bindings map[string]parser.NodeUnit) (parser.NodeUnitEll, error) {
+	var err error
+	switch n := u.I.(type) {
+	case parser.NodeUnit:
+		unit, err := substUnit(n, bindings)
+		return parser.NodeUnitEll{I: unit}, err
+	case parser.NodeUnitEllFull:
+		n.I0, err = substUnit(n.I0, bindings)
+		return parser.NodeUnitEll{I: n}, err
+	case parser.NodeUnitEllOpt:
+		n.I0, err = substUnit(n.I0, bindings)
+		return parser.NodeUnitEll{I: n}, err
+	case parser.NodeUnitLook:
+		n.I1, err = substUnit(n.I1, bindings)
+		return parser.NodeUnitEll{I: n}, err
+	}
+	return u, nil
+}
+
+func substUnit(u parser.NodeUnit, bindings map[string]parser.NodeUnit) (parser.NodeUnit, error) {
+	switch n := u.I.(type) {
+	case parser.Token:
+		if arg, ok := bindings[n.Data]; ok && n.Type == "ident" {
+			return arg, nil
+		}
+	case parser.NodeUnitToken:
+		arg, ok := bindings[n.I0.Data]
+		if !ok {
+			break
+		}
+		tok, ok := arg.I.(parser.Token)
+		if !ok || tok.Type != "ident" {
+			return u, fmt.Errorf("%s is tagged, so its argument must be a token", n.I0.Data)
+		}
+		n.I0.Data = tok.Data
+		return parser.NodeUnit{I: n}, nil
+	case parser.NodeUnitCall:
+		args := make([]parser.NodeUnit, len(n.I2.Items))
+		for i, arg := range n.I2.Items {
+			var err error
+			if args[i], err = substUnit(arg, bindings); err != nil {
+				return u, err
+			}
+		}
+		n.I2.Items = args
+		return parser.NodeUnit{I: n}, nil
+	}
+	return u, nil
+}
@@ -4,16 +4,19 @@ import (
 	"flag"
 	"fmt"
 	"github.com/allen-b1/llgen/parser"
-	"io/ioutil"
 	"os"
 	"reflect"
 	"strings"
 )
 
 var showTree bool
+var opts options
+var fuzzTest string
 
 func init() {
 	flag.BoolVar(&showTree, "tree", false, "whether to print tree or not")
+	flag.BoolVar(&opts.coverage, "coverage", false, "whether the parser counts what it matches, for llgen coverage")
+	flag.StringVar(&fuzzTest, "fuzz", "", "also write fuzz tests of the parser to `file`, which must end in _test.go, and a native fuzz target to the file named like it with _go118_test.go")
 }
 
 func print(n interface{}) string {
@@ -22,26 +25,66 @@ func print(n interface{}) string {
 	}
 
 	val := reflect.ValueOf(n)
+	if !val.IsValid() || val.Kind() == reflect.Ptr && val.IsNil() {
+		return "nil"
+	}
+	if val.Kind() == reflect.Ptr {
+		return print(val.Elem().Interface())
+	}
 	str := val.Type().Name()
 	if val.Type().Kind() == reflect.Slice {
 		str = "[]" + val.Type().Elem().Name()
 		for i := 0; i < val.Len(); i++ {
 			str += "\n\t" + fmt.Sprint(i) + ": " + strings.Replace(print(val.Index(i).Interface()), "\n", "\n\t", -1)
 		}
-	} else {
+	} else if val.Kind() == reflect.Struct {
 		for i := 0; i < val.Type().NumField(); i++ {
 			str += "\n\t" + val.Type().Field(i).Name + ": " + strings.Replace(print(val.Field(i).Interface()), "\n", "\n\t", -1)
 		}
+	} else {
+		return fmt.Sprint(n)
 	}
 	return str
 }
 
+// commands are run by llgen COMMAND, with the arguments after the command.
+var commands = map[string]func(args []string) error{
+	"coverage":    coverageCommand,
+	"diagram":     diagramCommand,
+	"export":      exportCommand,
+	"fmt":         fmtCommand,
+	"gen-samples": genSamplesCommand,
+	"graph":       graphCommand,
+	"import":      importCommand,
+	"lsp":         lspCommand,
+	"test":        testCommand,
+}
+
 func main() {
 	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "usage: llgen [FLAGS] FILE\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: llgen [FLAGS] FILE\n       llgen COMMAND [FLAGS] FILE\n\ncommands:\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  coverage\treport which rules and alternatives a corpus of inputs matches\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  diagram\twrite railroad diagrams of the rules as HTML\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  export\twrite the grammar as ISO EBNF, W3C EBNF or ABNF\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  fmt\tformat grammar files, like gofmt\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  gen-samples\twrite random sentences of a grammar, for tests and fuzzing\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  graph\twrite the graph of which rules use which as DOT\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  import\tconvert an ANTLR4, yacc or pigeon grammar into llgen syntax\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  lsp\trun a language server for grammar files over standard input and output\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  test\tcheck the trees or errors of golden files of inputs\n\nflags:\n")
 		flag.PrintDefaults()
 	}
 
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, "llgen:", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	flag.Parse()
 
 	if flag.Arg(0) == "" {
@@ -49,30 +92,27 @@ func main() {
 		os.Exit(1)
 	}
 
-	body, err := ioutil.ReadFile(flag.Arg(0))
+	a, files, err := loadGrammarOpen(flag.Arg(0), nil)
 	if err != nil {
-		panic(err)
-	}
-
-	tokens, err := tokenize(string(body))
-	if err != nil {
-		panic(err)
-	}
-
-	a, n, err := parser.ParseStatements(tokens)
-	if err != nil {
-		panic(err)
-	}
-	if n != len(tokens) {
-		panic("invalid document")
+		fmt.Fprintln(os.Stderr, "llgen:", err)
+		os.Exit(1)
 	}
 
 	if showTree {
 		fmt.Println(print(a))
 	} else {
-		res, err := generateAll(a)
+		opts.files = files
+		g := newGenerator(opts)
+		res, err := g.generateAll(a)
 		if err != nil {
-			panic(err)
+			fmt.Fprintln(os.Stderr, "llgen:", err)
+			os.Exit(1)
+		}
+		if fuzzTest != "" {
+			if err := writeFuzzTests(fuzzTest, a, g); err != nil {
+				fmt.Fprintln(os.Stderr, "llgen:", err)
+				os.Exit(1)
+			}
 		}
 
 		fmt.Println(res)
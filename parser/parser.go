@@ -3,36 +3,52 @@ package parser
 
 import (
 	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
 )
 
 type Error struct {
 	Message string
 	Line int
+	Col int // in runes, starting at 1, or 0 if unknown
+	// Cut is set for errors past a cut, which stop alternatives from being tried.
+	Cut bool
 }
 
 func (e Error) Error() string {
+	if e.Col != 0 {
+		return fmt.Sprintf("%s (%v:%v)", e.Message, e.Line, e.Col)
+	}
 	return fmt.Sprintf("%s (%v)", e.Message, e.Line)
 }
 
-func newError(msg string, line int) error {
-	if line == 0 {
-		msg += ": unexpected EOF"
+// newError returns an error at tok, or at the end of input if tok is nil.
+func newError(msg string, tok *Token) error {
+	if tok == nil {
+		return Error{Message: msg + ": unexpected EOF"}
 	}
-	return Error{msg, line}
+	return Error{Message: msg, Line: tok.Line, Col: tok.Col}
 }
 
-func getLineOr0(tokens []Token, index int) int {
-	if len(tokens) > index {
-		return tokens[index].Line
+func cut(err error) error {
+	if e, ok := err.(Error); ok {
+		e.Cut = true
+		return e
 	}
-	return 0
+	return Error{Message: err.Error(), Cut: true}
+}
+
+func isCut(err error) bool {
+	e, ok := err.(Error)
+	return ok && e.Cut
 }
 
 func wrap(err error, msg string) error {
 	if e, ok := err.(Error); ok {
-		return Error{msg + ": " + e.Message, e.Line}
+		return Error{Message: msg + ": " + e.Message, Line: e.Line, Col: e.Col, Cut: e.Cut}
 	} else {
-		return Error{msg + ": " + err.Error(), 0}
+		return Error{Message: msg + ": " + err.Error()}
 	}
 }
 
@@ -40,22 +56,141 @@ type Token struct {
 	Type string
 	Data string
 	Line int
+	Col int
+}
+
+// TokenSource produces tokens on demand. Next returns false at the end of
+// input.
+type TokenSource interface {
+	Next() (Token, bool, error)
+}
+
+type sliceSource struct {
+	tokens []Token
+}
+
+func (s *sliceSource) Next() (Token, bool, error) {
+	if len(s.tokens) == 0 {
+		return Token{}, false, nil
+	}
+	tok := s.tokens[0]
+	s.tokens = s.tokens[1:]
+	return tok, true, nil
+}
+
+// Parser holds the state of a parse. State is for use by predicates.
+//
+// Tokens are pulled from the source as the parser needs them and kept in a
+// buffer until no alternative, optional or repetition that could backtrack
+// over them is still being tried.
+type Parser struct {
+	State interface{}
+	src TokenSource
+	buf []Token // tokens from position base on
+	base int
+	done bool // whether src is exhausted
+	err error // error from src
+	marks []int // positions the parser may backtrack to, oldest first
+	lookahead int
+}
+
+func (p *Parser) reset(src TokenSource) {
+	*p = Parser{State: p.State, src: src}
+}
+
+// at returns the token at pos, or nil past the end of input.
+func (p *Parser) at(pos int) *Token {
+	for !p.done && pos >= p.base+len(p.buf) {
+		tok, ok, err := p.src.Next()
+		if err != nil {
+			p.err = err
+		}
+		if !ok || err != nil {
+			p.done = true
+			break
+		}
+		p.buf = append(p.buf, tok)
+	}
+	if pos >= p.base+len(p.buf) {
+		return nil
+	}
+	return &p.buf[pos-p.base]
+}
+
+func (p *Parser) mark(pos int) {
+	p.marks = append(p.marks, pos)
+}
+
+func (p *Parser) unmark() {
+	pos := p.marks[len(p.marks)-1]
+	p.marks = p.marks[:len(p.marks)-1]
+	p.release(pos)
+}
+
+// advance moves the newest mark forward once a repetition has matched again.
+func (p *Parser) advance(pos int) {
+	p.marks[len(p.marks)-1] = pos
+	p.release(pos)
+}
+
+// release drops the buffered tokens before pos that no mark still needs.
+func (p *Parser) release(pos int) {
+	if len(p.marks) != 0 && p.marks[0] < pos {
+		pos = p.marks[0]
+	}
+	if n := pos - p.base; n > 0 {
+		p.buf = p.buf[n:]
+		p.base = pos
+	}
+}
+
+// Peek returns the ith token after the current position, for use by
+// predicates. Past the end of input it returns an empty Token.
+func (p *Parser) Peek(i int) Token {
+	if tok := p.at(p.lookahead + i); tok != nil {
+		return *tok
+	}
+	return Token{}
 }
 
 type NodeUnit struct {
 	I interface{}
 }
 
-func ParseUnit(in []Token) (NodeUnit, int, error) {
-	if node, curr, err := ParseUnitToken(in); err == nil {
-		return NodeUnit{node}, curr, nil
+func (p *Parser) parseUnit(start int) (NodeUnit, int, error) {
+	p.mark(start)
+	defer p.unmark()
+	if node, n, err := p.parseUnitCall(start); err == nil {
+		return NodeUnit{node}, n, nil
+	} else if isCut(err) {
+		return NodeUnit{nil}, 0, wrap(err, "failed to parse unit")
+	}
+		
+	if node, n, err := p.parseUnitToken(start); err == nil {
+		return NodeUnit{node}, n, nil
+	} else if isCut(err) {
+		return NodeUnit{nil}, 0, wrap(err, "failed to parse unit")
 	}
 		
-	if len(in) != 0 && in[0].Type == "ident" {
-		return NodeUnit{in[0]}, 1, nil
+	if p.at(start) != nil && p.at(start).Type == "ident" {
+		return NodeUnit{*p.at(start)}, 1, nil
 	}
 
-	return NodeUnit{nil}, 0, newError("failed to parse unit", getLineOr0(in, 0))
+	if p.at(start) != nil && p.at(start).Type == "dot" {
+		return NodeUnit{*p.at(start)}, 1, nil
+	}
+
+	if p.at(start) != nil && p.at(start).Type == "string" {
+		return NodeUnit{*p.at(start)}, 1, nil
+	}
+
+	return NodeUnit{nil}, 0, newError("failed to parse unit", p.at(start))
+}
+
+// ParseUnit parses a prefix of in, returning the number of tokens used.
+func (p *Parser) ParseUnit(in []Token) (NodeUnit, int, error) {
+	p.reset(&sliceSource{tokens: in})
+	return p.parseUnit(0)
 }
 
 type NodeUnitToken struct {
@@ -66,55 +201,144 @@ type NodeUnitToken struct {
 
 }
 
-func ParseUnitToken(in []Token) (NodeUnitToken, int, error) {
+func (p *Parser) parseUnitToken(start int) (NodeUnitToken, int, error) {
 	var out NodeUnitToken
-	curr := 0
+	curr := start
 
-	if len(in) <= curr || in[curr].Type != "ident" {
-		return NodeUnitToken{}, 0, newError("failed to parse unit-token: ident expected", getLineOr0(in, curr))
+	if p.at(curr) == nil || p.at(curr).Type != "ident" {
+		return NodeUnitToken{}, 0, newError("failed to parse unit-token: ident expected", p.at(curr))
 	}
-	out.I0 = in[curr]
+	out.I0 = *p.at(curr)
 	curr++
+	p.release(curr)
 	
-	if len(in) <= curr || in[curr].Type != "al" {
-		return NodeUnitToken{}, 0, newError("failed to parse unit-token: al expected", getLineOr0(in, curr))
+	if p.at(curr) == nil || p.at(curr).Type != "al" {
+		return NodeUnitToken{}, 0, newError("failed to parse unit-token: al expected", p.at(curr))
 	}
-	out.I1 = in[curr]
+	out.I1 = *p.at(curr)
 	curr++
+	p.release(curr)
 	
-	if len(in) <= curr || in[curr].Type != "string" {
-		return NodeUnitToken{}, 0, newError("failed to parse unit-token: string expected", getLineOr0(in, curr))
+	if p.at(curr) == nil || p.at(curr).Type != "string" {
+		return NodeUnitToken{}, 0, cut(newError("failed to parse unit-token: string expected", p.at(curr)))
 	}
-	out.I2 = in[curr]
+	out.I2 = *p.at(curr)
 	curr++
+	p.release(curr)
 	
-	if len(in) <= curr || in[curr].Type != "ar" {
-		return NodeUnitToken{}, 0, newError("failed to parse unit-token: ar expected", getLineOr0(in, curr))
+	if p.at(curr) == nil || p.at(curr).Type != "ar" {
+		return NodeUnitToken{}, 0, cut(newError("failed to parse unit-token: ar expected", p.at(curr)))
 	}
-	out.I3 = in[curr]
+	out.I3 = *p.at(curr)
 	curr++
+	p.release(curr)
 	
-	return out, curr, nil
+	return out, curr - start, nil
+}
+
+// ParseUnitToken parses a prefix of in, returning the number of tokens used.
+func (p *Parser) ParseUnitToken(in []Token) (NodeUnitToken, int, error) {
+	p.reset(&sliceSource{tokens: in})
+	return p.parseUnitToken(0)
+}
+
+type NodeUnitCall struct {
+	I0 Token // ident
+	I1 Token // lparen
+	I2 ListOfNodeUnit
+	I3 Token // rparen
+
+}
+
+func (p *Parser) parseUnitCall(start int) (NodeUnitCall, int, error) {
+	var out NodeUnitCall
+	curr := start
+
+	if p.at(curr) == nil || p.at(curr).Type != "ident" {
+		return NodeUnitCall{}, 0, newError("failed to parse unit-call: ident expected", p.at(curr))
+	}
+	out.I0 = *p.at(curr)
+	curr++
+	p.release(curr)
+	
+	if p.at(curr) == nil || p.at(curr).Type != "lparen" {
+		return NodeUnitCall{}, 0, newError("failed to parse unit-call: lparen expected", p.at(curr))
+	}
+	out.I1 = *p.at(curr)
+	curr++
+	p.release(curr)
+	
+	node2, currChange, err := p.parseList0(curr)
+	if err != nil {
+		return NodeUnitCall{}, 0, cut(wrap(err, "failed to parse unit-call"))
+	}
+	out.I2 = node2
+	curr += currChange
+				
+	if p.at(curr) == nil || p.at(curr).Type != "rparen" {
+		return NodeUnitCall{}, 0, cut(newError("failed to parse unit-call: rparen expected", p.at(curr)))
+	}
+	out.I3 = *p.at(curr)
+	curr++
+	p.release(curr)
+	
+	return out, curr - start, nil
+}
+
+// ParseUnitCall parses a prefix of in, returning the number of tokens used.
+func (p *Parser) ParseUnitCall(in []Token) (NodeUnitCall, int, error) {
+	p.reset(&sliceSource{tokens: in})
+	return p.parseUnitCall(0)
 }
 
 type NodeUnitEll struct {
 	I interface{}
 }
 
-func ParseUnitEll(in []Token) (NodeUnitEll, int, error) {
-	if node, curr, err := ParseUnitEllFull(in); err == nil {
-		return NodeUnitEll{node}, curr, nil
+func (p *Parser) parseUnitEll(start int) (NodeUnitEll, int, error) {
+	p.mark(start)
+	defer p.unmark()
+	if node, n, err := p.parseUnitEllFull(start); err == nil {
+		return NodeUnitEll{node}, n, nil
+	} else if isCut(err) {
+		return NodeUnitEll{nil}, 0, wrap(err, "failed to parse unit-ell")
+	}
+		
+	if node, n, err := p.parseUnitEllOpt(start); err == nil {
+		return NodeUnitEll{node}, n, nil
+	} else if isCut(err) {
+		return NodeUnitEll{nil}, 0, wrap(err, "failed to parse unit-ell")
 	}
 		
-	if node, curr, err := ParseUnitEllOpt(in); err == nil {
-		return NodeUnitEll{node}, curr, nil
+	if node, n, err := p.parseUnitPred(start); err == nil {
+		return NodeUnitEll{node}, n, nil
+	} else if isCut(err) {
+		return NodeUnitEll{nil}, 0, wrap(err, "failed to parse unit-ell")
 	}
 		
-	if node, curr, err := ParseUnit(in); err == nil {
-		return NodeUnitEll{node}, curr, nil
+	if node, n, err := p.parseUnitLook(start); err == nil {
+		return NodeUnitEll{node}, n, nil
+	} else if isCut(err) {
+		return NodeUnitEll{nil}, 0, wrap(err, "failed to parse unit-ell")
 	}
 		
-	return NodeUnitEll{nil}, 0, newError("failed to parse unit-ell", getLineOr0(in, 0))
+	if node, n, err := p.parseUnit(start); err == nil {
+		return NodeUnitEll{node}, n, nil
+	} else if isCut(err) {
+		return NodeUnitEll{nil}, 0, wrap(err, "failed to parse unit-ell")
+	}
+		
+	if p.at(start) != nil && p.at(start).Type == "cut" {
+		return NodeUnitEll{*p.at(start)}, 1, nil
+	}
+
+	return NodeUnitEll{nil}, 0, newError("failed to parse unit-ell", p.at(start))
+}
+
+// ParseUnitEll parses a prefix of in, returning the number of tokens used.
+func (p *Parser) ParseUnitEll(in []Token) (NodeUnitEll, int, error) {
+	p.reset(&sliceSource{tokens: in})
+	return p.parseUnitEll(0)
 }
 
 type NodeUnitEllFull struct {
@@ -123,24 +347,31 @@ type NodeUnitEllFull struct {
 
 }
 
-func ParseUnitEllFull(in []Token) (NodeUnitEllFull, int, error) {
+func (p *Parser) parseUnitEllFull(start int) (NodeUnitEllFull, int, error) {
 	var out NodeUnitEllFull
-	curr := 0
+	curr := start
 
-	node0, currChange, err := ParseUnit(in[curr:])
+	node0, currChange, err := p.parseUnit(curr)
 	if err != nil {
 		return NodeUnitEllFull{}, 0, wrap(err, "failed to parse unit-ell-full")
 	}
 	out.I0 = node0
 	curr += currChange
 				
-	if len(in) <= curr || in[curr].Type != "ell" {
-		return NodeUnitEllFull{}, 0, newError("failed to parse unit-ell-full: ell expected", getLineOr0(in, curr))
+	if p.at(curr) == nil || p.at(curr).Type != "ell" {
+		return NodeUnitEllFull{}, 0, newError("failed to parse unit-ell-full: ell expected", p.at(curr))
 	}
-	out.I1 = in[curr]
+	out.I1 = *p.at(curr)
 	curr++
+	p.release(curr)
 	
-	return out, curr, nil
+	return out, curr - start, nil
+}
+
+// ParseUnitEllFull parses a prefix of in, returning the number of tokens used.
+func (p *Parser) ParseUnitEllFull(in []Token) (NodeUnitEllFull, int, error) {
+	p.reset(&sliceSource{tokens: in})
+	return p.parseUnitEllFull(0)
 }
 
 type NodeUnitEllOpt struct {
@@ -149,24 +380,121 @@ type NodeUnitEllOpt struct {
 
 }
 
-func ParseUnitEllOpt(in []Token) (NodeUnitEllOpt, int, error) {
+func (p *Parser) parseUnitEllOpt(start int) (NodeUnitEllOpt, int, error) {
 	var out NodeUnitEllOpt
-	curr := 0
+	curr := start
 
-	node0, currChange, err := ParseUnit(in[curr:])
+	node0, currChange, err := p.parseUnit(curr)
 	if err != nil {
 		return NodeUnitEllOpt{}, 0, wrap(err, "failed to parse unit-ell-opt")
 	}
 	out.I0 = node0
 	curr += currChange
 				
-	if len(in) <= curr || in[curr].Type != "opt" {
-		return NodeUnitEllOpt{}, 0, newError("failed to parse unit-ell-opt: opt expected", getLineOr0(in, curr))
+	if p.at(curr) == nil || p.at(curr).Type != "opt" {
+		return NodeUnitEllOpt{}, 0, newError("failed to parse unit-ell-opt: opt expected", p.at(curr))
 	}
-	out.I1 = in[curr]
+	out.I1 = *p.at(curr)
 	curr++
+	p.release(curr)
 	
-	return out, curr, nil
+	return out, curr - start, nil
+}
+
+// ParseUnitEllOpt parses a prefix of in, returning the number of tokens used.
+func (p *Parser) ParseUnitEllOpt(in []Token) (NodeUnitEllOpt, int, error) {
+	p.reset(&sliceSource{tokens: in})
+	return p.parseUnitEllOpt(0)
+}
+
+type NodeUnitLook struct {
+	I0 NodeLook
+	I1 NodeUnit
+
+}
+
+func (p *Parser) parseUnitLook(start int) (NodeUnitLook, int, error) {
+	var out NodeUnitLook
+	curr := start
+
+	node0, currChange, err := p.parseLook(curr)
+	if err != nil {
+		return NodeUnitLook{}, 0, wrap(err, "failed to parse unit-look")
+	}
+	out.I0 = node0
+	curr += currChange
+				
+	node1, currChange, err := p.parseUnit(curr)
+	if err != nil {
+		return NodeUnitLook{}, 0, wrap(err, "failed to parse unit-look")
+	}
+	out.I1 = node1
+	curr += currChange
+				
+	return out, curr - start, nil
+}
+
+// ParseUnitLook parses a prefix of in, returning the number of tokens used.
+func (p *Parser) ParseUnitLook(in []Token) (NodeUnitLook, int, error) {
+	p.reset(&sliceSource{tokens: in})
+	return p.parseUnitLook(0)
+}
+
+type NodeUnitPred struct {
+	I0 NodeLook
+	I1 Token // action
+
+}
+
+func (p *Parser) parseUnitPred(start int) (NodeUnitPred, int, error) {
+	var out NodeUnitPred
+	curr := start
+
+	node0, currChange, err := p.parseLook(curr)
+	if err != nil {
+		return NodeUnitPred{}, 0, wrap(err, "failed to parse unit-pred")
+	}
+	out.I0 = node0
+	curr += currChange
+				
+	if p.at(curr) == nil || p.at(curr).Type != "action" {
+		return NodeUnitPred{}, 0, newError("failed to parse unit-pred: action expected", p.at(curr))
+	}
+	out.I1 = *p.at(curr)
+	curr++
+	p.release(curr)
+	
+	return out, curr - start, nil
+}
+
+// ParseUnitPred parses a prefix of in, returning the number of tokens used.
+func (p *Parser) ParseUnitPred(in []Token) (NodeUnitPred, int, error) {
+	p.reset(&sliceSource{tokens: in})
+	return p.parseUnitPred(0)
+}
+
+type NodeLook struct {
+	I interface{}
+}
+
+func (p *Parser) parseLook(start int) (NodeLook, int, error) {
+	p.mark(start)
+	defer p.unmark()
+	if p.at(start) != nil && p.at(start).Type == "amp" {
+		return NodeLook{*p.at(start)}, 1, nil
+	}
+
+	if p.at(start) != nil && p.at(start).Type == "bang" {
+		return NodeLook{*p.at(start)}, 1, nil
+	}
+
+	return NodeLook{nil}, 0, newError("failed to parse look", p.at(start))
+}
+
+// ParseLook parses a prefix of in, returning the number of tokens used.
+func (p *Parser) ParseLook(in []Token) (NodeLook, int, error) {
+	p.reset(&sliceSource{tokens: in})
+	return p.parseLook(0)
 }
 
 type NodeExprAnd struct {
@@ -174,20 +502,36 @@ type NodeExprAnd struct {
 
 }
 
-func ParseExprAnd(in []Token) (NodeExprAnd, int, error) {
+func (p *Parser) parseExprAnd(start int) (NodeExprAnd, int, error) {
 	var out NodeExprAnd
-	curr := 0
+	curr := start
 
+	p.mark(curr)
 	for {
-		node0, currChange, err := ParseUnitEll(in[curr:])
+		node0, currChange, err := p.parseUnitEll(curr)
 		if err != nil {
+			if isCut(err) {
+				p.unmark()
+				return NodeExprAnd{}, 0, wrap(err, "failed to parse expr-and")
+			}
+			break
+		}
+		if currChange == 0 {
 			break
 		}
 		out.I0 = append(out.I0, node0)
 		curr += currChange
+		p.advance(curr)
 				
 	}
-	return out, curr, nil
+	p.unmark()
+	return out, curr - start, nil
+}
+
+// ParseExprAnd parses a prefix of in, returning the number of tokens used.
+func (p *Parser) ParseExprAnd(in []Token) (NodeExprAnd, int, error) {
+	p.reset(&sliceSource{tokens: in})
+	return p.parseExprAnd(0)
 }
 
 type NodeExprOr struct {
@@ -198,40 +542,57 @@ type NodeExprOr struct {
 
 }
 
-func ParseExprOr(in []Token) (NodeExprOr, int, error) {
+func (p *Parser) parseExprOr(start int) (NodeExprOr, int, error) {
 	var out NodeExprOr
-	curr := 0
+	curr := start
 
-	node0, currChange, err := ParseUnit(in[curr:])
+	node0, currChange, err := p.parseUnit(curr)
 	if err != nil {
 		return NodeExprOr{}, 0, wrap(err, "failed to parse expr-or")
 	}
 	out.I0 = node0
 	curr += currChange
 				
-	if len(in) <= curr || in[curr].Type != "or" {
-		return NodeExprOr{}, 0, newError("failed to parse expr-or: or expected", getLineOr0(in, curr))
+	if p.at(curr) == nil || p.at(curr).Type != "or" {
+		return NodeExprOr{}, 0, newError("failed to parse expr-or: or expected", p.at(curr))
 	}
-	out.I1 = in[curr]
+	out.I1 = *p.at(curr)
 	curr++
+	p.release(curr)
 	
-	node2, currChange, err := ParseUnit(in[curr:])
+	node2, currChange, err := p.parseUnit(curr)
 	if err != nil {
 		return NodeExprOr{}, 0, wrap(err, "failed to parse expr-or")
 	}
 	out.I2 = node2
 	curr += currChange
 				
+	p.mark(curr)
 	for {
-		node3, currChange, err := ParseExprOrExt(in[curr:])
+		node3, currChange, err := p.parseExprOrExt(curr)
 		if err != nil {
+			if isCut(err) {
+				p.unmark()
+				return NodeExprOr{}, 0, wrap(err, "failed to parse expr-or")
+			}
+			break
+		}
+		if currChange == 0 {
 			break
 		}
 		out.I3 = append(out.I3, node3)
 		curr += currChange
+		p.advance(curr)
 				
 	}
-	return out, curr, nil
+	p.unmark()
+	return out, curr - start, nil
+}
+
+// ParseExprOr parses a prefix of in, returning the number of tokens used.
+func (p *Parser) ParseExprOr(in []Token) (NodeExprOr, int, error) {
+	p.reset(&sliceSource{tokens: in})
+	return p.parseExprOr(0)
 }
 
 type NodeExprOrExt struct {
@@ -240,119 +601,288 @@ type NodeExprOrExt struct {
 
 }
 
-func ParseExprOrExt(in []Token) (NodeExprOrExt, int, error) {
+func (p *Parser) parseExprOrExt(start int) (NodeExprOrExt, int, error) {
 	var out NodeExprOrExt
-	curr := 0
+	curr := start
 
-	if len(in) <= curr || in[curr].Type != "or" {
-		return NodeExprOrExt{}, 0, newError("failed to parse expr-or-ext: or expected", getLineOr0(in, curr))
+	if p.at(curr) == nil || p.at(curr).Type != "or" {
+		return NodeExprOrExt{}, 0, newError("failed to parse expr-or-ext: or expected", p.at(curr))
 	}
-	out.I0 = in[curr]
+	out.I0 = *p.at(curr)
 	curr++
+	p.release(curr)
 	
-	node1, currChange, err := ParseUnit(in[curr:])
+	node1, currChange, err := p.parseUnit(curr)
 	if err != nil {
 		return NodeExprOrExt{}, 0, wrap(err, "failed to parse expr-or-ext")
 	}
 	out.I1 = node1
 	curr += currChange
 				
-	return out, curr, nil
+	return out, curr - start, nil
+}
+
+// ParseExprOrExt parses a prefix of in, returning the number of tokens used.
+func (p *Parser) ParseExprOrExt(in []Token) (NodeExprOrExt, int, error) {
+	p.reset(&sliceSource{tokens: in})
+	return p.parseExprOrExt(0)
 }
 
 type NodeExpr struct {
 	I interface{}
 }
 
-func ParseExpr(in []Token) (NodeExpr, int, error) {
-	if node, curr, err := ParseExprOr(in); err == nil {
-		return NodeExpr{node}, curr, nil
+func (p *Parser) parseExpr(start int) (NodeExpr, int, error) {
+	p.mark(start)
+	defer p.unmark()
+	if node, n, err := p.parseExprOr(start); err == nil {
+		return NodeExpr{node}, n, nil
+	} else if isCut(err) {
+		return NodeExpr{nil}, 0, wrap(err, "failed to parse expr")
 	}
 		
-	if node, curr, err := ParseExprAnd(in); err == nil {
-		return NodeExpr{node}, curr, nil
+	if node, n, err := p.parseExprAnd(start); err == nil {
+		return NodeExpr{node}, n, nil
+	} else if isCut(err) {
+		return NodeExpr{nil}, 0, wrap(err, "failed to parse expr")
 	}
 		
-	return NodeExpr{nil}, 0, newError("failed to parse expr", getLineOr0(in, 0))
+	return NodeExpr{nil}, 0, newError("failed to parse expr", p.at(start))
+}
+
+// ParseExpr parses a prefix of in, returning the number of tokens used.
+func (p *Parser) ParseExpr(in []Token) (NodeExpr, int, error) {
+	p.reset(&sliceSource{tokens: in})
+	return p.parseExpr(0)
+}
+
+type NodeStatementMacro struct {
+	I0 Token // ident
+	I1 Token // lparen
+	I2 ListOfToken
+	I3 Token // rparen
+	I4 Token // eq
+	I5 NodeExpr
+	I6 *Token // action
+	I7 Token // newline
+
+}
+
+func (p *Parser) parseStatementMacro(start int) (NodeStatementMacro, int, error) {
+	var out NodeStatementMacro
+	curr := start
+
+	if p.at(curr) == nil || p.at(curr).Type != "ident" {
+		return NodeStatementMacro{}, 0, newError("failed to parse statement-macro: ident expected", p.at(curr))
+	}
+	out.I0 = *p.at(curr)
+	curr++
+	p.release(curr)
+	
+	if p.at(curr) == nil || p.at(curr).Type != "lparen" {
+		return NodeStatementMacro{}, 0, newError("failed to parse statement-macro: lparen expected", p.at(curr))
+	}
+	out.I1 = *p.at(curr)
+	curr++
+	p.release(curr)
+	
+	node2, currChange, err := p.parseList1(curr)
+	if err != nil {
+		return NodeStatementMacro{}, 0, cut(wrap(err, "failed to parse statement-macro"))
+	}
+	out.I2 = node2
+	curr += currChange
+				
+	if p.at(curr) == nil || p.at(curr).Type != "rparen" {
+		return NodeStatementMacro{}, 0, cut(newError("failed to parse statement-macro: rparen expected", p.at(curr)))
+	}
+	out.I3 = *p.at(curr)
+	curr++
+	p.release(curr)
+	
+	if p.at(curr) == nil || p.at(curr).Type != "eq" {
+		return NodeStatementMacro{}, 0, cut(newError("failed to parse statement-macro: eq expected", p.at(curr)))
+	}
+	out.I4 = *p.at(curr)
+	curr++
+	p.release(curr)
+	
+	node5, currChange, err := p.parseExpr(curr)
+	if err != nil {
+		return NodeStatementMacro{}, 0, cut(wrap(err, "failed to parse statement-macro"))
+	}
+	out.I5 = node5
+	curr += currChange
+				
+	if p.at(curr) != nil && p.at(curr).Type == "action" {
+		tok := *p.at(curr)
+		out.I6 = &tok
+		curr++
+		p.release(curr)
+	}
+	
+	if p.at(curr) == nil || p.at(curr).Type != "newline" {
+		return NodeStatementMacro{}, 0, cut(newError("failed to parse statement-macro: newline expected", p.at(curr)))
+	}
+	out.I7 = *p.at(curr)
+	curr++
+	p.release(curr)
+	
+	return out, curr - start, nil
+}
+
+// ParseStatementMacro parses a prefix of in, returning the number of tokens used.
+func (p *Parser) ParseStatementMacro(in []Token) (NodeStatementMacro, int, error) {
+	p.reset(&sliceSource{tokens: in})
+	return p.parseStatementMacro(0)
 }
 
 type NodeStatementExpr struct {
 	I0 Token // ident
 	I1 Token // eq
 	I2 NodeExpr
-	I3 Token // newline
+	I3 *Token // action
+	I4 Token // newline
 
 }
 
-func ParseStatementExpr(in []Token) (NodeStatementExpr, int, error) {
+func (p *Parser) parseStatementExpr(start int) (NodeStatementExpr, int, error) {
 	var out NodeStatementExpr
-	curr := 0
+	curr := start
 
-	if len(in) <= curr || in[curr].Type != "ident" {
-		return NodeStatementExpr{}, 0, newError("failed to parse statement-expr: ident expected", getLineOr0(in, curr))
+	if p.at(curr) == nil || p.at(curr).Type != "ident" {
+		return NodeStatementExpr{}, 0, newError("failed to parse statement-expr: ident expected", p.at(curr))
 	}
-	out.I0 = in[curr]
+	out.I0 = *p.at(curr)
 	curr++
+	p.release(curr)
 	
-	if len(in) <= curr || in[curr].Type != "eq" {
-		return NodeStatementExpr{}, 0, newError("failed to parse statement-expr: eq expected", getLineOr0(in, curr))
+	if p.at(curr) == nil || p.at(curr).Type != "eq" {
+		return NodeStatementExpr{}, 0, newError("failed to parse statement-expr: eq expected", p.at(curr))
 	}
-	out.I1 = in[curr]
+	out.I1 = *p.at(curr)
 	curr++
+	p.release(curr)
 	
-	node2, currChange, err := ParseExpr(in[curr:])
+	node2, currChange, err := p.parseExpr(curr)
 	if err != nil {
-		return NodeStatementExpr{}, 0, wrap(err, "failed to parse statement-expr")
+		return NodeStatementExpr{}, 0, cut(wrap(err, "failed to parse statement-expr"))
 	}
 	out.I2 = node2
 	curr += currChange
 				
-	if len(in) <= curr || in[curr].Type != "newline" {
-		return NodeStatementExpr{}, 0, newError("failed to parse statement-expr: newline expected", getLineOr0(in, curr))
+	if p.at(curr) != nil && p.at(curr).Type == "action" {
+		tok := *p.at(curr)
+		out.I3 = &tok
+		curr++
+		p.release(curr)
+	}
+	
+	if p.at(curr) == nil || p.at(curr).Type != "newline" {
+		return NodeStatementExpr{}, 0, cut(newError("failed to parse statement-expr: newline expected", p.at(curr)))
 	}
-	out.I3 = in[curr]
+	out.I4 = *p.at(curr)
 	curr++
+	p.release(curr)
 	
-	return out, curr, nil
+	return out, curr - start, nil
+}
+
+// ParseStatementExpr parses a prefix of in, returning the number of tokens used.
+func (p *Parser) ParseStatementExpr(in []Token) (NodeStatementExpr, int, error) {
+	p.reset(&sliceSource{tokens: in})
+	return p.parseStatementExpr(0)
 }
 
 type NodeStatementToken struct {
-	I0 Token // ident
+	I0 Token // kw-token
 	I1 Token // ident
-	I2 *NodeStatementTokenAnnotation
-	I3 Token // newline
+	I2 *NodeStatementTokenDef
+	I3 *NodeTokenMode
+	I4 Token // newline
 
 }
 
-func ParseStatementToken(in []Token) (NodeStatementToken, int, error) {
+func (p *Parser) parseStatementToken(start int) (NodeStatementToken, int, error) {
 	var out NodeStatementToken
-	curr := 0
+	curr := start
 
-	if len(in) <= curr || in[curr].Type != "ident" || in[curr].Data != "token" {
-		return NodeStatementToken{}, 0, newError("failed to parse statement-token: ident expected", getLineOr0(in, curr))
+	if p.at(curr) == nil || p.at(curr).Type != "kw-token" {
+		return NodeStatementToken{}, 0, newError("failed to parse statement-token: \"token\" expected", p.at(curr))
 	}
-	out.I0 = in[curr]
+	out.I0 = *p.at(curr)
 	curr++
+	p.release(curr)
 	
-	if len(in) <= curr || in[curr].Type != "ident" {
-		return NodeStatementToken{}, 0, newError("failed to parse statement-token: ident expected", getLineOr0(in, curr))
+	if p.at(curr) == nil || p.at(curr).Type != "ident" {
+		return NodeStatementToken{}, 0, cut(newError("failed to parse statement-token: ident expected", p.at(curr)))
 	}
-	out.I1 = in[curr]
+	out.I1 = *p.at(curr)
 	curr++
+	p.release(curr)
 	
-	node2, currChange, err := ParseStatementTokenAnnotation(in[curr:])
+	p.mark(curr)
+	node2, currChange, err := p.parseStatementTokenDef(curr)
+	p.unmark()
 	if err == nil {
 		out.I2 = &node2
 		curr += currChange
+	} else if isCut(err) {
+		return NodeStatementToken{}, 0, wrap(err, "failed to parse statement-token")
+	}
+				
+	p.mark(curr)
+	node3, currChange, err := p.parseTokenMode(curr)
+	p.unmark()
+	if err == nil {
+		out.I3 = &node3
+		curr += currChange
+	} else if isCut(err) {
+		return NodeStatementToken{}, 0, wrap(err, "failed to parse statement-token")
 	}
 				
-	if len(in) <= curr || in[curr].Type != "newline" {
-		return NodeStatementToken{}, 0, newError("failed to parse statement-token: newline expected", getLineOr0(in, curr))
+	if p.at(curr) == nil || p.at(curr).Type != "newline" {
+		return NodeStatementToken{}, 0, cut(newError("failed to parse statement-token: newline expected", p.at(curr)))
 	}
-	out.I3 = in[curr]
+	out.I4 = *p.at(curr)
 	curr++
+	p.release(curr)
 	
-	return out, curr, nil
+	return out, curr - start, nil
+}
+
+// ParseStatementToken parses a prefix of in, returning the number of tokens used.
+func (p *Parser) ParseStatementToken(in []Token) (NodeStatementToken, int, error) {
+	p.reset(&sliceSource{tokens: in})
+	return p.parseStatementToken(0)
+}
+
+type NodeStatementTokenDef struct {
+	I interface{}
+}
+
+func (p *Parser) parseStatementTokenDef(start int) (NodeStatementTokenDef, int, error) {
+	p.mark(start)
+	defer p.unmark()
+	if node, n, err := p.parseStatementTokenAnnotation(start); err == nil {
+		return NodeStatementTokenDef{node}, n, nil
+	} else if isCut(err) {
+		return NodeStatementTokenDef{nil}, 0, wrap(err, "failed to parse statement-token-def")
+	}
+		
+	if node, n, err := p.parseStatementTokenPattern(start); err == nil {
+		return NodeStatementTokenDef{node}, n, nil
+	} else if isCut(err) {
+		return NodeStatementTokenDef{nil}, 0, wrap(err, "failed to parse statement-token-def")
+	}
+		
+	return NodeStatementTokenDef{nil}, 0, newError("failed to parse statement-token-def", p.at(start))
+}
+
+// ParseStatementTokenDef parses a prefix of in, returning the number of tokens used.
+func (p *Parser) ParseStatementTokenDef(in []Token) (NodeStatementTokenDef, int, error) {
+	p.reset(&sliceSource{tokens: in})
+	return p.parseStatementTokenDef(0)
 }
 
 type NodeStatementTokenAnnotation struct {
@@ -361,23 +891,272 @@ type NodeStatementTokenAnnotation struct {
 
 }
 
-func ParseStatementTokenAnnotation(in []Token) (NodeStatementTokenAnnotation, int, error) {
+func (p *Parser) parseStatementTokenAnnotation(start int) (NodeStatementTokenAnnotation, int, error) {
 	var out NodeStatementTokenAnnotation
-	curr := 0
+	curr := start
 
-	if len(in) <= curr || in[curr].Type != "eq" {
-		return NodeStatementTokenAnnotation{}, 0, newError("failed to parse statement-token-annotation: eq expected", getLineOr0(in, curr))
+	if p.at(curr) == nil || p.at(curr).Type != "eq" {
+		return NodeStatementTokenAnnotation{}, 0, newError("failed to parse statement-token-annotation: eq expected", p.at(curr))
 	}
-	out.I0 = in[curr]
+	out.I0 = *p.at(curr)
 	curr++
+	p.release(curr)
 	
-	if len(in) <= curr || in[curr].Type != "string" {
-		return NodeStatementTokenAnnotation{}, 0, newError("failed to parse statement-token-annotation: string expected", getLineOr0(in, curr))
+	if p.at(curr) == nil || p.at(curr).Type != "string" {
+		return NodeStatementTokenAnnotation{}, 0, newError("failed to parse statement-token-annotation: string expected", p.at(curr))
 	}
-	out.I1 = in[curr]
+	out.I1 = *p.at(curr)
 	curr++
+	p.release(curr)
 	
-	return out, curr, nil
+	return out, curr - start, nil
+}
+
+// ParseStatementTokenAnnotation parses a prefix of in, returning the number of tokens used.
+func (p *Parser) ParseStatementTokenAnnotation(in []Token) (NodeStatementTokenAnnotation, int, error) {
+	p.reset(&sliceSource{tokens: in})
+	return p.parseStatementTokenAnnotation(0)
+}
+
+type NodeStatementTokenPattern struct {
+	I0 Token // tilde
+	I1 Token // string
+
+}
+
+func (p *Parser) parseStatementTokenPattern(start int) (NodeStatementTokenPattern, int, error) {
+	var out NodeStatementTokenPattern
+	curr := start
+
+	if p.at(curr) == nil || p.at(curr).Type != "tilde" {
+		return NodeStatementTokenPattern{}, 0, newError("failed to parse statement-token-pattern: tilde expected", p.at(curr))
+	}
+	out.I0 = *p.at(curr)
+	curr++
+	p.release(curr)
+	
+	if p.at(curr) == nil || p.at(curr).Type != "string" {
+		return NodeStatementTokenPattern{}, 0, newError("failed to parse statement-token-pattern: string expected", p.at(curr))
+	}
+	out.I1 = *p.at(curr)
+	curr++
+	p.release(curr)
+	
+	return out, curr - start, nil
+}
+
+// ParseStatementTokenPattern parses a prefix of in, returning the number of tokens used.
+func (p *Parser) ParseStatementTokenPattern(in []Token) (NodeStatementTokenPattern, int, error) {
+	p.reset(&sliceSource{tokens: in})
+	return p.parseStatementTokenPattern(0)
+}
+
+type NodeTokenMode struct {
+	I interface{}
+}
+
+func (p *Parser) parseTokenMode(start int) (NodeTokenMode, int, error) {
+	p.mark(start)
+	defer p.unmark()
+	if node, n, err := p.parseTokenPush(start); err == nil {
+		return NodeTokenMode{node}, n, nil
+	} else if isCut(err) {
+		return NodeTokenMode{nil}, 0, wrap(err, "failed to parse token-mode")
+	}
+		
+	if p.at(start) != nil && p.at(start).Type == "ident" && p.at(start).Data == "pop" {
+		return NodeTokenMode{*p.at(start)}, 1, nil
+	}
+
+	return NodeTokenMode{nil}, 0, newError("failed to parse token-mode", p.at(start))
+}
+
+// ParseTokenMode parses a prefix of in, returning the number of tokens used.
+func (p *Parser) ParseTokenMode(in []Token) (NodeTokenMode, int, error) {
+	p.reset(&sliceSource{tokens: in})
+	return p.parseTokenMode(0)
+}
+
+type NodeTokenPush struct {
+	I0 Token // ident<"push">
+	I1 Token // ident
+
+}
+
+func (p *Parser) parseTokenPush(start int) (NodeTokenPush, int, error) {
+	var out NodeTokenPush
+	curr := start
+
+	if p.at(curr) == nil || p.at(curr).Type != "ident" || p.at(curr).Data != "push" {
+		return NodeTokenPush{}, 0, newError("failed to parse token-push: ident expected", p.at(curr))
+	}
+	out.I0 = *p.at(curr)
+	curr++
+	p.release(curr)
+	
+	if p.at(curr) == nil || p.at(curr).Type != "ident" {
+		return NodeTokenPush{}, 0, newError("failed to parse token-push: ident expected", p.at(curr))
+	}
+	out.I1 = *p.at(curr)
+	curr++
+	p.release(curr)
+	
+	return out, curr - start, nil
+}
+
+// ParseTokenPush parses a prefix of in, returning the number of tokens used.
+func (p *Parser) ParseTokenPush(in []Token) (NodeTokenPush, int, error) {
+	p.reset(&sliceSource{tokens: in})
+	return p.parseTokenPush(0)
+}
+
+type NodeStatementKeyword struct {
+	I0 Token // kw-keyword
+	I1 Token // ident
+	I2 *NodeStatementTokenAnnotation
+	I3 *Token // ident<"nocase">
+	I4 Token // newline
+
+}
+
+func (p *Parser) parseStatementKeyword(start int) (NodeStatementKeyword, int, error) {
+	var out NodeStatementKeyword
+	curr := start
+
+	if p.at(curr) == nil || p.at(curr).Type != "kw-keyword" {
+		return NodeStatementKeyword{}, 0, newError("failed to parse statement-keyword: \"keyword\" expected", p.at(curr))
+	}
+	out.I0 = *p.at(curr)
+	curr++
+	p.release(curr)
+	
+	if p.at(curr) == nil || p.at(curr).Type != "ident" {
+		return NodeStatementKeyword{}, 0, cut(newError("failed to parse statement-keyword: ident expected", p.at(curr)))
+	}
+	out.I1 = *p.at(curr)
+	curr++
+	p.release(curr)
+	
+	p.mark(curr)
+	node2, currChange, err := p.parseStatementTokenAnnotation(curr)
+	p.unmark()
+	if err == nil {
+		out.I2 = &node2
+		curr += currChange
+	} else if isCut(err) {
+		return NodeStatementKeyword{}, 0, wrap(err, "failed to parse statement-keyword")
+	}
+				
+	if p.at(curr) != nil && p.at(curr).Type == "ident" && p.at(curr).Data == "nocase" {
+		tok := *p.at(curr)
+		out.I3 = &tok
+		curr++
+		p.release(curr)
+	}
+	
+	if p.at(curr) == nil || p.at(curr).Type != "newline" {
+		return NodeStatementKeyword{}, 0, cut(newError("failed to parse statement-keyword: newline expected", p.at(curr)))
+	}
+	out.I4 = *p.at(curr)
+	curr++
+	p.release(curr)
+	
+	return out, curr - start, nil
+}
+
+// ParseStatementKeyword parses a prefix of in, returning the number of tokens used.
+func (p *Parser) ParseStatementKeyword(in []Token) (NodeStatementKeyword, int, error) {
+	p.reset(&sliceSource{tokens: in})
+	return p.parseStatementKeyword(0)
+}
+
+type NodeStatementDirective struct {
+	I0 Token // percent
+	I1 Token // ident
+	I2 []NodeDirectiveArg
+	I3 Token // newline
+
+}
+
+func (p *Parser) parseStatementDirective(start int) (NodeStatementDirective, int, error) {
+	var out NodeStatementDirective
+	curr := start
+
+	if p.at(curr) == nil || p.at(curr).Type != "percent" {
+		return NodeStatementDirective{}, 0, newError("failed to parse statement-directive: percent expected", p.at(curr))
+	}
+	out.I0 = *p.at(curr)
+	curr++
+	p.release(curr)
+	
+	if p.at(curr) == nil || p.at(curr).Type != "ident" {
+		return NodeStatementDirective{}, 0, cut(newError("failed to parse statement-directive: ident expected", p.at(curr)))
+	}
+	out.I1 = *p.at(curr)
+	curr++
+	p.release(curr)
+	
+	p.mark(curr)
+	for {
+		node2, currChange, err := p.parseDirectiveArg(curr)
+		if err != nil {
+			if isCut(err) {
+				p.unmark()
+				return NodeStatementDirective{}, 0, wrap(err, "failed to parse statement-directive")
+			}
+			break
+		}
+		if currChange == 0 {
+			break
+		}
+		out.I2 = append(out.I2, node2)
+		curr += currChange
+		p.advance(curr)
+				
+	}
+	p.unmark()
+	if p.at(curr) == nil || p.at(curr).Type != "newline" {
+		return NodeStatementDirective{}, 0, cut(newError("failed to parse statement-directive: newline expected", p.at(curr)))
+	}
+	out.I3 = *p.at(curr)
+	curr++
+	p.release(curr)
+	
+	return out, curr - start, nil
+}
+
+// ParseStatementDirective parses a prefix of in, returning the number of tokens used.
+func (p *Parser) ParseStatementDirective(in []Token) (NodeStatementDirective, int, error) {
+	p.reset(&sliceSource{tokens: in})
+	return p.parseStatementDirective(0)
+}
+
+type NodeDirectiveArg struct {
+	I interface{}
+}
+
+func (p *Parser) parseDirectiveArg(start int) (NodeDirectiveArg, int, error) {
+	p.mark(start)
+	defer p.unmark()
+	if p.at(start) != nil && p.at(start).Type == "ident" {
+		return NodeDirectiveArg{*p.at(start)}, 1, nil
+	}
+
+	if p.at(start) != nil && p.at(start).Type == "string" {
+		return NodeDirectiveArg{*p.at(start)}, 1, nil
+	}
+
+	if p.at(start) != nil && p.at(start).Type == "action" {
+		return NodeDirectiveArg{*p.at(start)}, 1, nil
+	}
+
+	return NodeDirectiveArg{nil}, 0, newError("failed to parse directive-arg", p.at(start))
+}
+
+// ParseDirectiveArg parses a prefix of in, returning the number of tokens used.
+func (p *Parser) ParseDirectiveArg(in []Token) (NodeDirectiveArg, int, error) {
+	p.reset(&sliceSource{tokens: in})
+	return p.parseDirectiveArg(0)
 }
 
 type NodeStatementEmpty struct {
@@ -385,37 +1164,76 @@ type NodeStatementEmpty struct {
 
 }
 
-func ParseStatementEmpty(in []Token) (NodeStatementEmpty, int, error) {
+func (p *Parser) parseStatementEmpty(start int) (NodeStatementEmpty, int, error) {
 	var out NodeStatementEmpty
-	curr := 0
+	curr := start
 
-	if len(in) <= curr || in[curr].Type != "newline" {
-		return NodeStatementEmpty{}, 0, newError("failed to parse statement-empty: newline expected", getLineOr0(in, curr))
+	if p.at(curr) == nil || p.at(curr).Type != "newline" {
+		return NodeStatementEmpty{}, 0, newError("failed to parse statement-empty: newline expected", p.at(curr))
 	}
-	out.I0 = in[curr]
+	out.I0 = *p.at(curr)
 	curr++
+	p.release(curr)
 	
-	return out, curr, nil
+	return out, curr - start, nil
+}
+
+// ParseStatementEmpty parses a prefix of in, returning the number of tokens used.
+func (p *Parser) ParseStatementEmpty(in []Token) (NodeStatementEmpty, int, error) {
+	p.reset(&sliceSource{tokens: in})
+	return p.parseStatementEmpty(0)
 }
 
 type NodeStatement struct {
 	I interface{}
 }
 
-func ParseStatement(in []Token) (NodeStatement, int, error) {
-	if node, curr, err := ParseStatementToken(in); err == nil {
-		return NodeStatement{node}, curr, nil
+func (p *Parser) parseStatement(start int) (NodeStatement, int, error) {
+	p.mark(start)
+	defer p.unmark()
+	if node, n, err := p.parseStatementToken(start); err == nil {
+		return NodeStatement{node}, n, nil
+	} else if isCut(err) {
+		return NodeStatement{nil}, 0, wrap(err, "failed to parse statement")
+	}
+		
+	if node, n, err := p.parseStatementKeyword(start); err == nil {
+		return NodeStatement{node}, n, nil
+	} else if isCut(err) {
+		return NodeStatement{nil}, 0, wrap(err, "failed to parse statement")
 	}
 		
-	if node, curr, err := ParseStatementExpr(in); err == nil {
-		return NodeStatement{node}, curr, nil
+	if node, n, err := p.parseStatementDirective(start); err == nil {
+		return NodeStatement{node}, n, nil
+	} else if isCut(err) {
+		return NodeStatement{nil}, 0, wrap(err, "failed to parse statement")
 	}
 		
-	if node, curr, err := ParseStatementEmpty(in); err == nil {
-		return NodeStatement{node}, curr, nil
+	if node, n, err := p.parseStatementMacro(start); err == nil {
+		return NodeStatement{node}, n, nil
+	} else if isCut(err) {
+		return NodeStatement{nil}, 0, wrap(err, "failed to parse statement")
 	}
 		
-	return NodeStatement{nil}, 0, newError("failed to parse statement", getLineOr0(in, 0))
+	if node, n, err := p.parseStatementExpr(start); err == nil {
+		return NodeStatement{node}, n, nil
+	} else if isCut(err) {
+		return NodeStatement{nil}, 0, wrap(err, "failed to parse statement")
+	}
+		
+	if node, n, err := p.parseStatementEmpty(start); err == nil {
+		return NodeStatement{node}, n, nil
+	} else if isCut(err) {
+		return NodeStatement{nil}, 0, wrap(err, "failed to parse statement")
+	}
+		
+	return NodeStatement{nil}, 0, newError("failed to parse statement", p.at(start))
+}
+
+// ParseStatement parses a prefix of in, returning the number of tokens used.
+func (p *Parser) ParseStatement(in []Token) (NodeStatement, int, error) {
+	p.reset(&sliceSource{tokens: in})
+	return p.parseStatement(0)
 }
 
 type NodeStatements struct {
@@ -423,19 +1241,336 @@ type NodeStatements struct {
 
 }
 
-func ParseStatements(in []Token) (NodeStatements, int, error) {
+func (p *Parser) parseStatements(start int) (NodeStatements, int, error) {
 	var out NodeStatements
-	curr := 0
+	curr := start
 
+	p.mark(curr)
 	for {
-		node0, currChange, err := ParseStatement(in[curr:])
+		node0, currChange, err := p.parseStatement(curr)
 		if err != nil {
+			if isCut(err) {
+				p.unmark()
+				return NodeStatements{}, 0, wrap(err, "failed to parse statements")
+			}
+			break
+		}
+		if currChange == 0 {
 			break
 		}
 		out.I0 = append(out.I0, node0)
 		curr += currChange
+		p.advance(curr)
 				
 	}
-	return out, curr, nil
+	p.unmark()
+	return out, curr - start, nil
+}
+
+// ParseStatements parses a prefix of in, returning the number of tokens used.
+func (p *Parser) ParseStatements(in []Token) (NodeStatements, int, error) {
+	p.reset(&sliceSource{tokens: in})
+	return p.parseStatements(0)
+}
+
+type ListOfNodeUnit struct {
+	Items []NodeUnit
+	Seps []Token
+}
+
+// list(unit, comma)
+func (p *Parser) parseList0(start int) (ListOfNodeUnit, int, error) {
+	var out ListOfNodeUnit
+	curr := start
+	p.mark(start)
+	defer p.unmark()
+	end := start
+	for {
+		node, currChange, err := p.parseUnit(curr)
+		if err != nil {
+			if isCut(err) {
+				return ListOfNodeUnit{}, 0, wrap(err, "failed to parse list(unit, comma)")
+			}
+			break
+		}
+		out.Items = append(out.Items, node)
+		curr += currChange
+		end = curr
+		p.advance(curr)
+
+		if p.at(curr) == nil || p.at(curr).Type != "comma" {
+			return out, curr - start, nil
+		}
+		out.Seps = append(out.Seps, *p.at(curr))
+		curr++
+	}
+
+	if len(out.Items) == 0 {
+		return ListOfNodeUnit{}, 0, newError("failed to parse list(unit, comma): unit expected", p.at(curr))
+	}
+
+	if len(out.Seps) > 0 && len(out.Seps) == len(out.Items) {
+		out.Seps = out.Seps[:len(out.Seps)-1]
+	}
+	return out, end - start, nil
+}
+
+type ListOfToken struct {
+	Items []Token
+	Seps []Token
+}
+
+// list(ident, comma)
+func (p *Parser) parseList1(start int) (ListOfToken, int, error) {
+	var out ListOfToken
+	curr := start
+	p.mark(start)
+	defer p.unmark()
+	end := start
+	for {
+		if p.at(curr) == nil || p.at(curr).Type != "ident" {
+			break
+		}
+		out.Items = append(out.Items, *p.at(curr))
+		curr++
+		end = curr
+		p.advance(curr)
+
+		if p.at(curr) == nil || p.at(curr).Type != "comma" {
+			return out, curr - start, nil
+		}
+		out.Seps = append(out.Seps, *p.at(curr))
+		curr++
+	}
+
+	if len(out.Items) == 0 {
+		return ListOfToken{}, 0, newError("failed to parse list(ident, comma): ident expected", p.at(curr))
+	}
+
+	if len(out.Seps) > 0 && len(out.Seps) == len(out.Items) {
+		out.Seps = out.Seps[:len(out.Seps)-1]
+	}
+	return out, end - start, nil
+}
+
+type tokenDef struct {
+	Type string
+	Literal string
+	Fold bool
+}
+
+var tokenDefs = []tokenDef{
+	{Type: "eq", Literal: "="},
+	{Type: "or", Literal: "|"},
+	{Type: "al", Literal: "<"},
+	{Type: "ar", Literal: ">"},
+	{Type: "ell", Literal: "..."},
+	{Type: "opt", Literal: "?"},
+	{Type: "newline", Literal: "\n"},
+	{Type: "lparen", Literal: "("},
+	{Type: "rparen", Literal: ")"},
+	{Type: "comma", Literal: ","},
+	{Type: "amp", Literal: "&"},
+	{Type: "bang", Literal: "!"},
+	{Type: "dot", Literal: "."},
+	{Type: "tilde", Literal: "~"},
+	{Type: "percent", Literal: "%"},
+	{Type: "cut", Literal: "^"},
+	{Type: "kw-token", Literal: "token"},
+	{Type: "kw-keyword", Literal: "keyword"},
+}
+
+func matchLiteral(src string, def tokenDef) bool {
+	if def.Fold {
+		return len(src) >= len(def.Literal) && strings.EqualFold(src[:len(def.Literal)], def.Literal)
+	}
+	return strings.HasPrefix(src, def.Literal)
+}
+
+type lexer struct {
+	src string // input read but not yet lexed, from i on
+	i int
+	r io.Reader // the rest of the input, or nil
+	err error // error from r
+	line int
+	col int // in runes
+}
+
+// more reads the next chunk of input into src, returning false at the end
+// of input. Chunks grow with src so that long tokens take few reads.
+func (l *lexer) more() bool {
+	if l.r == nil {
+		return false
+	}
+	size := 4096
+	if len(l.src) > size {
+		size = len(l.src)
+	}
+	buf := make([]byte, size)
+	n, err := io.ReadFull(l.r, buf)
+	l.src += string(buf[:n])
+	if err != nil {
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			l.err = err
+		}
+		l.r = nil
+	}
+	return n > 0
+}
+
+// advance moves past the next n bytes, keeping track of the line and column.
+func (l *lexer) advance(n int) {
+	text := l.src[l.i : l.i+n]
+	if j := strings.LastIndexByte(text, '\n'); j >= 0 {
+		l.line += strings.Count(text, "\n")
+		l.col = 1
+		text = text[j+1:]
+	}
+	l.col += utf8.RuneCountInString(text)
+	l.i += n
+}
+
+func (l *lexer) errorf(format string, args ...interface{}) error {
+	return Error{Message: fmt.Sprintf(format, args...), Line: l.line, Col: l.col}
+}
+
+// validPrefix returns the length of the longest valid UTF-8 prefix of s.
+func validPrefix(s string) int {
+	for i, r := range s {
+		if r == utf8.RuneError {
+			if _, size := utf8.DecodeRuneInString(s[i:]); size == 1 {
+				return i
+			}
+		}
+	}
+	return len(s)
+}
+
+// match returns the index of the longest matching token definition and
+// the length of its match, or -1 if none match.
+func (l *lexer) match() (int, int) {
+	best := -1
+	bestLen := 0
+	for j, def := range tokenDefs {
+		n := 0
+		if matchLiteral(l.src[l.i:], def) {
+			n = len(def.Literal)
+		}
+		if n > bestLen {
+			best = j
+			bestLen = n
+		}
+	}
+	return best, bestLen
+}
+
+// Next returns the next token, or false at the end of input.
+func (l *lexer) Next() (Token, bool, error) {
+	for {
+		l.src = l.src[l.i:]
+		l.i = 0
+		for len(l.src) < 1024 && l.more() {
+		}
+		if l.err != nil {
+			return Token{}, false, l.err
+		}
+		if l.i >= len(l.src) {
+			return Token{}, false, nil
+		}
+
+		// A match running to the end of what has been read, or no match
+		// at all, might change with more input.
+		best, bestLen := l.match()
+		if (best < 0 && !(l.src[l.i] == ' ' || l.src[l.i] == '\t' || l.src[l.i] == '\r' || l.src[l.i] == '\n') || best >= 0 && l.i+bestLen == len(l.src)) && l.more() {
+			continue
+		}
+		if best < 0 {
+			if l.src[l.i] == ' ' || l.src[l.i] == '\t' || l.src[l.i] == '\r' || l.src[l.i] == '\n' {
+				l.advance(1)
+				continue
+			}
+			r, size := utf8.DecodeRuneInString(l.src[l.i:])
+			if r == utf8.RuneError && size == 1 {
+				return Token{}, false, l.errorf("invalid UTF-8")
+			}
+			return Token{}, false, l.errorf("invalid token: %q", l.src[l.i:l.i+size])
+		}
+
+		def := tokenDefs[best]
+		text := l.src[l.i : l.i+bestLen]
+		if n := validPrefix(text); n < len(text) {
+			l.advance(n)
+			return Token{}, false, l.errorf("invalid UTF-8")
+		}
+		tok := Token{Type: def.Type, Data: text, Line: l.line, Col: l.col}
+		l.advance(bestLen)
+		return tok, true, nil
+	}
+}
+
+// NewLexer returns a TokenSource that lexes r as tokens are requested.
+func NewLexer(r io.Reader) TokenSource {
+	return &lexer{r: r, line: 1, col: 1}
+}
+
+func Lex(src string) ([]Token, error) {
+	l := &lexer{src: src, line: 1, col: 1}
+	out := make([]Token, 0)
+	for {
+		tok, ok, err := l.Next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return out, nil
+		}
+		out = append(out, tok)
+	}
+}
+
+func (p *Parser) ParseStatementsFrom(src TokenSource) (*NodeStatements, error) {
+	p.reset(src)
+	out, n, err := p.parseStatements(0)
+	if err == nil && p.at(n) != nil {
+		err = newError("failed to parse statements: unexpected "+p.at(n).Type, p.at(n))
+	}
+	if p.err != nil {
+		err = p.err
+	}
+	if err != nil {
+		var zero *NodeStatements
+		return zero, err
+	}
+	return &out, nil
+}
+
+func (p *Parser) ParseStatementsTokens(in []Token) (*NodeStatements, error) {
+	return p.ParseStatementsFrom(&sliceSource{tokens: in})
+}
+
+func ParseStatementsFrom(src TokenSource) (*NodeStatements, error) {
+	return new(Parser).ParseStatementsFrom(src)
+}
+
+func ParseStatementsTokens(in []Token) (*NodeStatements, error) {
+	return new(Parser).ParseStatementsTokens(in)
+}
+
+func (p *Parser) Parse(src string) (*NodeStatements, error) {
+	return p.ParseReader(strings.NewReader(src))
+}
+
+// ParseReader lexes r as the parser needs tokens, so the input never has
+// to be held in memory at once.
+func (p *Parser) ParseReader(r io.Reader) (*NodeStatements, error) {
+	return p.ParseStatementsFrom(NewLexer(r))
+}
+
+func Parse(src string) (*NodeStatements, error) {
+	return new(Parser).Parse(src)
+}
+
+func ParseReader(r io.Reader) (*NodeStatements, error) {
+	return new(Parser).ParseReader(r)
 }
 
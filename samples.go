@@ -0,0 +1,476 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unbounded is the height of a rule that never stops expanding.
+const unbounded = math.MaxInt32
+
+// sampler makes random sentences of a grammar. Lookaheads and predicates
+// are not checked, so a sentence can break them.
+type sampler struct {
+	g        *grammar
+	rnd      *rand.Rand
+	depth    int                  // how deeply rules nest before only the shortest ways out are taken
+	weights  map[string][]float64 // rule name to the weights of its alternatives
+	values   map[string][]string  // token name to texts to pick from
+	heights  map[string]int       // rule name to how deeply it must nest at least
+	patterns map[string]*syntax.Regexp
+	literals map[string]bool // texts of tokens matched by their text
+	warned   map[string]bool
+}
+
+type sampleToken struct {
+	typ   string
+	text  string
+	fixed bool // whether every token of the type has the text
+}
+
+func newSampler(g *grammar, seed int64, depth int) *sampler {
+	s := &sampler{g: g, rnd: rand.New(rand.NewSource(seed)), depth: depth, weights: make(map[string][]float64), values: make(map[string][]string), patterns: make(map[string]*syntax.Regexp), literals: make(map[string]bool), warned: make(map[string]bool)}
+	for _, tok := range g.tokens {
+		if tok.literal != "" {
+			s.literals[tok.literal] = true
+		}
+	}
+
+	s.heights = make(map[string]int)
+	for _, rule := range g.rules {
+		s.heights[rule.name] = unbounded
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, rule := range g.rules {
+			if rule.params != nil {
+				continue
+			}
+			h := s.height(rule.body, 0)
+			if h != unbounded {
+				h++
+			}
+			if h < s.heights[rule.name] {
+				s.heights[rule.name] = h
+				changed = true
+			}
+		}
+	}
+	return s
+}
+
+// height returns how deeply rules must nest at least for t to match.
+func (s *sampler) height(t term, depth int) int {
+	switch t.op {
+	case opSeq:
+		h := 0
+		for _, item := range t.items {
+			h = max(h, s.height(item, depth))
+		}
+		return h
+	case opOr:
+		h := unbounded
+		for _, item := range t.items {
+			h = min(h, s.height(item, depth))
+		}
+		return h
+	case opList:
+		if t.empty {
+			return 0
+		}
+		return s.height(t.items[0], depth)
+	case opRule:
+		return s.heights[t.name]
+	case opCall:
+		rule := s.g.ruleOf[t.name]
+		if depth >= maxDepth || len(t.items) != len(rule.params) {
+			return unbounded
+		}
+		h := s.height(rule.body.subst(s.args(t)), depth+1)
+		if h != unbounded {
+			h++
+		}
+		return h
+	}
+	return 0
+}
+
+// args maps the parameters of the rule a call calls to its arguments.
+func (s *sampler) args(t term) map[string]term {
+	args := make(map[string]term)
+	for i, param := range s.g.ruleOf[t.name].params {
+		args[param] = t.items[i]
+	}
+	return args
+}
+
+// fits reports whether t can match without rules nesting deeper than the
+// limit, from depth.
+func (s *sampler) fits(t term, depth int) bool {
+	h := s.height(t, 0)
+	return h != unbounded && depth+h <= s.depth
+}
+
+// more reports whether to match a repeated term once more.
+func (s *sampler) more(t term, depth int) bool {
+	return s.fits(t, depth) && s.rnd.Intn(2) == 0
+}
+
+// sample appends the tokens of a random match of t, a term of the rule
+// named rule, nested depth rules deep.
+func (s *sampler) sample(rule string, t term, depth int, out []sampleToken) []sampleToken {
+	switch t.op {
+	case opSeq:
+		for _, item := range t.items {
+			out = s.sample(rule, item, depth, out)
+		}
+	case opOr:
+		return s.sample(rule, t.items[s.choose(rule, t, depth)], depth, out)
+	case opOpt:
+		if s.more(t.items[0], depth) {
+			out = s.sample(rule, t.items[0], depth, out)
+		}
+	case opMany:
+		for s.more(t.items[0], depth) {
+			out = s.sample(rule, t.items[0], depth, out)
+		}
+	case opList:
+		if t.empty && !s.more(t.items[0], depth) {
+			return out
+		}
+		out = s.sample(rule, t.items[0], depth, out)
+		for s.more(t.items[0], depth) {
+			out = s.sample(rule, t.items[1], depth, out)
+			out = s.sample(rule, t.items[0], depth, out)
+		}
+		if t.trailing && s.rnd.Intn(2) == 0 {
+			out = s.sample(rule, t.items[1], depth, out)
+		}
+	case opRule:
+		return s.sample(t.name, s.g.ruleOf[t.name].body, depth+1, out)
+	case opCall:
+		return s.sample(t.name, s.g.ruleOf[t.name].body.subst(s.args(t)), depth+1, out)
+	case opText:
+		return append(out, sampleToken{typ: t.name, text: t.text, fixed: true})
+	case opToken:
+		if t.text != "" {
+			return append(out, sampleToken{typ: t.name, text: t.text, fixed: true})
+		}
+		return append(out, s.token(t.name))
+	case opAny:
+		var names []string
+		for _, tok := range s.g.tokens {
+			if tok.literal != "" || tok.pattern != "" || s.values[tok.name] != nil {
+				names = append(names, tok.name)
+			}
+		}
+		if names == nil {
+			s.warnf(".", "no token has a text or a pattern to match . with")
+			return out
+		}
+		return append(out, s.token(names[s.rnd.Intn(len(names))]))
+	}
+	return out
+}
+
+// choose picks an alternative of an or term by the weights of the rule's
+// alternatives, from those that fit in the depth left, or else from the
+// shortest.
+func (s *sampler) choose(rule string, t term, depth int) int {
+	var fit []int
+	for i, item := range t.items {
+		if s.fits(item, depth) {
+			fit = append(fit, i)
+		}
+	}
+	if fit == nil {
+		least := unbounded
+		for i, item := range t.items {
+			if h := s.height(item, 0); h < least {
+				least, fit = h, []int{i}
+			} else if h == least {
+				fit = append(fit, i)
+			}
+		}
+	}
+
+	weights := s.weights[rule]
+	total := 0.0
+	for _, i := range fit {
+		if weights != nil {
+			total += weights[i]
+		} else {
+			total++
+		}
+	}
+	if total == 0 {
+		return fit[s.rnd.Intn(len(fit))]
+	}
+	x := s.rnd.Float64() * total
+	for _, i := range fit {
+		w := 1.0
+		if weights != nil {
+			w = weights[i]
+		}
+		if x < w {
+			return i
+		}
+		x -= w
+	}
+	return fit[len(fit)-1]
+}
+
+// token returns a token of a type: one of its given values, its text, or
+// a random match of its pattern that no token with a text has.
+func (s *sampler) token(name string) sampleToken {
+	if values := s.values[name]; values != nil {
+		return sampleToken{typ: name, text: values[s.rnd.Intn(len(values))]}
+	}
+	tok := s.g.tokenOf[name]
+	if tok.literal != "" {
+		return sampleToken{typ: name, text: tok.literal, fixed: true}
+	}
+	if tok.pattern == "" {
+		s.warnf(name, "token %s has no text or pattern, so its name is written instead; give it values with -value", name)
+		return sampleToken{typ: name, text: name}
+	}
+
+	re, ok := s.patterns[name]
+	if !ok {
+		var err error
+		if re, err = syntax.Parse(tok.pattern, syntax.Perl); err != nil {
+			s.warnf(name, "token %s: %v", name, err)
+		} else {
+			re = re.Simplify()
+		}
+		s.patterns[name] = re
+	}
+	if re == nil {
+		return sampleToken{typ: name, text: name}
+	}
+	b := &strings.Builder{}
+	for try := 0; try < 10; try++ {
+		b.Reset()
+		s.sampleRegexp(re, b)
+		if !s.literals[b.String()] {
+			break
+		}
+	}
+	return sampleToken{typ: name, text: b.String()}
+}
+
+// sampleRegexp writes a random match of re, preferring printable ASCII
+// where it can choose characters.
+func (s *sampler) sampleRegexp(re *syntax.Regexp, b *strings.Builder) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		b.WriteString(string(re.Rune))
+	case syntax.OpCharClass:
+		b.WriteRune(s.sampleClass(re.Rune))
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		b.WriteRune(rune(' ' + 1 + s.rnd.Intn('~'-' ')))
+	case syntax.OpCapture:
+		s.sampleRegexp(re.Sub[0], b)
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			s.sampleRegexp(sub, b)
+		}
+	case syntax.OpAlternate:
+		s.sampleRegexp(re.Sub[s.rnd.Intn(len(re.Sub))], b)
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		lo, hi := re.Min, re.Max
+		switch re.Op {
+		case syntax.OpStar:
+			lo, hi = 0, -1
+		case syntax.OpPlus:
+			lo, hi = 1, -1
+		case syntax.OpQuest:
+			lo, hi = 0, 1
+		}
+		n := lo
+		if hi < 0 {
+			for n < lo+8 && s.rnd.Intn(2) == 0 {
+				n++
+			}
+		} else {
+			n += s.rnd.Intn(hi - lo + 1)
+		}
+		for i := 0; i < n; i++ {
+			s.sampleRegexp(re.Sub[0], b)
+		}
+	}
+}
+
+// sampleClass picks a character of a class, given as pairs of runes that
+// start and end ranges.
+func (s *sampler) sampleClass(ranges []rune) rune {
+	if len(ranges) == 0 {
+		return ' '
+	}
+	var printable []rune
+	for i := 0; i < len(ranges); i += 2 {
+		for r := max(int(ranges[i]), ' '); r <= min(int(ranges[i+1]), '~'); r++ {
+			printable = append(printable, rune(r))
+		}
+	}
+	if printable != nil {
+		return printable[s.rnd.Intn(len(printable))]
+	}
+	i := s.rnd.Intn(len(ranges)/2) * 2
+	lo, hi := ranges[i], ranges[i+1]
+	return lo + rune(s.rnd.Int63n(int64(min(int(hi-lo), 0xff))+1))
+}
+
+func (s *sampler) warnf(key string, format string, args ...interface{}) {
+	if !s.warned[key] {
+		s.warned[key] = true
+		fmt.Fprintf(os.Stderr, "llgen: warning: "+format+"\n", args...)
+	}
+}
+
+// sampleText joins the texts of tokens with a space, except next to tokens
+// that are only whitespace.
+func sampleText(toks []sampleToken) string {
+	b := &strings.Builder{}
+	for i, tok := range toks {
+		if i != 0 && strings.TrimSpace(tok.text) != "" && strings.TrimSpace(toks[i-1].text) != "" {
+			b.WriteString(" ")
+		}
+		b.WriteString(tok.text)
+	}
+	return b.String()
+}
+
+// sampleTokens writes tokens in grammar syntax: "text" for the tokens
+// created for a text and type<"text"> for the others.
+func sampleTokens(toks []sampleToken) string {
+	parts := make([]string, len(toks))
+	for i, tok := range toks {
+		if tok.fixed && tok.typ == strconv.Quote(tok.text) {
+			parts[i] = strconv.Quote(tok.text)
+		} else {
+			parts[i] = tok.typ + "<" + strconv.Quote(tok.text) + ">"
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func genSamplesCommand(args []string) error {
+	flags := flag.NewFlagSet("gen-samples", flag.ExitOnError)
+	n := flags.Int("n", 10, "number of samples")
+	depth := flags.Int("depth", 10, "how deeply rules nest before only the shortest ways out are taken")
+	seed := flags.Int64("seed", 0, "seed of the random choices; 0 picks one from the clock and prints it")
+	start := flags.String("start", "", "`rule` to make samples of, by default the first %start rule")
+	tokens := flags.Bool("tokens", false, "write the tokens of each sample instead of its text")
+	out := flags.String("o", "", "write each sample to a file in `dir` instead of a line of standard output")
+	weights := make(map[string][]float64)
+	flags.Func("weight", "weights of the alternatives of a rule, as `rule=w1,w2,...`; may be repeated", func(arg string) error {
+		eq := strings.Index(arg, "=")
+		if eq < 0 {
+			return fmt.Errorf("rule=w1,w2,... expected")
+		}
+		for _, w := range strings.Split(arg[eq+1:], ",") {
+			f, err := strconv.ParseFloat(w, 64)
+			if err != nil || f < 0 {
+				return fmt.Errorf("invalid weight: %s", w)
+			}
+			weights[arg[:eq]] = append(weights[arg[:eq]], f)
+		}
+		return nil
+	})
+	values := make(map[string][]string)
+	flags.Func("value", "a text for a token to take, as `token=text`; may be repeated to pick from several", func(arg string) error {
+		eq := strings.Index(arg, "=")
+		if eq < 0 {
+			return fmt.Errorf("token=text expected")
+		}
+		values[arg[:eq]] = append(values[arg[:eq]], arg[eq+1:])
+		return nil
+	})
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: llgen gen-samples [FLAGS] FILE\n\nWrites random sentences of a grammar, for tests and fuzzing. Lookaheads and predicates are not checked.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	g, err := readGrammar(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+		fmt.Fprintf(os.Stderr, "llgen: seed %v\n", *seed)
+	}
+	s := newSampler(g, *seed, *depth)
+	for name, w := range weights {
+		rule := g.ruleOf[name]
+		if rule == nil {
+			return fmt.Errorf("-weight: unknown rule: %s", name)
+		}
+		alts := 1
+		if rule.body.op == opOr {
+			alts = len(rule.body.items)
+		}
+		if alts != len(w) {
+			return fmt.Errorf("-weight: %s has %v alternatives, got %v weights", name, alts, len(w))
+		}
+		s.weights[name] = w
+	}
+	for name, v := range values {
+		if g.tokenOf[name] == nil {
+			return fmt.Errorf("-value: unknown token: %s", name)
+		}
+		s.values[name] = v
+	}
+
+	if *start == "" && g.starts != nil {
+		*start = g.starts[0]
+	}
+	for _, rule := range g.rules {
+		if *start == "" && rule.params == nil {
+			*start = rule.name
+		}
+	}
+	rule := g.ruleOf[*start]
+	if rule == nil || rule.params != nil {
+		return fmt.Errorf("unknown start rule: %s", *start)
+	}
+	if s.heights[rule.name] == unbounded {
+		return fmt.Errorf("%s never stops expanding, so it has no sentences", rule.name)
+	}
+
+	if *out != "" {
+		if err := os.MkdirAll(*out, 0755); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < *n; i++ {
+		toks := s.sample(rule.name, rule.body, 1, nil)
+		text := sampleText(toks)
+		if *tokens {
+			text = sampleTokens(toks)
+		}
+		if *out == "" {
+			fmt.Println(text)
+			continue
+		}
+		name := fmt.Sprintf("sample-%0*d.txt", len(strconv.Itoa(*n)), i+1)
+		if err := ioutil.WriteFile(filepath.Join(*out, name), []byte(text), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
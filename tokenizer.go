@@ -3,82 +3,297 @@ package main
 import (
 	"fmt"
 	"github.com/allen-b1/llgen/parser"
+	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
+// keywords maps reserved words to their token types.
+var keywords = map[string]string{
+	"token":   "kw-token",
+	"keyword": "kw-keyword",
+}
+
 func tokenize(in string) ([]parser.Token, error) {
+	return tokenizeSource(in, nil)
+}
+
+// source is what the tokens leave out of a grammar's text, which llgen fmt
+// needs to print it again: comments, and strings and actions as written.
+type source struct {
+	comments map[int]string    // line to the comment that ends it
+	text     map[[2]int]string // line and column of a string or action to its text
+}
+
+// tokenizeSource tokenizes in, recording its comments and the text of its
+// strings and actions in src unless it is nil.
+func tokenizeSource(in string, src *source) ([]parser.Token, error) {
 	in = strings.Replace(in, "\r", "", -1)
+	if err := checkUTF8(in); err != nil {
+		return nil, err
+	}
 
 	out := make([]parser.Token, 0)
 	line := 1
+	lineStart := 0
 	i := 0
+	// tok returns a token starting at in[i]. Columns count runes.
+	tok := func(typ string, data string) parser.Token {
+		return parser.Token{Type: typ, Data: data, Line: line, Col: utf8.RuneCountInString(in[lineStart:i]) + 1}
+	}
+	// errorAt returns an error at in[j], which must be on the current line.
+	errorAt := func(j int, format string, args ...interface{}) error {
+		return parser.Error{Message: fmt.Sprintf(format, args...), Line: line, Col: utf8.RuneCountInString(in[lineStart:j]) + 1}
+	}
+	errorf := func(format string, args ...interface{}) error {
+		return errorAt(i, format, args...)
+	}
+	// record adds the text from in[i] to end, that of tok, to src.
+	record := func(tok parser.Token, end int) parser.Token {
+		if src != nil {
+			src.text[[2]int{tok.Line, tok.Col}] = in[i:end]
+		}
+		return tok
+	}
+	// skipTo moves i to end, keeping track of the lines in between.
+	skipTo := func(end int) {
+		line += strings.Count(in[i:end], "\n")
+		if j := strings.LastIndexByte(in[i:end], '\n'); j >= 0 {
+			lineStart = i + j + 1
+		}
+		i = end
+	}
 	for i < len(in) {
 		if in[i] == '=' {
-			out = append(out, parser.Token{"eq", "=", line})
+			out = append(out, tok("eq", "="))
 			i += 1
 			continue
 		}
 		if in[i] == '|' {
-			out = append(out, parser.Token{"or", "|", line})
+			out = append(out, tok("or", "|"))
 			i += 1
 			continue
 		}
 		if in[i] == '<' {
-			out = append(out, parser.Token{"al", "<", line})
+			out = append(out, tok("al", "<"))
 			i += 1
 			continue
 		}
 		if in[i] == '>' {
-			out = append(out, parser.Token{"ar", ">", line})
+			out = append(out, tok("ar", ">"))
 			i += 1
 			continue
 		}
 		if in[i] == '\n' {
-			out = append(out, parser.Token{"newline", "", line})
-			line += 1
+			out = append(out, tok("newline", ""))
+			skipTo(i + 1)
+			continue
+		}
+		if in[i] == '(' {
+			out = append(out, tok("lparen", "("))
+			i += 1
+			continue
+		}
+		if in[i] == ')' {
+			out = append(out, tok("rparen", ")"))
+			i += 1
+			continue
+		}
+		if in[i] == ',' {
+			out = append(out, tok("comma", ","))
+			i += 1
+			continue
+		}
+		if in[i] == '&' {
+			out = append(out, tok("amp", "&"))
+			i += 1
+			continue
+		}
+		if in[i] == '!' {
+			out = append(out, tok("bang", "!"))
+			i += 1
+			continue
+		}
+		if in[i] == '~' {
+			out = append(out, tok("tilde", "~"))
+			i += 1
+			continue
+		}
+		if in[i] == '{' {
+			end, err := scanAction(in, i)
+			if err != nil {
+				return nil, errorf("%v", err)
+			}
+			out = append(out, record(tok("action", strings.TrimSpace(in[i+1:end-1])), end))
+			skipTo(end)
+			continue
+		}
+		if in[i] == '^' {
+			out = append(out, tok("cut", "^"))
+			i += 1
+			continue
+		}
+		if in[i] == '%' {
+			out = append(out, tok("percent", "%"))
 			i += 1
 			continue
 		}
 		if in[i] == '?' {
-			out = append(out, parser.Token{"opt", "?", line})
+			out = append(out, tok("opt", "?"))
 			i += 1
 			continue
 		}
-		if unicode.IsLetter(rune(in[i])) {
-			end := i
-			for end < len(in) && (unicode.IsLetter(rune(in[end])) || unicode.IsNumber(rune(in[end])) || in[end] == '-') {
-				end += 1
+		r, size := utf8.DecodeRuneInString(in[i:])
+		if unicode.IsLetter(r) {
+			end := i + size
+			for end < len(in) {
+				r, size := utf8.DecodeRuneInString(in[end:])
+				if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' {
+					break
+				}
+				end += size
+			}
+			typ := "ident"
+			if kw, ok := keywords[in[i:end]]; ok {
+				typ = kw
 			}
-			out = append(out, parser.Token{"ident", in[i:end], line})
+			out = append(out, tok(typ, in[i:end]))
 			i = end
 			continue
 		}
 		if in[i] == '"' {
-			end := i + 1
-			for end < len(in) && (in[end] != '"' || in[end-1] == '\\') {
-				end += 1
+			data, end, err := scanString(in, i)
+			if err != nil {
+				return nil, errorAt(end, "%v", err)
+			}
+			out = append(out, record(tok("string", data), end))
+			skipTo(end)
+			continue
+		}
+		if in[i] == '`' {
+			end := strings.IndexByte(in[i+1:], '`')
+			if end < 0 {
+				return nil, errorf("unterminated raw string")
 			}
-			out = append(out, parser.Token{"string", strings.NewReplacer("\\n", "\n", "\\\"", "\"").Replace(in[i+1 : end]), line})
-			i = end + 1
+			out = append(out, record(tok("string", in[i+1:i+1+end]), i+end+2))
+			skipTo(i + end + 2)
 			continue
 		}
 		if in[i] == '.' {
-			if len(in) <= i+2 {
-				return nil, parser.Error{"expected ., got EOF", line}
+			if strings.HasPrefix(in[i:], "...") {
+				out = append(out, tok("ell", "..."))
+				i += 3
+				continue
 			}
-			if in[i+1] != '.' || in[i+2] != '.' {
-				return nil, parser.Error{"expected .", line}
+			if strings.HasPrefix(in[i:], "..") {
+				return nil, errorf("expected .")
 			}
-			out = append(out, parser.Token{"ell", "...", line})
-			i += 3
+			out = append(out, tok("dot", "."))
+			i += 1
 			continue
 		}
 		if in[i] == ' ' || in[i] == '\t' {
 			i++
 			continue
 		}
-		return nil, parser.Error{fmt.Sprintf("invalid token: %c", in[i]), line}
+		if in[i] == '#' {
+			end := strings.IndexByte(in[i:], '\n')
+			if end < 0 {
+				end = len(in) - i
+			}
+			if src != nil {
+				src.comments[line] = strings.TrimRight(in[i:i+end], " \t")
+			}
+			i += end
+			continue
+		}
+		return nil, errorf("invalid token: %c", r)
 	}
 	return out, nil
 }
+
+// checkUTF8 reports the position of the first invalid UTF-8 in in.
+func checkUTF8(in string) error {
+	for i, r := range in {
+		if r != utf8.RuneError {
+			continue
+		}
+		if _, size := utf8.DecodeRuneInString(in[i:]); size == 1 {
+			lineStart := strings.LastIndexByte(in[:i], '\n') + 1
+			return parser.Error{
+				Message: "invalid UTF-8",
+				Line:    strings.Count(in[:i], "\n") + 1,
+				Col:     utf8.RuneCountInString(in[lineStart:i]) + 1,
+			}
+		}
+	}
+	return nil
+}
+
+// scanString decodes the Go-style string starting at in[start], returning
+// its value and the index just past the closing quote. On error, the index
+// is where the problem is.
+func scanString(in string, start int) (string, int, error) {
+	var b strings.Builder
+	i := start + 1
+	for {
+		if i >= len(in) || in[i] == '\n' {
+			return "", i, fmt.Errorf("unterminated string")
+		}
+		if in[i] == '"' {
+			return b.String(), i + 1, nil
+		}
+		r, multibyte, tail, err := strconv.UnquoteChar(in[i:], '"')
+		if err != nil {
+			return "", i, fmt.Errorf("invalid escape in string")
+		}
+		if multibyte {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte(byte(r))
+		}
+		i = len(in) - len(tail)
+	}
+}
+
+// scanAction returns the index just past the brace that closes the Go
+// block starting at in[start], skipping over strings and comments.
+func scanAction(in string, start int) (int, error) {
+	depth := 0
+	i := start
+	for i < len(in) {
+		switch {
+		case in[i] == '{':
+			depth++
+		case in[i] == '}':
+			depth--
+			if depth == 0 {
+				return i + 1, nil
+			}
+		case strings.HasPrefix(in[i:], "//"):
+			for i < len(in) && in[i] != '\n' {
+				i++
+			}
+			continue
+		case strings.HasPrefix(in[i:], "/*"):
+			end := strings.Index(in[i+2:], "*/")
+			if end < 0 {
+				return 0, fmt.Errorf("unterminated comment in action")
+			}
+			i += end + 4
+			continue
+		case in[i] == '"' || in[i] == '\'' || in[i] == '`':
+			quote := in[i]
+			i++
+			for i < len(in) && in[i] != quote {
+				if in[i] == '\\' && quote != '`' {
+					i++
+				}
+				i++
+			}
+		}
+		i++
+	}
+	return 0, fmt.Errorf("unterminated action")
+}